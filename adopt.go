@@ -0,0 +1,143 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/glottis/inotify"
+	"github.com/malumar/pguard/client"
+)
+
+// errNotAdoptable is returned for adopt paths outside the adoptable roots.
+var errNotAdoptable = errors.New("path is not below an adoptable root")
+
+var (
+	// adoptRoot is a cgroup directory besides usersPath whose subgroups may
+	// be adopted, e.g. the tree of another tool.
+	adoptRoot string
+
+	// adopted are the subgroups pguard took over with adopt. They are swept
+	// with the rest, wherever they are.
+	adoptedMu sync.Mutex
+	adopted   = make(map[string]struct{})
+)
+
+// adoptCommand takes over a cgroup created by someone else, e.g.
+// "adopt|alice.slice/job|business": the plan's limits are written to it, the
+// plan is recorded and the cgroup is watched and removed once it is empty,
+// like the subgroups pguard creates itself. Relative paths are relative to
+// usersPath.
+func adoptCommand(conn net.Conn, args []string) {
+	if len(args) != 2 {
+		reply(conn, "ERR %s expected adopt|path|plan", client.CodeBadRequest)
+		return
+	}
+	path, err := adoptablePath(args[0])
+	if err != nil {
+		slog.Error("Refusing to adopt cgroup", "path", args[0], "err", err)
+		reply(conn, "ERR %s %v", client.CodeBadRequest, err)
+		return
+	}
+
+	config, ok := getPlanConfig(args[1])
+	if !ok {
+		reply(conn, "ERR %s %v %q", client.CodeUnknownPlan, errUnknownPlan, args[1])
+		return
+	}
+	plan := resolvePlan(args[1])
+	dir, err := openCgroupDir(path)
+	if err != nil {
+		reply(conn, "ERR %s %v", errorCode(err), err)
+		return
+	}
+	defer dir.Close()
+	if err := layout.applyLimits(dir, path, config); err != nil {
+		slog.Error("Failed to apply limits to adopted cgroup", "path", path, "err", err)
+		reply(conn, "ERR %s %v", errorCode(err), err)
+		return
+	}
+	if err := setMeta(path, metaPlan, plan); err != nil {
+		slog.Error("Failed to record plan", "path", path, "err", err)
+	}
+	if err := setMeta(path, metaPriority, priorityNormal); err != nil {
+		slog.Error("Failed to record priority", "path", path, "err", err)
+	}
+
+	adoptedMu.Lock()
+	adopted[path] = struct{}{}
+	adoptedMu.Unlock()
+	// A cgroup adopted in a user slice counts against its subgroups.
+	forgetSubgroupCount(filepath.Dir(path))
+	if activeWatcher != nil {
+		if err := addWatch(activeWatcher, path); err != nil {
+			slog.Error("Failed to watch adopted cgroup", "path", path, "err", err)
+		}
+	}
+	metrics.Add("cgroups_adopted", 1, "plan", plan)
+	slog.Info("Cgroup adopted", "path", path, "plan", plan)
+	reply(conn, "adopted path=%s plan=%s", path, plan)
+}
+
+// adoptablePath resolves path, following symlinks, and checks that it is a
+// cgroup strictly below usersPath or -adoptRoot.
+func adoptablePath(path string) (string, error) {
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(usersPath, path)
+	}
+	resolved, err := filepath.EvalSymlinks(filepath.Clean(path))
+	if err != nil {
+		return "", err
+	}
+	roots := []string{usersPath}
+	if adoptRoot != "" {
+		roots = append(roots, adoptRoot)
+	}
+	for _, root := range roots {
+		root, err := filepath.EvalSymlinks(root)
+		if err != nil {
+			continue
+		}
+		if strings.HasPrefix(resolved, root+"/") {
+			if _, err := os.Stat(filepath.Join(resolved, "cgroup.procs")); err != nil {
+				return "", fmt.Errorf("%s is not a cgroup: %w", resolved, err)
+			}
+			return resolved, nil
+		}
+	}
+	return "", fmt.Errorf("%s: %w", path, errNotAdoptable)
+}
+
+// isAdopted reports whether path is a cgroup taken over with adopt.
+func isAdopted(path string) bool {
+	adoptedMu.Lock()
+	defer adoptedMu.Unlock()
+	_, ok := adopted[path]
+	return ok
+}
+
+// cleanupAdopted removes the adopted cgroups that became empty and forgets the
+// ones that are gone.
+func cleanupAdopted(watcher *inotify.Watcher) {
+	adoptedMu.Lock()
+	paths := make([]string, 0, len(adopted))
+	for path := range adopted {
+		paths = append(paths, path)
+	}
+	adoptedMu.Unlock()
+
+	for _, path := range paths {
+		_, err := os.Stat(path)
+		if errors.Is(err, fs.ErrNotExist) || err == nil && cleanupSubgroup(path, watcher) {
+			adoptedMu.Lock()
+			delete(adopted, path)
+			adoptedMu.Unlock()
+		}
+	}
+}
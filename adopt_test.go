@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAdoptablePath(t *testing.T) {
+	tree := newTestTree(t)
+	system := filepath.Join(delegatedRoot, "system.slice")
+	tools := filepath.Join(delegatedRoot, "tools")
+	for _, dir := range []string{usersPath + "alice.slice", usersPath + "alice.slice/job", system, tools, tools + "/tool1"} {
+		if err := tree.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(usersPath+"alice.slice/plain", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(system, usersPath+"escape"); err != nil {
+		t.Fatal(err)
+	}
+	saved := adoptRoot
+	t.Cleanup(func() { adoptRoot = saved })
+
+	job := filepath.Clean(usersPath + "alice.slice/job")
+	for _, test := range []struct {
+		path, root, want string
+		notAdoptable     bool
+	}{
+		{path: "alice.slice/job", want: job},
+		{path: job, want: job},
+		{path: "alice.slice/../alice.slice/job", want: job},
+		{path: "../system.slice", notAdoptable: true},
+		{path: system, notAdoptable: true},
+		{path: "escape", notAdoptable: true},
+		{path: ".", notAdoptable: true},
+		{path: tools + "/tool1", notAdoptable: true},
+		{path: tools + "/tool1", root: tools, want: tools + "/tool1"},
+		{path: tools, root: tools, notAdoptable: true},
+		{path: "alice.slice/plain"},
+		{path: "alice.slice/nosuch"},
+	} {
+		adoptRoot = test.root
+		got, err := adoptablePath(test.path)
+		switch {
+		case test.want != "":
+			if err != nil || got != test.want {
+				t.Errorf("adoptablePath(%q) with root %q = %q, %v; want %q", test.path, test.root, got, err, test.want)
+			}
+		case test.notAdoptable:
+			if !errors.Is(err, errNotAdoptable) {
+				t.Errorf("adoptablePath(%q) with root %q = %q, %v; want errNotAdoptable", test.path, test.root, got, err)
+			}
+		case err == nil:
+			t.Errorf("adoptablePath(%q) = %q, want an error for a path that isn't a cgroup", test.path, got)
+		}
+	}
+}
+
+func TestAdoptRefusesOutsidePath(t *testing.T) {
+	tree := newTestTree(t)
+	system := filepath.Join(delegatedRoot, "system.slice")
+	if err := tree.Mkdir(system, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if reply := request(t, "adopt|../system.slice|standard"); !strings.HasPrefix(reply, "ERR bad-request ") {
+		t.Errorf("adopting a cgroup outside usersPath: %s", reply)
+	}
+	if got := tree.writeOrder(system); len(got) > 0 {
+		t.Errorf("%v written to the refused cgroup", got)
+	}
+	if isAdopted(system) {
+		t.Error("the refused cgroup was recorded as adopted")
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// auditRecord is one line of the -audit-log.
+type auditRecord struct {
+	Time   time.Time `json:"time"`
+	User   string    `json:"user"`
+	Plan   string    `json:"plan"`
+	Pids   []string  `json:"pids"`
+	SubDir string    `json:"subDir,omitempty"`
+	Result string    `json:"result"`
+	Error  string    `json:"error,omitempty"`
+}
+
+// auditLog appends a JSON line per assignment to the file given with
+// -audit-log. Lines are written whole under mu and an exclusive flock, so
+// neither concurrent requests nor another process appending to the file split
+// them. On SIGHUP reloadOnHangup reopens the file, e.g. after logrotate moved
+// it away.
+var auditLog struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+}
+
+// openAuditLog starts the audit log at path.
+func openAuditLog(path string) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	auditLog.path = path
+	auditLog.file = file
+	return nil
+}
+
+// reopenAuditLog switches to a fresh file at the audit log path. The old file
+// is kept if the new one can't be opened.
+func reopenAuditLog() {
+	if auditLog.path == "" {
+		return
+	}
+	file, err := os.OpenFile(auditLog.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		slog.Error("Failed to reopen audit log", "path", auditLog.path, "err", err)
+		return
+	}
+	auditLog.mu.Lock()
+	old := auditLog.file
+	auditLog.file = file
+	auditLog.mu.Unlock()
+	old.Close()
+}
+
+// audit records the outcome of a createCgroup for slice.
+func audit(slice, plan string, pids []string, placed placement, err error) {
+	if auditLog.path == "" {
+		return
+	}
+	record := auditRecord{
+		Time:   time.Now().UTC(),
+		User:   strings.TrimSuffix(filepath.Base(slice), ".slice"),
+		Plan:   strings.ToLower(plan),
+		Pids:   pids,
+		SubDir: strings.TrimPrefix(placed.subDir, usersPath),
+		Result: "created",
+	}
+	if err != nil {
+		record.Result = "failed"
+		record.Error = err.Error()
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		slog.Error("Failed to encode audit record", "err", err)
+		return
+	}
+	line = append(line, '\n')
+
+	auditLog.mu.Lock()
+	defer auditLog.mu.Unlock()
+	fd := int(auditLog.file.Fd())
+	if err := unix.Flock(fd, unix.LOCK_EX); err != nil {
+		slog.Error("Failed to lock audit log", "path", auditLog.path, "err", err)
+	}
+	defer unix.Flock(fd, unix.LOCK_UN)
+	if _, err := auditLog.file.Write(line); err != nil {
+		slog.Error("Failed to write audit log", "path", auditLog.path, "err", err)
+	}
+}
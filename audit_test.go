@@ -0,0 +1,76 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// useAuditLog opens an audit log in a temporary directory for the test and
+// returns its path.
+func useAuditLog(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "audit.log")
+	if err := openAuditLog(path); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		auditLog.file.Close()
+		auditLog.path = ""
+		auditLog.file = nil
+	})
+	return path
+}
+
+// auditLines returns the records in the audit log file at path.
+func auditLines(t *testing.T, path string) []string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Fields(string(data))
+}
+
+func TestHangUpReopensAuditLogAndReloads(t *testing.T) {
+	tree := newTestTree(t)
+	path := useAuditLog(t)
+	config := useConfigFile(t, webPlan("20000 100000"))
+	assign(t, "alice", "standard")
+
+	// logrotate moves the file away and signals pguard.
+	rotated := path + ".1"
+	if err := os.Rename(path, rotated); err != nil {
+		t.Fatal(err)
+	}
+	writeConfigFile(t, config, webPlan("30000 100000"))
+	hangUp()
+
+	if got := tree.read(t, filepath.Join(assign(t, "bob", "web"), "cpu.max")); got != "30000 100000" {
+		t.Errorf("cpu.max %q after SIGHUP, want the reloaded plan's", got)
+	}
+	if lines := auditLines(t, rotated); len(lines) != 1 || !strings.Contains(lines[0], `"user":"alice"`) {
+		t.Errorf("rotated audit log %q, want only alice's record", lines)
+	}
+	if lines := auditLines(t, path); len(lines) != 1 || !strings.Contains(lines[0], `"user":"bob"`) {
+		t.Errorf("reopened audit log %q, want bob's record", lines)
+	}
+}
+
+func TestHangUpWithoutConfigReopensAuditLog(t *testing.T) {
+	newTestTree(t)
+	path := useAuditLog(t)
+	saved := configFile
+	configFile = ""
+	t.Cleanup(func() { configFile = saved })
+
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	hangUp()
+	assign(t, "alice", "standard")
+	if lines := auditLines(t, path); len(lines) != 1 {
+		t.Errorf("audit log %q after SIGHUP without -config, want one record", lines)
+	}
+}
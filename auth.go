@@ -0,0 +1,173 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os/user"
+	"slices"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// capability is what a connection is allowed to do. Every tier includes the
+// ones below it.
+type capability int
+
+const (
+	capRead  capability = iota // query state: stat, failures, checkauth
+	capWrite                   // assign processes to cgroups
+	capAdmin                   // change the daemon: gc, setinterval, ...
+)
+
+var capabilityNames = map[capability]string{capRead: "read", capWrite: "write", capAdmin: "admin"}
+
+func (c capability) String() string {
+	return capabilityNames[c]
+}
+
+func parseCapability(name string) (capability, error) {
+	for c, n := range capabilityNames {
+		if n == name {
+			return c, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown capability %q, expected read, write or admin", name)
+}
+
+var (
+	// listenerCapability caps every connection accepted on the socket, a
+	// tenant-facing socket would be limited to write.
+	listenerCapability = capAdmin
+	// adminUids are the uids (besides root) granted capAdmin. When empty every
+	// peer is an admin, otherwise the others get capWrite.
+	adminUids []uint32
+	// allowUids, when not empty, are the only uids whose connections are
+	// accepted at all; root is not implied.
+	allowUids []uint32
+	// assignGids, when not empty, restricts assignments: besides root only
+	// peers with one of these gids may assign, and only to their own user.
+	assignGids []uint32
+)
+
+// parseUids parses a comma separated list of uids (or gids).
+func parseUids(list string) ([]uint32, error) {
+	var uids []uint32
+	for _, field := range strings.Split(list, ",") {
+		if field = strings.TrimSpace(field); field == "" {
+			continue
+		}
+		id, err := strconv.ParseUint(field, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid id %q", field)
+		}
+		uids = append(uids, uint32(id))
+	}
+	return uids, nil
+}
+
+// connectionCapability returns what the peer of conn may do: the lower of the
+// listener's capability and the one granted to the peer's identity.
+func connectionCapability(conn net.Conn) capability {
+	if _, ok := conn.(remoteConn); ok {
+		return remoteCapability
+	}
+	granted := capAdmin
+	if len(adminUids) > 0 {
+		cred, err := peerCredentials(conn)
+		switch {
+		case err != nil:
+			granted = capRead
+		case cred.Uid != 0 && !slices.Contains(adminUids, cred.Uid):
+			granted = capWrite
+		}
+	}
+	return min(granted, listenerCapability)
+}
+
+// acceptPeer reports whether a freshly accepted connection passes the
+// -allowUids filter. It runs before anything is read from the connection.
+func acceptPeer(conn net.Conn) bool {
+	if len(allowUids) == 0 {
+		return true
+	}
+	cred, err := peerCredentials(conn)
+	if err != nil {
+		slog.Error("Rejecting connection without peer credentials", "err", err)
+		return false
+	}
+	if !slices.Contains(allowUids, cred.Uid) {
+		slog.Warn("Rejecting connection from disallowed uid", "uid", cred.Uid, "pid", cred.Pid)
+		return false
+	}
+	return true
+}
+
+// peerCredentials returns the credentials of the process on the other end of
+// a unix socket connection.
+func peerCredentials(conn net.Conn) (*unix.Ucred, error) {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return nil, errors.New("not a unix socket connection")
+	}
+	raw, err := unixConn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var cred *unix.Ucred
+	var credErr error
+	if err := raw.Control(func(fd uintptr) {
+		cred, credErr = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	}); err != nil {
+		return nil, err
+	}
+	return cred, credErr
+}
+
+// authorizeCreate decides whether the peer may place processes into the slice
+// of user. Without -assignGids every client that can connect to the socket is
+// allowed and access is controlled by the socket's ownership. With it root may
+// assign to any user, a peer whose gid is listed only to the user of its own
+// uid, and everyone else not at all.
+func authorizeCreate(cred *unix.Ucred, name string) error {
+	if len(assignGids) == 0 {
+		return nil
+	}
+	switch {
+	case cred == nil:
+		return errors.New("no peer credentials")
+	case cred.Uid == 0:
+		return nil
+	case !slices.Contains(assignGids, cred.Gid):
+		return fmt.Errorf("gid %d may not assign", cred.Gid)
+	}
+	account, err := user.LookupId(strconv.Itoa(int(cred.Uid)))
+	if err != nil {
+		return fmt.Errorf("uid %d has no user name: %w", cred.Uid, err)
+	}
+	if account.Username != name {
+		return fmt.Errorf("uid %d may only assign to %s", cred.Uid, account.Username)
+	}
+	return nil
+}
+
+// authorizePids checks, with -assignGids, that a peer other than root only
+// moves processes of its own uid.
+func authorizePids(cred *unix.Ucred, pids []string) error {
+	if len(assignGids) == 0 || cred.Uid == 0 {
+		return nil
+	}
+	for _, pid := range pids {
+		owner, err := processOwner(pid)
+		if err != nil {
+			return err
+		}
+		if owner != cred.Uid {
+			return fmt.Errorf("pid %s is not a process of uid %d", pid, cred.Uid)
+		}
+	}
+	return nil
+}
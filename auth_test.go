@@ -0,0 +1,100 @@
+package main
+
+import (
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// lookupAccount returns the uid of the account name, skipping the test if the
+// system has none.
+func lookupAccount(t *testing.T, name string) uint32 {
+	t.Helper()
+	account, err := user.Lookup(name)
+	if err != nil {
+		t.Skipf("no %s account: %v", name, err)
+	}
+	uid, err := strconv.ParseUint(account.Uid, 10, 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return uint32(uid)
+}
+
+// useProcOwners points procPath at a directory with a process entry per pid,
+// owned by the uid given for it.
+func useProcOwners(t *testing.T, owners map[string]uint32) {
+	t.Helper()
+	dir := t.TempDir()
+	for pid, uid := range owners {
+		path := filepath.Join(dir, pid)
+		if err := os.Mkdir(path, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chown(path, int(uid), -1); err != nil {
+			t.Skipf("can't hand %s to uid %d: %v", path, uid, err)
+		}
+	}
+	saved := procPath
+	procPath = dir
+	t.Cleanup(func() { procPath = saved })
+}
+
+func TestAuthorizeCreate(t *testing.T) {
+	nobody := lookupAccount(t, "nobody")
+	if err := authorizeCreate(&unix.Ucred{Uid: nobody, Gid: 1}, "alice"); err != nil {
+		t.Errorf("without -assignGids: %v, want everyone allowed", err)
+	}
+
+	restrictAssign(t)
+	for _, test := range []struct {
+		name string
+		cred *unix.Ucred
+		user string
+		ok   bool
+	}{
+		{name: "no credentials", cred: nil, user: "alice"},
+		{name: "root", cred: &unix.Ucred{Uid: 0, Gid: 0}, user: "alice", ok: true},
+		{name: "gid not listed", cred: &unix.Ucred{Uid: nobody, Gid: 1}, user: "nobody"},
+		{name: "own user", cred: &unix.Ucred{Uid: nobody, Gid: 4242}, user: "nobody", ok: true},
+		{name: "other user", cred: &unix.Ucred{Uid: nobody, Gid: 4242}, user: "alice"},
+		{name: "uid without a name", cred: &unix.Ucred{Uid: 4000000000, Gid: 4242}, user: "alice"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			err := authorizeCreate(test.cred, test.user)
+			if test.ok && err != nil {
+				t.Errorf("refused: %v", err)
+			}
+			if !test.ok && err == nil {
+				t.Error("allowed, want refused")
+			}
+		})
+	}
+}
+
+func TestAuthorizePids(t *testing.T) {
+	nobody := lookupAccount(t, "nobody")
+	useProcOwners(t, map[string]uint32{"100": nobody, "200": 0})
+	peer := &unix.Ucred{Uid: nobody, Gid: 4242}
+
+	if err := authorizePids(peer, []string{"200"}); err != nil {
+		t.Errorf("without -assignGids: %v, want any pid allowed", err)
+	}
+	restrictAssign(t)
+	if err := authorizePids(peer, []string{"100"}); err != nil {
+		t.Errorf("own process: %v", err)
+	}
+	if err := authorizePids(peer, []string{"100", "200"}); err == nil {
+		t.Error("root's process among the pids was allowed")
+	}
+	if err := authorizePids(peer, []string{"300"}); err == nil {
+		t.Error("a pid with no process was allowed")
+	}
+	if err := authorizePids(&unix.Ucred{Uid: 0}, []string{"200", "300"}); err != nil {
+		t.Errorf("root: %v, want any pid allowed", err)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+// Everything pguard creates or writes below usersPath is opened relative to a
+// descriptor of usersPath with RESOLVE_BENEATH, so a path built from request
+// input can't leave the managed tree even if validation misses something (a
+// ".." component or a symlink planted in the tree).
+
+var (
+	rootFdMu sync.Mutex
+	rootFd   = -1
+
+	// errEscapesRoot is returned for paths resolving outside usersPath.
+	errEscapesRoot = errors.New("path escapes the managed cgroup tree")
+)
+
+// usersRootFd returns the descriptor of usersPath, opening it on first use.
+func usersRootFd() (int, error) {
+	rootFdMu.Lock()
+	defer rootFdMu.Unlock()
+	if rootFd >= 0 {
+		return rootFd, nil
+	}
+	fd, err := unix.Open(usersPath, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return -1, err
+	}
+	rootFd = fd
+	return fd, nil
+}
+
+// beneathRoot returns path relative to usersPath. ok is false for paths that
+// don't start with usersPath, e.g. the controllers of the cgroup root; paths
+// that start with it but lead out of it with ".." are an error.
+func beneathRoot(path string) (rel string, ok bool, err error) {
+	if !strings.HasPrefix(path, usersPath) {
+		return "", false, nil
+	}
+	rel, err = filepath.Rel(usersPath, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", true, fmt.Errorf("%s: %w", path, errEscapesRoot)
+	}
+	return rel, true, nil
+}
+
+// openBeneath opens a path inside usersPath with openat2(RESOLVE_BENEATH). On
+// kernels without openat2 (before 5.6) it resolves the symlinks itself and
+// checks the result is still inside usersPath before opening.
+func openBeneath(rel string, flags int, mode uint32) (*os.File, error) {
+	root, err := usersRootFd()
+	if err != nil {
+		return nil, err
+	}
+	fd, err := unix.Openat2(root, rel, &unix.OpenHow{
+		Flags:   uint64(flags | unix.O_CLOEXEC),
+		Mode:    uint64(mode),
+		Resolve: unix.RESOLVE_BENEATH | unix.RESOLVE_NO_MAGICLINKS,
+	})
+	switch {
+	case err == nil:
+		return os.NewFile(uintptr(fd), filepath.Join(usersPath, rel)), nil
+	case errors.Is(err, unix.EXDEV):
+		return nil, fmt.Errorf("%s: %w", rel, errEscapesRoot)
+	case !errors.Is(err, unix.ENOSYS):
+		return nil, &os.PathError{Op: "openat2", Path: filepath.Join(usersPath, rel), Err: err}
+	}
+
+	path := filepath.Join(usersPath, rel)
+	if err := checkResolvesBeneath(filepath.Dir(path)); err != nil {
+		return nil, err
+	}
+	return os.OpenFile(path, flags, os.FileMode(mode))
+}
+
+// checkResolvesBeneath is the fallback check of openBeneath for kernels
+// without openat2.
+func checkResolvesBeneath(dir string) error {
+	root, err := filepath.EvalSymlinks(usersPath)
+	if err != nil {
+		return err
+	}
+	resolved, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return err
+	}
+	if resolved != root && !strings.HasPrefix(resolved, root+"/") {
+		return fmt.Errorf("%s: %w", dir, errEscapesRoot)
+	}
+	return nil
+}
+
+// mkdirBeneath creates a directory inside usersPath: its parent is opened with
+// openBeneath and the directory made with mkdirat relative to it.
+func mkdirBeneath(rel string, mode os.FileMode) error {
+	parent, err := openBeneath(filepath.Dir(rel), unix.O_PATH|unix.O_DIRECTORY, 0)
+	if err != nil {
+		return err
+	}
+	defer parent.Close()
+	if err := unix.Mkdirat(int(parent.Fd()), filepath.Base(rel), uint32(mode.Perm())); err != nil {
+		return &os.PathError{Op: "mkdir", Path: filepath.Join(usersPath, rel), Err: err}
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWritesDontEscapeThroughSymlinks(t *testing.T) {
+	root := useKernelTree(t)
+	outside := t.TempDir()
+	if err := os.Symlink(outside, root+"evil.slice"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(root+"real.slice", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("real.slice", root+"link.slice"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := writeToFile(root+"evil.slice/cpu.max", "max"); !errors.Is(err, errEscapesRoot) {
+		t.Errorf("write through a symlink out of usersPath: %v, want errEscapesRoot", err)
+	}
+	if err := CreateCgroupDir(root+"evil.slice/job", 0755); !errors.Is(err, errEscapesRoot) {
+		t.Errorf("mkdir through a symlink out of usersPath: %v, want errEscapesRoot", err)
+	}
+	if _, err := openCgroupDir(root + "evil.slice"); !errors.Is(err, errEscapesRoot) {
+		t.Errorf("opening a symlink out of usersPath: %v, want errEscapesRoot", err)
+	}
+	if err := writeToFile(root+"../cpu.max", "max"); !errors.Is(err, errEscapesRoot) {
+		t.Errorf("write to a path with ..: %v, want errEscapesRoot", err)
+	}
+	if entries, _ := os.ReadDir(outside); len(entries) > 0 {
+		t.Errorf("%d entries created outside usersPath", len(entries))
+	}
+
+	// A symlink staying inside usersPath is followed.
+	if err := writeToFile(root+"link.slice/cpu.max", "max"); err != nil {
+		t.Errorf("write through a symlink inside usersPath: %v", err)
+	}
+	if content, _ := os.ReadFile(root + "real.slice/cpu.max"); string(content) != "max" {
+		t.Errorf("real.slice/cpu.max = %q, want the write through link.slice", content)
+	}
+}
+
+func TestCheckResolvesBeneath(t *testing.T) {
+	root := useKernelTree(t)
+	if err := os.Symlink(t.TempDir(), root+"evil.slice"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(root+"alice.slice", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkResolvesBeneath(root + "evil.slice"); !errors.Is(err, errEscapesRoot) {
+		t.Errorf("symlink out of usersPath: %v, want errEscapesRoot", err)
+	}
+	for _, dir := range []string{filepath.Clean(root), root + "alice.slice"} {
+		if err := checkResolvesBeneath(dir); err != nil {
+			t.Errorf("%s: %v", dir, err)
+		}
+	}
+}
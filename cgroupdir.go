@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+)
+
+// errValueRejected is returned for a control file write the kernel took only
+// part of. Control files are written in one go, so a short write means the
+// value was refused or cut short rather than that the rest is still to come.
+var errValueRejected = errors.New("value rejected")
+
+// shortWriteError returns the error of a write of data to path that wrote n
+// bytes, nil if it wrote all of them.
+func shortWriteError(path, data string, n int) error {
+	if n == len(data) {
+		return nil
+	}
+	return &os.PathError{Op: "write", Path: path, Err: fmt.Errorf("%w: wrote %d of %d bytes", errValueRejected, n, len(data))}
+}
+
+// cgroupDir is an open cgroup directory. Its control files are opened relative
+// to the directory descriptor, so writing the several files of a subgroup
+// resolves the subgroup path once instead of once per file. Without a
+// descriptor, in dry-run mode or on a cgroupFiles other than the kernel's,
+// they are written by path.
+type cgroupDir struct {
+	file *os.File
+	path string
+	// log is the logger of the request the directory is written for.
+	log *slog.Logger
+}
+
+func openCgroupDir(path string) (*cgroupDir, error) {
+	if dryRun {
+		// The subgroup may not exist, nothing is written through it anyway.
+		return &cgroupDir{path: path, log: slog.Default()}, nil
+	}
+	if _, ok := cgroupFiles.(kernelFS); !ok {
+		return &cgroupDir{path: path, log: slog.Default()}, nil
+	}
+	rel, ok, err := beneathRoot(path)
+	switch {
+	case err != nil:
+		return nil, err
+	case ok:
+		file, err := openBeneath(rel, unix.O_PATH|unix.O_DIRECTORY, 0)
+		if err != nil {
+			return nil, err
+		}
+		return &cgroupDir{file: file, path: path, log: slog.Default()}, nil
+	}
+	fd, err := unix.Open(path, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: path, Err: err}
+	}
+	return &cgroupDir{file: os.NewFile(uintptr(fd), path), path: path, log: slog.Default()}, nil
+}
+
+// write writes data to the control file name of the directory, with the same
+// open flags and retries as writeToFile.
+func (d *cgroupDir) write(name, data string) error {
+	path := filepath.Join(d.path, name)
+	if skipInDryRun("write", path, "value", data) {
+		return nil
+	}
+	if d.file == nil {
+		err := retryWrite(path, func() error { return cgroupFiles.WriteFile(path, data) })
+		if err != nil {
+			metrics.Add("write_errors", 1, "file", name)
+		}
+		return err
+	}
+	raw, err := d.file.SyscallConn()
+	if err != nil {
+		return err
+	}
+	err = retryWrite(path, func() error {
+		// Control keeps the directory descriptor from being closed under a
+		// write that timed out and is still running.
+		var writeErr error
+		if err := raw.Control(func(dirfd uintptr) {
+			fd, err := unix.Openat(int(dirfd), name, unix.O_WRONLY|unix.O_CREAT|unix.O_CLOEXEC, 0644)
+			if err != nil {
+				writeErr = &os.PathError{Op: "open", Path: path, Err: err}
+				return
+			}
+			defer unix.Close(fd)
+			n, err := unix.Write(fd, []byte(data))
+			if err != nil {
+				writeErr = &os.PathError{Op: "write", Path: path, Err: err}
+				return
+			}
+			writeErr = shortWriteError(path, data, n)
+		}); err != nil {
+			return err
+		}
+		return writeErr
+	})
+	if err != nil {
+		metrics.Add("write_errors", 1, "file", name)
+	}
+	return err
+}
+
+// exists reports whether the directory has the control file name. In dry-run
+// mode every file is taken to exist.
+func (d *cgroupDir) exists(name string) bool {
+	if dryRun {
+		return true
+	}
+	if d.file == nil {
+		_, err := cgroupFiles.ReadFile(filepath.Join(d.path, name))
+		return err == nil
+	}
+	return unix.Faccessat(int(d.file.Fd()), name, unix.F_OK, 0) == nil
+}
+
+func (d *cgroupDir) Close() error {
+	if d.file == nil {
+		return nil
+	}
+	return d.file.Close()
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// useKernelTree points pguard's kernelFS at a usersPath in a temporary
+// directory, so the descriptor-relative writes run against plain files, and
+// returns that path.
+func useKernelTree(t testing.TB) string {
+	t.Helper()
+	saved := struct {
+		files cgroupFS
+		users string
+	}{cgroupFiles, usersPath}
+	closeRootFd := func() {
+		rootFdMu.Lock()
+		if rootFd >= 0 {
+			unix.Close(rootFd)
+		}
+		rootFd = -1
+		rootFdMu.Unlock()
+	}
+	closeRootFd()
+	t.Cleanup(func() {
+		closeRootFd()
+		cgroupFiles, usersPath = saved.files, saved.users
+	})
+	cgroupFiles = kernelFS{}
+	usersPath = t.TempDir() + "/"
+	return usersPath
+}
+
+// subgroupFiles are the limits a subgroup of the test plans gets written.
+var subgroupFiles = map[string]string{
+	"cpu.max":     "20000 100000",
+	"cpu.weight":  "20",
+	"memory.max":  "1073741824",
+	"memory.high": "805306368",
+	"io.weight":   "50",
+	"pids.max":    "64",
+}
+
+// makeSubgroup creates a subgroup directory holding the subgroupFiles.
+func makeSubgroup(t testing.TB, path string) {
+	t.Helper()
+	if err := os.MkdirAll(path, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name := range subgroupFiles {
+		if err := os.WriteFile(filepath.Join(path, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCgroupDirWritesLikeWriteToFile(t *testing.T) {
+	root := useKernelTree(t)
+	byDir, byPath := root+"alice.slice/dir", root+"alice.slice/path"
+	makeSubgroup(t, byDir)
+	makeSubgroup(t, byPath)
+
+	dir, err := openCgroupDir(byDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dir.Close()
+	if dir.file == nil {
+		t.Fatal("openCgroupDir on kernelFS didn't open a descriptor")
+	}
+	for name, value := range subgroupFiles {
+		if err := dir.write(name, value); err != nil {
+			t.Fatal(err)
+		}
+		if err := writeToFile(filepath.Join(byPath, name), value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name := range subgroupFiles {
+		got, _ := os.ReadFile(filepath.Join(byDir, name))
+		want, _ := os.ReadFile(filepath.Join(byPath, name))
+		if string(got) != string(want) {
+			t.Errorf("%s: %q through the descriptor, %q by path", name, got, want)
+		}
+	}
+}
+
+// BenchmarkSubgroupWrites compares writing a subgroup's limits through its
+// open cgroupDir with writing each file by path with writeToFile.
+func BenchmarkSubgroupWrites(b *testing.B) {
+	root := useKernelTree(b)
+	subDir := root + "alice.slice/started_1"
+	makeSubgroup(b, subDir)
+
+	b.Run("cgroupDir", func(b *testing.B) {
+		for range b.N {
+			dir, err := openCgroupDir(subDir)
+			if err != nil {
+				b.Fatal(err)
+			}
+			for name, value := range subgroupFiles {
+				if err := dir.write(name, value); err != nil {
+					b.Fatal(err)
+				}
+			}
+			dir.Close()
+		}
+	})
+	b.Run("writeToFile", func(b *testing.B) {
+		for range b.N {
+			for name, value := range subgroupFiles {
+				if err := writeToFile(filepath.Join(subDir, name), value); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+}
+
+// shortWriteFS is a cgroup tree on which the kernel takes only part of every
+// value written to the control file name, as it can for a value it refuses.
+type shortWriteFS struct {
+	cgroupFS
+	name string
+}
+
+func (f shortWriteFS) WriteFile(path, data string) error {
+	if filepath.Base(path) != f.name {
+		return f.cgroupFS.WriteFile(path, data)
+	}
+	n := len(data) / 2
+	if err := f.cgroupFS.WriteFile(path, data[:n]); err != nil {
+		return err
+	}
+	return shortWriteError(path, data, n)
+}
+
+func TestShortWriteRejectsValue(t *testing.T) {
+	tree := newTestTree(t)
+	usePlans(t, map[string]PlanConfig{"tight": {CpuMax: "20000 100000", PidsMax: "64"}})
+	slice := usersPath + "alice.slice/"
+	subDir := slice + "job"
+	if err := tree.Mkdir(slice, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.WriteFile(slice+"cgroup.subtree_control", subtreeControl(usableControllers())); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Mkdir(subDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	cgroupFiles = shortWriteFS{cgroupFS: tree.fakeCgroupFS, name: "pids.max"}
+
+	config, _ := getPlanConfig("tight")
+	err := applyCgroupConfig(slog.Default(), subDir, config, []string{selfPid})
+	if !errors.Is(err, errValueRejected) {
+		t.Fatalf("applyCgroupConfig: %v, want errValueRejected", err)
+	}
+	if got := tree.read(t, subDir+"/cpu.max"); got != "20000 100000" {
+		t.Errorf("cpu.max = %q, want the other limits still written", got)
+	}
+
+	reply := request(t, selfPid+"|bob|tight")
+	if !strings.HasPrefix(reply, "ERR rejected ") || !strings.Contains(reply, errValueRejected.Error()) {
+		t.Errorf("assignment with pids.max cut short: %s, want ERR rejected naming the rejected value", reply)
+	}
+}
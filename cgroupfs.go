@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+)
+
+// cgroupFS is the access to the cgroup tree: creating and removing cgroups and
+// writing and reading their control files. The rest of pguard goes through
+// cgroupFiles, so it can run against a directory tree that behaves like
+// cgroupfs instead of the kernel's.
+type cgroupFS interface {
+	// Mkdir creates the cgroup at path.
+	Mkdir(path string, mode os.FileMode) error
+	// WriteFile writes data to the control file at path in a single write.
+	WriteFile(path, data string) error
+	// ReadFile reads the control file at path.
+	ReadFile(path string) ([]byte, error)
+	// Remove removes the empty cgroup at path.
+	Remove(path string) error
+}
+
+// cgroupFiles is the cgroup tree pguard works on.
+var cgroupFiles cgroupFS = kernelFS{}
+
+// kernelFS is the kernel's cgroupfs. Paths inside usersPath are resolved with
+// openBeneath, and cgroupDir writes the files of an open directory relative to
+// its descriptor.
+type kernelFS struct{}
+
+func (kernelFS) Mkdir(path string, mode os.FileMode) error {
+	rel, ok, err := beneathRoot(path)
+	switch {
+	case err != nil:
+		return err
+	case ok && rel != ".":
+		return mkdirBeneath(rel, mode)
+	}
+	return os.Mkdir(path, mode)
+}
+
+func (kernelFS) WriteFile(path, data string) error {
+	rel, ok, err := beneathRoot(path)
+	if err != nil {
+		return err
+	}
+	var file *os.File
+	if ok {
+		file, err = openBeneath(rel, os.O_WRONLY|os.O_CREATE, 0644)
+	} else {
+		file, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0644)
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	n, err := file.WriteString(data)
+	// os.File reports a short write as io.ErrShortWrite, which doesn't tell
+	// that the kernel refused the value.
+	if err != nil && !errors.Is(err, io.ErrShortWrite) {
+		return err
+	}
+	return shortWriteError(path, data, n)
+}
+
+func (kernelFS) ReadFile(path string) ([]byte, error) {
+	return os.ReadFile(path)
+}
+
+func (kernelFS) Remove(path string) error {
+	return os.Remove(path)
+}
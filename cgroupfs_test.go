@@ -0,0 +1,502 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// controllerFiles are the control files the fake creates in a cgroup whose
+// parent enables the controller, with the kernel's defaults.
+var controllerFiles = map[string]map[string]string{
+	"cpu":    {"cpu.max": "max 100000", "cpu.max.burst": "0", "cpu.weight": "100", "cpu.idle": "0", "cpu.stat": "usage_usec 0\nuser_usec 0\nsystem_usec 0\n"},
+	"io":     {"io.max": "", "io.weight": "default 100"},
+	"memory": {"memory.max": "max", "memory.high": "max", "memory.swap.max": "max", "memory.oom.group": "0", "memory.current": "0", "memory.peak": "0", "memory.events": "low 0\nhigh 0\nmax 0\noom 0\noom_kill 0\n"},
+	"pids":   {"pids.max": "max"},
+}
+
+// fakeWrite is a control file write seen by fakeCgroupFS.
+type fakeWrite struct {
+	path, data string
+}
+
+// fakeCgroupFS is a temporary directory that behaves like cgroupfs as far as
+// pguard relies on it: a new cgroup comes with the control files its parent's
+// cgroup.subtree_control enables, only existing control files can be
+// written, cgroup.procs writes populate the cgroup and its ancestors, and a
+// cgroup is removed with its control files unless it has children or
+// processes.
+type fakeCgroupFS struct {
+	mu sync.Mutex
+	// fail holds the errors writes to a control file fail with instead of
+	// being written, by its path or by its name for that file of any cgroup.
+	fail map[string]error
+	// failMkdir holds the errors creating a cgroup fails with, by the path of
+	// its parent.
+	failMkdir map[string]error
+	// hold blocks the writes to a control file, keyed like fail, until the
+	// channel is closed.
+	hold map[string]chan struct{}
+	// intercept, if set, is called with f.mu held before a control file
+	// write and fails it with the error it returns.
+	intercept func(path, data string) error
+	// moves makes a cgroup.procs write move the process out of the cgroup it
+	// was in, as the kernel does. Without it the write only adds the process,
+	// so one test process can populate many cgroups.
+	moves bool
+	// writes are the successful control file writes, in order.
+	writes []fakeWrite
+}
+
+func (f *fakeCgroupFS) Mkdir(path string, mode os.FileMode) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	path = filepath.Clean(path)
+	if err := f.failMkdir[filepath.Dir(path)]; err != nil {
+		return &os.PathError{Op: "mkdir", Path: path, Err: err}
+	}
+	if err := os.Mkdir(path, mode); err != nil {
+		return err
+	}
+	files := map[string]string{
+		"cgroup.procs":           "",
+		"cgroup.threads":         "",
+		"cgroup.events":          "populated 0\nfrozen 0\n",
+		"cgroup.type":            "domain",
+		"cgroup.subtree_control": "",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(path, name), []byte(content), 0644); err != nil {
+			return err
+		}
+	}
+	enabled, _ := os.ReadFile(filepath.Join(filepath.Dir(path), "cgroup.subtree_control"))
+	return addControllers(path, strings.Fields(string(enabled)))
+}
+
+// addControllers makes the controllers available in the cgroup at path: they
+// are listed in its cgroup.controllers and their files are created.
+func addControllers(path string, controllers []string) error {
+	if err := os.WriteFile(filepath.Join(path, "cgroup.controllers"), []byte(strings.Join(controllers, " ")), 0644); err != nil {
+		return err
+	}
+	for _, controller := range controllers {
+		for name, content := range controllerFiles[controller] {
+			file := filepath.Join(path, name)
+			if _, err := os.Stat(file); err == nil {
+				continue
+			}
+			if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (f *fakeCgroupFS) WriteFile(path, data string) error {
+	f.mu.Lock()
+	hold := f.hold[path]
+	if hold == nil {
+		hold = f.hold[filepath.Base(path)]
+	}
+	f.mu.Unlock()
+	if hold != nil {
+		<-hold
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	err := f.fail[path]
+	if err == nil {
+		err = f.fail[filepath.Base(path)]
+	}
+	if err == nil && f.intercept != nil {
+		err = f.intercept(path, data)
+	}
+	if err != nil {
+		return &os.PathError{Op: "write", Path: path, Err: err}
+	}
+	if info, err := os.Stat(path); err != nil || info.IsDir() {
+		return &os.PathError{Op: "open", Path: path, Err: unix.ENOENT}
+	}
+	dir := filepath.Dir(path)
+	switch filepath.Base(path) {
+	case "cgroup.procs", "cgroup.threads":
+		if _, err := strconv.Atoi(strings.TrimSpace(data)); err != nil {
+			return &os.PathError{Op: "write", Path: path, Err: unix.EINVAL}
+		}
+		if f.moves && filepath.Base(path) == "cgroup.procs" {
+			if err := moveOut(strings.TrimSpace(data)); err != nil {
+				return err
+			}
+		}
+		if err := appendLine(path, strings.TrimSpace(data)); err != nil {
+			return err
+		}
+		if err := setPopulated(dir); err != nil {
+			return err
+		}
+	case "cgroup.subtree_control":
+		if err := f.writeSubtreeControl(dir, data); err != nil {
+			return &os.PathError{Op: "write", Path: path, Err: err}
+		}
+	default:
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			return err
+		}
+	}
+	f.writes = append(f.writes, fakeWrite{path, data})
+	return nil
+}
+
+// writeSubtreeControl enables and disables the "+name -name" controllers of
+// the cgroup dir for its children, refusing the whole write if one isn't
+// available in dir.
+func (f *fakeCgroupFS) writeSubtreeControl(dir, data string) error {
+	available, _ := os.ReadFile(filepath.Join(dir, "cgroup.controllers"))
+	current, _ := os.ReadFile(filepath.Join(dir, "cgroup.subtree_control"))
+	enabled := strings.Fields(string(current))
+	for _, change := range strings.Fields(data) {
+		controller := change[1:]
+		if !slices.Contains(strings.Fields(string(available)), controller) {
+			return unix.ENOENT
+		}
+		switch change[0] {
+		case '+':
+			if !slices.Contains(enabled, controller) {
+				enabled = append(enabled, controller)
+			}
+		case '-':
+			enabled = slices.DeleteFunc(enabled, func(c string) bool { return c == controller })
+		default:
+			return unix.EINVAL
+		}
+	}
+	slices.Sort(enabled)
+	if err := os.WriteFile(filepath.Join(dir, "cgroup.subtree_control"), []byte(strings.Join(enabled, " ")), 0644); err != nil {
+		return err
+	}
+	entries, _ := os.ReadDir(dir)
+	for _, entry := range entries {
+		if entry.IsDir() {
+			if err := addControllers(filepath.Join(dir, entry.Name()), enabled); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (f *fakeCgroupFS) ReadFile(path string) ([]byte, error) {
+	return os.ReadFile(path)
+}
+
+func (f *fakeCgroupFS) Remove(path string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	path = filepath.Clean(path)
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			return &os.PathError{Op: "rmdir", Path: path, Err: unix.EBUSY}
+		}
+	}
+	if processExists(filepath.Join(path, "cgroup.events")) {
+		return &os.PathError{Op: "rmdir", Path: path, Err: unix.EBUSY}
+	}
+	for _, entry := range entries {
+		if err := os.Remove(filepath.Join(path, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return os.Remove(path)
+}
+
+// failWrites makes the writes to the control file at path fail with err, nil
+// lets them through again. A path without a directory, e.g. "cgroup.procs",
+// fails the writes to that file of every cgroup.
+func (f *fakeCgroupFS) failWrites(path string, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err == nil {
+		delete(f.fail, path)
+		return
+	}
+	if f.fail == nil {
+		f.fail = make(map[string]error)
+	}
+	f.fail[path] = err
+}
+
+// failMkdirs makes creating cgroups in parent fail with err, nil lets them
+// be created again.
+func (f *fakeCgroupFS) failMkdirs(parent string, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	parent = filepath.Clean(parent)
+	if err == nil {
+		delete(f.failMkdir, parent)
+		return
+	}
+	if f.failMkdir == nil {
+		f.failMkdir = make(map[string]error)
+	}
+	f.failMkdir[parent] = err
+}
+
+// holdWrites blocks the writes to the control file at path, or to a file of
+// that name in every cgroup like failWrites, until release is called.
+func (f *fakeCgroupFS) holdWrites(path string) (release func()) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.hold == nil {
+		f.hold = make(map[string]chan struct{})
+	}
+	hold := make(chan struct{})
+	f.hold[path] = hold
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			f.mu.Lock()
+			delete(f.hold, path)
+			f.mu.Unlock()
+			close(hold)
+		})
+	}
+}
+
+// written returns the values written to the control file at path, in order.
+func (f *fakeCgroupFS) written(path string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var values []string
+	for _, write := range f.writes {
+		if write.path == path {
+			values = append(values, write.data)
+		}
+	}
+	return values
+}
+
+// writeOrder returns the names of the control files written in dir, in the
+// order of their writes.
+func (f *fakeCgroupFS) writeOrder(dir string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var names []string
+	for _, write := range f.writes {
+		if filepath.Dir(write.path) == filepath.Clean(dir) {
+			names = append(names, filepath.Base(write.path))
+		}
+	}
+	return names
+}
+
+// exit empties the cgroup at path as if its processes had exited.
+func (f *fakeCgroupFS) exit(t testing.TB, path string) {
+	t.Helper()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, name := range []string{"cgroup.procs", "cgroup.threads"} {
+		if err := os.WriteFile(filepath.Join(path, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for dir := filepath.Clean(path); strings.HasPrefix(dir, cgroupMount); dir = filepath.Dir(dir) {
+		if err := writeEvents(dir, subtreePopulated(dir)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// moveOut removes pid from the cgroup it is in, updating the populated state
+// of the cgroups above.
+func moveOut(pid string) error {
+	return filepath.WalkDir(cgroupMount, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.Name() != "cgroup.procs" {
+			return err
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		lines := strings.Fields(string(content))
+		if !slices.Contains(lines, pid) {
+			return nil
+		}
+		lines = slices.DeleteFunc(lines, func(line string) bool { return line == pid })
+		var rest string
+		if len(lines) > 0 {
+			rest = strings.Join(lines, "\n") + "\n"
+		}
+		if err := os.WriteFile(path, []byte(rest), 0644); err != nil {
+			return err
+		}
+		for dir := filepath.Dir(path); strings.HasPrefix(dir, cgroupMount); dir = filepath.Dir(dir) {
+			if err := writeEvents(dir, subtreePopulated(dir)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func appendLine(path, line string) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = file.WriteString(line + "\n")
+	return err
+}
+
+// setPopulated marks the cgroup dir and its ancestors populated.
+func setPopulated(dir string) error {
+	for ; strings.HasPrefix(dir, cgroupMount); dir = filepath.Dir(dir) {
+		if err := writeEvents(dir, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeEvents(dir string, populated bool) error {
+	value := "0"
+	if populated {
+		value = "1"
+	}
+	return os.WriteFile(filepath.Join(dir, "cgroup.events"), []byte("populated "+value+"\nfrozen 0\n"), 0644)
+}
+
+// subtreePopulated reports whether a process is in the cgroup dir or below.
+func subtreePopulated(dir string) bool {
+	populated := false
+	filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err == nil && !entry.IsDir() && entry.Name() == "cgroup.procs" {
+			if content, _ := os.ReadFile(path); len(strings.TrimSpace(string(content))) > 0 {
+				populated = true
+				return filepath.SkipAll
+			}
+		}
+		return nil
+	})
+	return populated
+}
+
+// testTree is a fake cgroup tree mounted for one test.
+type testTree struct {
+	*fakeCgroupFS
+	root string
+}
+
+// newTestTree points pguard at a fresh fakeCgroupFS offering controllers,
+// with usersPath created and the controllers the plans need enabled, and
+// restores the previous tree when the test ends.
+func newTestTree(t testing.TB, controllers ...string) *testTree {
+	t.Helper()
+	if len(controllers) == 0 {
+		controllers = []string{"cpu", "io", "memory", "pids"}
+	}
+	root := t.TempDir()
+	saved := struct {
+		files                   cgroupFS
+		layout                  cgroupLayout
+		mount, users, delegated string
+		enabled                 []string
+		available               *map[string]bool
+		maxSubgroups, retries   int
+		reserve                 float64
+	}{cgroupFiles, layout, cgroupMount, usersPath, delegatedRoot, enabledControllers, availableControllers.Load(), maxSubgroupsPerUser, writeRetries, *systemReserve}
+	t.Cleanup(func() {
+		cgroupFiles, layout = saved.files, saved.layout
+		cgroupMount, usersPath, delegatedRoot = saved.mount, saved.users, saved.delegated
+		enabledControllers = saved.enabled
+		availableControllers.Store(saved.available)
+		maxSubgroupsPerUser, writeRetries, *systemReserve = saved.maxSubgroups, saved.retries, saved.reserve
+		activeWatcher = nil
+		watchedMu.Lock()
+		watched = make(map[string]struct{})
+		watchedMu.Unlock()
+		swapPlans(nil)
+		setDefaultPlan("")
+	})
+
+	tree := &testTree{fakeCgroupFS: &fakeCgroupFS{}, root: root}
+	for name, content := range map[string]string{
+		"cgroup.controllers":     strings.Join(controllers, " "),
+		"cgroup.subtree_control": "",
+		"cgroup.procs":           "",
+		"cgroup.events":          "populated 0\n",
+	} {
+		if err := os.WriteFile(filepath.Join(root, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cgroupFiles, layout = tree.fakeCgroupFS, cgroupV2{}
+	cgroupMount, delegatedRoot = root, root
+	usersPath = filepath.Join(root, usersDir) + "/"
+	enabledControllers = nil
+	activeWatcher = nil
+	swapPlans(nil)
+	setDefaultPlan("")
+	if err := tree.Mkdir(filepath.Clean(usersPath), 0755); err != nil {
+		t.Fatal(err)
+	}
+	enableControllers()
+	return tree
+}
+
+// read returns the trimmed content of the file at path, failing the test if
+// it can't be read.
+func (tree *testTree) read(t testing.TB, path string) string {
+	t.Helper()
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimSpace(string(content))
+}
+
+// exists reports whether path exists in the tree.
+func (tree *testTree) exists(path string) bool {
+	_, err := os.Stat(path)
+	return !errors.Is(err, fs.ErrNotExist)
+}
+
+func TestFakeCgroupFSRemove(t *testing.T) {
+	tree := newTestTree(t)
+	slice := usersPath + "alice.slice"
+	sub := slice + "/job"
+	for _, dir := range []string{slice, sub} {
+		if err := tree.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tree.Remove(slice); !errors.Is(err, unix.EBUSY) {
+		t.Fatalf("removing a cgroup with a child: got %v, want EBUSY", err)
+	}
+	if err := tree.WriteFile(sub+"/cgroup.procs", "42"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Remove(sub); !errors.Is(err, unix.EBUSY) {
+		t.Fatalf("removing a populated cgroup: got %v, want EBUSY", err)
+	}
+	tree.exit(t, sub)
+	for _, dir := range []string{sub, slice} {
+		if err := tree.Remove(dir); err != nil {
+			t.Fatalf("removing the emptied %s: %v", dir, err)
+		}
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// v1Controllers are the cgroup v1 controllers pguard writes limits to.
+var v1Controllers = []string{"memory", "cpu", "pids", "blkio"}
+
+// v1IoFiles are the blkio throttling files of the io.max keys.
+var v1IoFiles = map[string]string{
+	"rbps":  "blkio.throttle.read_bps_device",
+	"wbps":  "blkio.throttle.write_bps_device",
+	"riops": "blkio.throttle.read_iops_device",
+	"wiops": "blkio.throttle.write_iops_device",
+}
+
+// cgroupV1 is a host with only the legacy per-controller hierarchies.
+// usersPath is in the memory hierarchy; every cgroup pguard creates there is
+// mirrored at the same place in the cpu, pids and blkio hierarchies, and a
+// process is moved into all of them. The cgroup v2 limits of the plans are
+// translated: cpu.max to cpu.cfs_quota_us/cpu.cfs_period_us, cpu.max.burst to
+// cpu.cfs_burst_us, cpu.weight to cpu.shares, memory.max to
+// memory.limit_in_bytes, memory.high to memory.soft_limit_in_bytes and io.max
+// to the blkio.throttle files.
+type cgroupV1 struct {
+	// mounts maps a controller to the mountpoint of its hierarchy.
+	mounts map[string]string
+}
+
+// mirror returns the directory of path in the hierarchy of controller, or ""
+// when that controller isn't mounted.
+func (v cgroupV1) mirror(controller, path string) string {
+	mount, ok := v.mounts[controller]
+	if !ok {
+		return ""
+	}
+	rel, err := filepath.Rel(cgroupMount, path)
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(mount, rel)
+}
+
+// mirrors returns the directories of path in the hierarchies other than the
+// one of usersPath. Controllers mounted together share a directory.
+func (v cgroupV1) mirrors(path string) []string {
+	var dirs []string
+	for _, controller := range v1Controllers {
+		dir := v.mirror(controller, path)
+		if dir == "" || dir == filepath.Clean(path) || slices.Contains(dirs, dir) {
+			continue
+		}
+		dirs = append(dirs, dir)
+	}
+	return dirs
+}
+
+// enable does nothing, every v1 hierarchy has its controllers enabled in all
+// of its cgroups.
+func (cgroupV1) enable([]string) error {
+	return nil
+}
+
+func (v cgroupV1) mkdir(path string, mode os.FileMode) error {
+	if err := cgroupFiles.Mkdir(path, mode); err != nil {
+		return err
+	}
+	var errs []error
+	for _, dir := range v.mirrors(path) {
+		if err := cgroupFiles.Mkdir(dir, mode); err != nil && !errors.Is(err, fs.ErrExist) {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (v cgroupV1) setupSlice(slice string, config PlanConfig) error {
+	var errs []error
+	if err := writeToFile(slice+"memory.limit_in_bytes", v1Max(config.sliceMemoryMax())); err != nil {
+		slog.Error("Failed to write memory.limit_in_bytes", "path", slice, "err", err)
+		errs = append(errs, err)
+	}
+	if dir := v.mirror("cpu", slice); dir != "" {
+		quota, period := v1CpuMax(config.sliceCpuMax())
+		if period != "" {
+			if err := writeToFile(filepath.Join(dir, "cpu.cfs_period_us"), period); err != nil {
+				slog.Error("Failed to write cpu.cfs_period_us", "path", dir, "err", err)
+				errs = append(errs, err)
+			}
+		}
+		if err := writeToFile(filepath.Join(dir, "cpu.cfs_quota_us"), quota); err != nil {
+			slog.Error("Failed to write cpu.cfs_quota_us", "path", dir, "err", err)
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (v cgroupV1) applyLimits(dir *cgroupDir, subDir string, config PlanConfig) error {
+	var errs []error
+	write := func(controller, name, value string) {
+		mirror := v.mirror(controller, subDir)
+		if mirror == "" {
+			err := fmt.Errorf("%s: the %s controller is not mounted", name, controller)
+			dir.log.Error("Failed to write limit", "path", subDir, "err", err)
+			errs = append(errs, err)
+			return
+		}
+		path := filepath.Join(mirror, name)
+		if err := writeToFile(path, value); err != nil {
+			dir.log.Error("Failed to write limit", "path", path, "value", value, "err", err)
+			errs = append(errs, err)
+		}
+	}
+
+	if config.CpuMax != "" {
+		quota, period := v1CpuMax(config.CpuMax)
+		if period != "" {
+			write("cpu", "cpu.cfs_period_us", period)
+		}
+		write("cpu", "cpu.cfs_quota_us", quota)
+	}
+	if config.CpuBurst != "" {
+		write("cpu", "cpu.cfs_burst_us", config.CpuBurst)
+	}
+	if config.CpuWeight != "" {
+		if weight, err := strconv.Atoi(config.CpuWeight); err == nil {
+			write("cpu", "cpu.shares", strconv.Itoa(max(weight*1024/100, 2)))
+		}
+	}
+	if config.MemoryMax != "" {
+		if err := dir.write("memory.limit_in_bytes", v1Max(config.MemoryMax)); err != nil {
+			dir.log.Error("Failed to write memory.limit_in_bytes", "path", subDir, "err", err)
+			errs = append(errs, err)
+		}
+	}
+	// v1 has no throttling soft limit; memory.soft_limit_in_bytes is what
+	// reclaim goes for first when the host is short of memory.
+	if config.MemoryHigh != "" {
+		if err := dir.write("memory.soft_limit_in_bytes", v1Max(config.MemoryHigh)); err != nil {
+			dir.log.Error("Failed to write memory.soft_limit_in_bytes", "path", subDir, "err", err)
+			errs = append(errs, err)
+		}
+	}
+	for _, entry := range config.IoMax {
+		fields := strings.Fields(entry)
+		for _, limit := range fields[1:] {
+			key, value, _ := strings.Cut(limit, "=")
+			if value == "max" {
+				value = "0"
+			}
+			write("blkio", v1IoFiles[key], fields[0]+" "+value)
+		}
+	}
+	if config.PidsMax != "" {
+		write("pids", "pids.max", config.PidsMax)
+	} else if pids := v.mirror("pids", subDir); pids != "" {
+		if err := writeToFile(filepath.Join(pids, "pids.max"), "max"); err != nil {
+			dir.log.Debug("Failed to reset pids.max", "path", pids, "err", err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (v cgroupV1) moveProcess(dir *cgroupDir, subDir, pid string) error {
+	if err := dir.write("cgroup.procs", pid); err != nil {
+		dir.log.Error("Failed to write cgroup.procs", "path", subDir, "err", err)
+		return err
+	}
+	var errs []error
+	for _, mirror := range v.mirrors(subDir) {
+		if err := writeToFile(filepath.Join(mirror, "cgroup.procs"), pid); err != nil {
+			dir.log.Error("Failed to write cgroup.procs", "path", mirror, "err", err)
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// populated reads cgroup.procs, v1 has no cgroup.events.
+func (cgroupV1) populated(path string) bool {
+	return len(readPids(path)) > 0
+}
+
+func (v cgroupV1) remove(path string) error {
+	if err := cgroupFiles.Remove(path); err != nil {
+		return err
+	}
+	for _, dir := range v.mirrors(path) {
+		if err := cgroupFiles.Remove(dir); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			slog.Error("Failed to remove mirrored cgroup", "path", dir, "err", err)
+		}
+	}
+	return nil
+}
+
+// v1CpuMax splits a cpu.max value into cpu.cfs_quota_us and
+// cpu.cfs_period_us, the period is empty when the value has none.
+func v1CpuMax(value string) (quota, period string) {
+	quota, period, _ = strings.Cut(value, " ")
+	return v1Max(quota), strings.TrimSpace(period)
+}
+
+// v1Max translates the "max" of cgroup v2 into the -1 of v1.
+func v1Max(value string) string {
+	if value == "max" {
+		return "-1"
+	}
+	return value
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// check is one step of -check.
+type check struct {
+	name string
+	run  func() error
+}
+
+// preflightChecks verify the host before pguard is enabled on it. None of
+// them creates a cgroup or writes a control file.
+var preflightChecks = []check{
+	{"cgroup v2 is mounted", checkCgroup2},
+	{"the plans' controllers are available", checkControllers},
+	{"usersPath is writable", checkUsersPath},
+	{"the socket directory is writable", checkSocketDir},
+}
+
+// runChecks runs the preflight checks, printing one line each, and returns
+// the error of the first one failing.
+func runChecks() error {
+	for _, c := range preflightChecks {
+		if err := c.run(); err != nil {
+			fmt.Printf("FAIL %s: %v\n", c.name, err)
+			return err
+		}
+		fmt.Printf("ok   %s\n", c.name)
+	}
+	fmt.Printf("all %d checks passed\n", len(preflightChecks))
+	return nil
+}
+
+func checkCgroup2() error {
+	if _, ok := layout.(cgroupV1); ok {
+		return fmt.Errorf("%s is a cgroup v1 hierarchy", cgroupMount)
+	}
+	return nil
+}
+
+// checkControllers checks that the cgroup root, or the delegated cgroup,
+// offers the controllers the plans need and that its cgroup.subtree_control,
+// where pguard enables them, can be written.
+func checkControllers() error {
+	content, err := os.ReadFile(filepath.Join(delegatedRoot, "cgroup.controllers"))
+	if err != nil {
+		return err
+	}
+	available := strings.Fields(string(content))
+	var missing []string
+	for _, controller := range neededControllers() {
+		if !slices.Contains(available, controller) {
+			missing = append(missing, controller)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("%s lacks %s", delegatedRoot, strings.Join(missing, ", "))
+	}
+	control := filepath.Join(delegatedRoot, "cgroup.subtree_control")
+	if err := unix.Access(control, unix.W_OK); err != nil {
+		return fmt.Errorf("%s: %w", control, err)
+	}
+	return nil
+}
+
+// checkUsersPath checks that usersPath, or the directory it would be created
+// in, is writable.
+func checkUsersPath() error {
+	dir := filepath.Clean(usersPath)
+	if _, err := os.Stat(dir); err != nil {
+		dir = filepath.Dir(dir)
+	}
+	if err := unix.Access(dir, unix.W_OK); err != nil {
+		return fmt.Errorf("%s: %w", dir, err)
+	}
+	return nil
+}
+
+func checkSocketDir() error {
+	addr := getSocketAddress()
+	if isAbstractSocket(addr) {
+		return nil
+	}
+	dir := filepath.Dir(addr)
+	info, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	if err := unix.Access(dir, unix.W_OK); err != nil {
+		return fmt.Errorf("%s: %w", dir, err)
+	}
+	return nil
+}
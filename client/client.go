@@ -0,0 +1,132 @@
+// Package client requests cgroups from a running pguard.
+//
+// pguard listens on a unix socket and handles one request per connection. A
+// request is a single newline terminated line of at most 4096 bytes,
+//
+//	pid|user|plan[|priority[|format]]
+//
+// and the daemon answers with one line, "OK <path>" with the subgroup the
+// process was moved to, relative to the managed tree, or "ERR <code> <message>"
+// with one of the Code values.
+package client
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"time"
+)
+
+// DefaultSocket is where pguard listens when run as root.
+const DefaultSocket = "/var/run/pguard.webserver.socket"
+
+// Client talks to the pguard listening on Socket.
+type Client struct {
+	// Socket is the path of the unix socket, DefaultSocket when empty.
+	Socket string
+	// Timeout bounds a whole request, dialing included; zero means no limit.
+	Timeout time.Duration
+}
+
+// Code classifies an ERR answer. It is the word following "ERR", stable across
+// pguard versions while the message after it is meant for humans.
+type Code string
+
+const (
+	// CodeBadRequest is a malformed request, e.g. a missing user.
+	CodeBadRequest Code = "bad-request"
+	// CodeUnknownPlan is a request for a plan pguard doesn't have.
+	CodeUnknownPlan Code = "unknown-plan"
+	// CodeUnauthorized is a request the caller may not make.
+	CodeUnauthorized Code = "unauthorized"
+	// CodeNoSuchPid is a request for a process that doesn't exist (anymore).
+	CodeNoSuchPid Code = "no-such-pid"
+	// CodeRejected is a valid request pguard won't serve, e.g. for a kernel
+	// thread or a user at its subgroup limit.
+	CodeRejected Code = "rejected"
+	// CodeQuarantined is a request of a user quarantined after repeated
+	// failures.
+	CodeQuarantined Code = "quarantined"
+	// CodeUnavailable is a request pguard can't serve right now: it is busy,
+	// draining, shutting down or out of cgroups. Retrying later may succeed.
+	CodeUnavailable Code = "unavailable"
+	// CodeInternal is a failure on the side of pguard or the host.
+	CodeInternal Code = "internal"
+)
+
+var codes = []Code{CodeBadRequest, CodeUnknownPlan, CodeUnauthorized, CodeNoSuchPid,
+	CodeRejected, CodeQuarantined, CodeUnavailable, CodeInternal}
+
+// Error is a request pguard answered with ERR. Code is empty for answers of
+// pguard versions without codes.
+type Error struct {
+	Code    Code
+	Message string
+}
+
+func (e *Error) Error() string {
+	if e.Code == "" {
+		return "pguard: " + e.Message
+	}
+	return "pguard: " + string(e.Code) + ": " + e.Message
+}
+
+// parseError parses the part of an ERR answer after "ERR ".
+func parseError(answer string) *Error {
+	word, message, _ := strings.Cut(answer, " ")
+	if slices.Contains(codes, Code(word)) {
+		return &Error{Code: Code(word), Message: message}
+	}
+	return &Error{Message: answer}
+}
+
+// New returns a Client for socket.
+func New(socket string) *Client {
+	return &Client{Socket: socket, Timeout: 10 * time.Second}
+}
+
+// Assign asks pguard to move pid into a new subgroup of user's slice with the
+// limits of plan, sending "pid|user|plan". It returns the subgroup path from
+// the "OK <path>" answer; an "ERR <code> <message>" answer is returned as
+// *Error.
+func (c *Client) Assign(pid int, user, plan string) (string, error) {
+	if strings.ContainsAny(user+plan, "|\n") {
+		return "", errors.New("pguard: user and plan must not contain '|' or newlines")
+	}
+	return c.do(fmt.Sprintf("%d|%s|%s", pid, user, plan))
+}
+
+// do sends one request line and parses the answer.
+func (c *Client) do(request string) (string, error) {
+	socket := c.Socket
+	if socket == "" {
+		socket = DefaultSocket
+	}
+	conn, err := net.DialTimeout("unix", socket, c.Timeout)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	if c.Timeout > 0 {
+		conn.SetDeadline(time.Now().Add(c.Timeout))
+	}
+
+	if _, err := conn.Write([]byte(request + "\n")); err != nil {
+		return "", err
+	}
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil && line == "" {
+		return "", fmt.Errorf("pguard: reading the answer: %w", err)
+	}
+	line = strings.TrimSuffix(line, "\n")
+	if path, ok := strings.CutPrefix(line, "OK "); ok {
+		return path, nil
+	}
+	if answer, ok := strings.CutPrefix(line, "ERR "); ok {
+		return "", parseError(answer)
+	}
+	return "", fmt.Errorf("pguard: unexpected answer %q", line)
+}
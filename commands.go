@@ -0,0 +1,382 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/malumar/pguard/client"
+)
+
+// command is a request that starts with a verb instead of a pid. The verb is
+// matched case-insensitively and the remaining "|"-separated fields are passed
+// on as arguments. Callers need at least the command's capability.
+type command struct {
+	run        func(conn net.Conn, args []string)
+	capability capability
+}
+
+var commands = map[string]command{
+	"gc":          {gcCommand, capAdmin},
+	"stat":        {statCommand, capRead},
+	"failures":    {failuresCommand, capRead},
+	"checkauth":   {checkauthCommand, capRead},
+	"setinterval": {setintervalCommand, capAdmin},
+	"snapshot":    {snapshotCommand, capRead},
+	"promote":     {promoteCommand, capAdmin},
+	"planstats":   {planstatsCommand, capAdmin},
+	"rename":      {renameCommand, capAdmin},
+	"watches":     {watchesCommand, capAdmin},
+	"evacuate":    {evacuateCommand, capAdmin},
+	"adopt":       {adoptCommand, capAdmin},
+	"ping":        {pingCommand, capRead},
+	"list":        {listCommand, capRead},
+	"reassign":    {reassignCommand, capWrite},
+	"config":      {configCommand, capAdmin},
+	"kill":        {killCommand, capWrite},
+	"stats":       {statsCommand, capRead},
+	"remove":      {removeCommand, capWrite},
+	"drain":       {drainCommand, capAdmin},
+	"undrain":     {undrainCommand, capAdmin},
+	"reload":      {reloadCommand, capAdmin},
+}
+
+// isVerb reports whether the first field of a request names a command rather
+// than being the pid of an assignment.
+func isVerb(field string) bool {
+	return field != "" && (field[0] >= 'a' && field[0] <= 'z' || field[0] >= 'A' && field[0] <= 'Z')
+}
+
+// unknownCommand answers a request with an unrecognized verb, listing the
+// commands the caller is allowed to use. It usually means the client expects
+// a newer pguard.
+func unknownCommand(conn net.Conn, verb string, granted capability) {
+	attrs := []any{"command", verb, "capability", granted}
+	if cred, err := peerCredentials(conn); err == nil {
+		attrs = append(attrs, "uid", cred.Uid, "pid", cred.Pid)
+	}
+	slog.Debug("Unknown command", attrs...)
+
+	var available []string
+	for name, command := range commands {
+		if granted >= command.capability {
+			available = append(available, name)
+		}
+	}
+	slices.Sort(available)
+	reply(conn, "ERR %s unknown command: %s (available: %s)", client.CodeBadRequest, verb, strings.Join(available, ", "))
+}
+
+// pingCommand answers PONG, a liveness probe for supervisors that touches
+// nothing else.
+func pingCommand(conn net.Conn, _ []string) {
+	reply(conn, "PONG")
+}
+
+// gcCommand runs a cleanup sweep right away instead of waiting for the next
+// cycle and reports what it did.
+func gcCommand(conn net.Conn, _ []string) {
+	if cleanupTicker == nil {
+		reply(conn, "ERR %s cleanup is not running", client.CodeUnavailable)
+		return
+	}
+	scanned, removed := cleanupAllSubgroups(activeWatcher, "")
+	slog.Info("Forced cleanup", "path", usersPath, "scanned", scanned, "removed", removed)
+	reply(conn, "scanned=%d removed=%d", scanned, removed)
+}
+
+// setintervalCommand changes the time between cleanup sweeps until the next
+// restart, e.g. "setinterval|2s".
+func setintervalCommand(conn net.Conn, args []string) {
+	if len(args) != 1 {
+		reply(conn, "ERR %s expected setinterval|duration", client.CodeBadRequest)
+		return
+	}
+	d, err := time.ParseDuration(args[0])
+	if err != nil {
+		reply(conn, "ERR %s invalid duration %q", client.CodeBadRequest, args[0])
+		return
+	}
+	if err := setCleanupInterval(d); err != nil {
+		reply(conn, "ERR %s %v", errorCode(err), err)
+		return
+	}
+	slog.Info("Cleanup interval changed", "interval", d)
+	reply(conn, "interval=%s", d)
+}
+
+// failuresCommand reports how many assignments failed for each reason within
+// the -failureWindow.
+func failuresCommand(conn net.Conn, _ []string) {
+	counts := failures.counts()
+	reasons := []string{reasonUnknownPlan, reasonPidGone, reasonNotDelegated, reasonRejectedByLimit, reasonExhausted, reasonInternal}
+	fields := []string{"window=" + failures.window.String()}
+	for _, reason := range reasons {
+		fields = append(fields, fmt.Sprintf("%s=%d", reason, counts[reason]))
+	}
+	reply(conn, "%s", strings.Join(fields, " "))
+}
+
+// checkauthCommand tells the caller how pguard sees it: its credentials, the
+// user slice its uid maps to and whether it may create cgroups there. It
+// doesn't change anything.
+func checkauthCommand(conn net.Conn, _ []string) {
+	cred, err := peerCredentials(conn)
+	if err != nil {
+		reply(conn, "ERR %s can't read peer credentials: %v", client.CodeInternal, err)
+		return
+	}
+	fields := []string{fmt.Sprintf("uid=%d gid=%d pid=%d", cred.Uid, cred.Gid, cred.Pid)}
+	account, err := user.LookupId(strconv.Itoa(int(cred.Uid)))
+	if err != nil {
+		reply(conn, "%s user=unknown create=denied", fields[0])
+		return
+	}
+	fields = append(fields, "user="+account.Username, "slice="+account.Username+".slice")
+	if err := authorizeCreate(cred, account.Username); err != nil {
+		fields = append(fields, "create=denied", "reason="+strconv.Quote(err.Error()))
+	} else if until, ok := quarantinedUntil(account.Username); ok {
+		fields = append(fields, "create=denied", "quarantined="+until.Format(time.RFC3339))
+	} else if userDrained(account.Username) {
+		fields = append(fields, "create=denied", "drained")
+	} else {
+		fields = append(fields, "create=allowed")
+	}
+	reply(conn, "%s", strings.Join(fields, " "))
+}
+
+// reply writes a single newline-terminated line back to the client, within
+// -write-timeout.
+func reply(conn net.Conn, format string, args ...any) {
+	if replyTimeout > 0 {
+		if err := conn.SetWriteDeadline(time.Now().Add(replyTimeout)); err != nil {
+			slog.Debug("can't SetWriteDeadline", "err", err)
+		}
+	}
+	if _, err := fmt.Fprintf(conn, format+"\n", args...); err != nil {
+		slog.Debug("Connection write error", "err", err)
+	}
+}
+
+// statCommand reports the memory events of every subgroup of a user. The
+// hierarchical counters in memory.events include events raised by an ancestor
+// (e.g. the user slice hitting its own limit), while memory.events.local only
+// counts what happened in the subgroup itself; comparing the two tells a
+// tenant hitting its own limit apart from pressure coming from above.
+//
+// Without a user it reports the state of the daemon itself.
+func statCommand(conn net.Conn, args []string) {
+	if len(args) == 0 {
+		reply(conn, "interval=%s", cleanupInterval())
+		return
+	}
+	if len(args) != 1 || !validUsername(args[0]) {
+		reply(conn, "ERR %s expected stat|user", client.CodeBadRequest)
+		return
+	}
+	slice := filepath.Join(usersPath, args[0]+".slice")
+	entries, err := os.ReadDir(slice)
+	if err != nil {
+		slog.Error("Failed to read directory", "dir", slice, "err", err)
+		reply(conn, "ERR %s unknown user", client.CodeBadRequest)
+		return
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		subDir := filepath.Join(slice, entry.Name())
+		line := filepath.Join(args[0]+".slice", entry.Name())
+		if events, err := readKeyValues(filepath.Join(subDir, "memory.events")); err == nil {
+			line += fmt.Sprintf(" oom=%d oom_kill=%d", events["oom"], events["oom_kill"])
+		}
+		events, err := readKeyValues(filepath.Join(subDir, "memory.events.local"))
+		switch {
+		case err == nil:
+			line += fmt.Sprintf(" local_oom=%d local_oom_kill=%d", events["oom"], events["oom_kill"])
+		case os.IsNotExist(err):
+			// Kernels before 5.7 don't have memory.events.local.
+			line += " local=unavailable"
+		default:
+			slog.Error("Failed to read memory.events.local", "path", subDir, "err", err)
+		}
+		reply(conn, "%s", line)
+	}
+}
+
+// walkSubgroups calls fn for every subgroup of every user slice in usersPath.
+// Unreadable directories are logged and skipped.
+func walkSubgroups(fn func(user, dir string)) {
+	slices, err := os.ReadDir(usersPath)
+	if err != nil {
+		slog.Error("Failed to read directory", "dir", usersPath, "err", err)
+		return
+	}
+	for _, slice := range slices {
+		if user, ok := strings.CutSuffix(slice.Name(), ".slice"); slice.IsDir() && ok {
+			walkUserSubgroups(user, fn)
+		}
+	}
+}
+
+// walkUserSubgroups calls fn for every subgroup of the slice of user, without
+// looking at those of other users. An unreadable slice is logged and skipped.
+func walkUserSubgroups(user string, fn func(user, dir string)) {
+	sliceDir := filepath.Join(usersPath, user+".slice")
+	subDirs, err := os.ReadDir(sliceDir)
+	if err != nil {
+		slog.Error("Failed to read directory", "dir", sliceDir, "err", err)
+		return
+	}
+	for _, subDir := range subDirs {
+		if subDir.IsDir() {
+			fn(user, filepath.Join(sliceDir, subDir.Name()))
+		}
+	}
+}
+
+// listCommand lists the subgroups, of all users or of the one given as
+// "list|user", one "user/subgroup pid,pid" line each, followed by their count.
+func listCommand(conn net.Conn, args []string) {
+	if len(args) > 1 || len(args) == 1 && !validUsername(args[0]) {
+		reply(conn, "ERR %s expected list[|user]", client.CodeBadRequest)
+		return
+	}
+	n := 0
+	list := func(user, dir string) {
+		n++
+		line := user + "/" + filepath.Base(dir)
+		if pids := readPids(dir); len(pids) > 0 {
+			line += " " + strings.Join(pids, ",")
+		}
+		reply(conn, "%s", line)
+	}
+	if len(args) == 1 {
+		if _, err := os.Stat(filepath.Join(usersPath, args[0]+".slice")); err == nil {
+			walkUserSubgroups(args[0], list)
+		}
+	} else {
+		walkSubgroups(list)
+	}
+	reply(conn, "subgroups=%d", n)
+}
+
+// statsCommand reports the resource usage of a user for metering, e.g.
+// "stats|alice": the CPU time from cpu.stat and the memory.current and
+// memory.peak of every subgroup of the user, summed up. Files a kernel doesn't
+// have, like memory.peak before 5.19, are skipped. The reply is
+// "subgroups=N cpu_usage_usec=N memory_current=N memory_peak=N".
+func statsCommand(conn net.Conn, args []string) {
+	if len(args) != 1 || !validUsername(args[0]) {
+		reply(conn, "ERR %s expected stats|user", client.CodeBadRequest)
+		return
+	}
+	if _, err := os.Stat(filepath.Join(usersPath, args[0]+".slice")); err != nil {
+		reply(conn, "ERR %s unknown user", client.CodeBadRequest)
+		return
+	}
+	var subgroups int
+	var cpuUsage, memoryCurrent, memoryPeak uint64
+	walkUserSubgroups(args[0], func(_, dir string) {
+		subgroups++
+		if stat, err := readKeyValues(filepath.Join(dir, "cpu.stat")); err == nil {
+			cpuUsage += stat["usage_usec"]
+		}
+		if current, err := readUint(filepath.Join(dir, "memory.current")); err == nil {
+			memoryCurrent += current
+		}
+		if peak, err := readUint(filepath.Join(dir, "memory.peak")); err == nil {
+			memoryPeak += peak
+		}
+	})
+	reply(conn, "subgroups=%d cpu_usage_usec=%d memory_current=%d memory_peak=%d",
+		subgroups, cpuUsage, memoryCurrent, memoryPeak)
+}
+
+// planUsage is the usage of all subgroups of one plan.
+type planUsage struct {
+	Cgroups       int    `json:"cgroups"`
+	CpuUsageUsec  uint64 `json:"cpuUsageUsec"`
+	MemoryCurrent uint64 `json:"memoryCurrent"`
+}
+
+// planstatsCommand sums up the usage of all subgroups by the plan recorded for
+// them, for chargeback and capacity planning. Subgroups without a recorded plan
+// are counted as "unknown".
+func planstatsCommand(conn net.Conn, _ []string) {
+	usage := make(map[string]*planUsage)
+	walkSubgroups(func(_, dir string) {
+		plan, _ := getMeta(dir, metaPlan)
+		if plan == "" {
+			plan = "unknown"
+		}
+		if usage[plan] == nil {
+			usage[plan] = &planUsage{}
+		}
+		usage[plan].Cgroups++
+		if stat, err := readKeyValues(filepath.Join(dir, "cpu.stat")); err == nil {
+			usage[plan].CpuUsageUsec += stat["usage_usec"]
+		}
+		if current, err := readUint(filepath.Join(dir, "memory.current")); err == nil {
+			usage[plan].MemoryCurrent += current
+		}
+	})
+	out, err := json.Marshal(usage)
+	if err != nil {
+		reply(conn, "ERR %s %v", errorCode(err), err)
+		return
+	}
+	reply(conn, "%s", out)
+}
+
+// countSubgroups returns the number of subgroups in all user slices.
+func countSubgroups() int {
+	n := 0
+	walkSubgroups(func(_, _ string) { n++ })
+	return n
+}
+
+// readUint reads a cgroup file holding a single number.
+func readUint(path string) (uint64, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(content)), 10, 64)
+}
+
+// readKeyValues parses the flat "key value" format used by cgroup files such
+// as memory.events and cpu.stat. Malformed lines are skipped.
+func readKeyValues(path string) (map[string]uint64, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string]uint64)
+	for _, line := range strings.Split(string(content), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		if value, err := strconv.ParseUint(fields[1], 10, 64); err == nil {
+			values[fields[0]] = value
+		}
+	}
+	return values, nil
+}
+
+// validUsername reports whether user can be used as the name of a user slice
+// without escaping usersPath. Dots and hyphens are fine inside a name
+// ("john.doe", "web-1"), but not at its start or as "..".
+func validUsername(user string) bool {
+	return user != "" && !strings.HasPrefix(user, ".") && !strings.Contains(user, "..") &&
+		!strings.ContainsAny(user, "/\x00")
+}
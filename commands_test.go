@@ -0,0 +1,216 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/malumar/pguard/client"
+)
+
+func TestCommandErrorCodes(t *testing.T) {
+	for _, test := range []struct {
+		line  string
+		setup func(t *testing.T)
+		code  client.Code
+	}{
+		{line: "kill", code: client.CodeBadRequest},
+		{line: "kill|../etc", code: client.CodeBadRequest},
+		{line: "kill|nobody", code: client.CodeBadRequest},
+		{line: "remove|alice", code: client.CodeBadRequest},
+		{line: "remove|alice/job|now", code: client.CodeBadRequest},
+		{line: "remove|alice/job", code: client.CodeBadRequest},
+		{line: "drain", code: client.CodeBadRequest},
+		{line: "undrain|alice", code: client.CodeRejected},
+		{line: "rename|alice", code: client.CodeBadRequest},
+		{line: "rename|alice|bob", code: client.CodeBadRequest},
+		{line: "setinterval|soon", code: client.CodeBadRequest},
+		{line: "stats", code: client.CodeBadRequest},
+		{line: "adopt|/etc|standard", code: client.CodeBadRequest},
+		{line: "adopt|alice.slice/job|nosuch", setup: foreignCgroup, code: client.CodeUnknownPlan},
+		{line: "reassign|1|alice", code: client.CodeBadRequest},
+		{line: "reassign|" + selfPid + "|alice|nosuch", code: client.CodeUnknownPlan},
+		{line: "reassign|999999999|alice|standard", code: client.CodeNoSuchPid},
+		{line: "reassign|" + selfPid + "|alice|standard", setup: drainAll, code: client.CodeUnavailable},
+		{line: "reassign|" + selfPid + "|alice|standard", setup: restrictAssign, code: client.CodeUnauthorized},
+		{line: "kill|alice", setup: restrictAssign, code: client.CodeUnauthorized},
+		{line: "remove|alice/job", setup: restrictAssign, code: client.CodeUnauthorized},
+		{line: "reassign|" + selfPid + "|alice|standard", setup: closeAllSetups, code: client.CodeUnavailable},
+		{line: "promote", code: client.CodeRejected},
+		{line: "promote", setup: func(t *testing.T) { useStandby(t); closeAllSetups(t) }, code: client.CodeUnavailable},
+		{line: "loadtest|1", setup: func(t *testing.T) { useLoadtest(t); closeAllSetups(t) }, code: client.CodeUnavailable},
+		{line: "gc", code: client.CodeUnavailable},
+	} {
+		t.Run(test.line, func(t *testing.T) {
+			newTestTree(t)
+			if test.setup != nil {
+				test.setup(t)
+			}
+			reply := request(t, test.line)
+			if want := "ERR " + string(test.code) + " "; !strings.HasPrefix(reply, want) {
+				t.Errorf("got %q, want an answer starting with %q", reply, want)
+			}
+		})
+	}
+}
+
+// foreignCgroup creates alice.slice/job as someone else than pguard would.
+func foreignCgroup(t *testing.T) {
+	for _, dir := range []string{usersPath + "alice.slice", usersPath + "alice.slice/job"} {
+		if err := cgroupFiles.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// drainAll puts pguard in drain mode for the test.
+func drainAll(t *testing.T) {
+	draining.Store(true)
+	t.Cleanup(func() { draining.Store(false) })
+}
+
+// closeAllSetups makes pguard refuse new cgroup setups, as it does once
+// shutdown has begun.
+func closeAllSetups(t *testing.T) {
+	setupsMu.Lock()
+	setupsClosed = true
+	setupsMu.Unlock()
+	t.Cleanup(func() {
+		setupsMu.Lock()
+		setupsClosed = false
+		setupsMu.Unlock()
+	})
+}
+
+// useStandby makes pguard a standby that hasn't been promoted yet.
+func useStandby(t *testing.T) {
+	saved := *standbyOf
+	*standbyOf = "/run/pguard-active.sock"
+	t.Cleanup(func() {
+		*standbyOf = saved
+		standbyMu.Lock()
+		promoted = false
+		standbyMu.Unlock()
+	})
+}
+
+// useLoadtest registers the loadtest command, with a cleanup cycle running as
+// it requires.
+func useLoadtest(t *testing.T) {
+	commands["loadtest"] = command{loadtestCommand, capAdmin}
+	cleanupTicker = time.NewTicker(time.Hour)
+	t.Cleanup(func() {
+		delete(commands, "loadtest")
+		cleanupTicker.Stop()
+		cleanupTicker = nil
+	})
+}
+
+// restrictAssign sets -assignGids to a group the test's peer isn't in.
+func restrictAssign(t *testing.T) {
+	saved := assignGids
+	assignGids = []uint32{4242}
+	t.Cleanup(func() { assignGids = saved })
+}
+
+func TestStatsOfOneUser(t *testing.T) {
+	newTestTree(t)
+	for _, user := range []string{"alice", "alice", "bob"} {
+		subDir := assign(t, user, planStandard)
+		if err := os.WriteFile(filepath.Join(subDir, "cpu.stat"), []byte("usage_usec 100\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if reply := request(t, "stats|alice"); !strings.HasPrefix(reply, "subgroups=2 cpu_usage_usec=200 ") {
+		t.Errorf("stats|alice: %s, want the 2 subgroups of alice alone", reply)
+	}
+	if reply := request(t, "list|bob"); !strings.HasPrefix(reply, "bob/") || !strings.HasSuffix(reply, "subgroups=1") {
+		t.Errorf("list|bob: %q, want the one subgroup of bob", reply)
+	}
+	if reply := request(t, "list|carol"); reply != "subgroups=0" {
+		t.Errorf("list|carol: %q, want no subgroups", reply)
+	}
+}
+
+func TestAssignedPathRoundTrips(t *testing.T) {
+	tree := newTestTree(t)
+	var rels []string
+	for range 2 {
+		reply := request(t, selfPid+"|alice|standard")
+		rel, ok := strings.CutPrefix(reply, "OK ")
+		if !ok {
+			t.Fatalf("assignment: %s", reply)
+		}
+		if info, err := os.Stat(filepath.Join(usersPath, rel)); err != nil || !info.IsDir() {
+			t.Fatalf("the reply's path %s isn't a directory: %v", rel, err)
+		}
+		rels = append(rels, rel)
+	}
+	for _, rel := range rels {
+		tree.exit(t, filepath.Join(usersPath, rel))
+	}
+
+	// list names the subgroups without ".slice", remove takes either form.
+	listed := strings.Split(request(t, "list|alice"), "\n")
+	for _, rel := range rels {
+		if short := strings.Replace(rel, ".slice/", "/", 1); !slices.Contains(listed, short) {
+			t.Errorf("list %q doesn't name %s", listed, short)
+		}
+	}
+	for _, name := range []string{rels[0], strings.Replace(rels[1], ".slice/", "/", 1)} {
+		if reply := request(t, "remove|"+name); reply != "removed "+name {
+			t.Errorf("remove|%s: %s", name, reply)
+		}
+	}
+	for _, rel := range rels {
+		if tree.exists(filepath.Join(usersPath, rel)) {
+			t.Errorf("%s still there after its removal", rel)
+		}
+	}
+}
+
+func TestValidUsername(t *testing.T) {
+	for user, ok := range map[string]bool{
+		"alice":         true,
+		"john.doe":      true,
+		"web-01":        true,
+		"a.b-c_d":       true,
+		"":              false,
+		".":             false,
+		"..":            false,
+		".hidden":       false,
+		"../../etc":     false,
+		"alice/../bob":  false,
+		"alice..bob":    false,
+		"alice/bob":     false,
+		"/etc":          false,
+		"alice\x00.tmp": false,
+	} {
+		if got := validUsername(user); got != ok {
+			t.Errorf("validUsername(%q) = %v, want %v", user, got, ok)
+		}
+	}
+}
+
+func TestTraversalUsernameRefused(t *testing.T) {
+	newTestTree(t)
+	before, err := os.ReadDir(delegatedRoot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, user := range []string{"../../etc", "..", ".slice", "alice/../../x", "x\x00y"} {
+		if reply := request(t, selfPid+"|"+user+"|standard"); !strings.HasPrefix(reply, "ERR bad-request ") {
+			t.Errorf("user %q: %s, want ERR bad-request", user, reply)
+		}
+	}
+	if after, _ := os.ReadDir(delegatedRoot); len(after) != len(before) {
+		t.Errorf("%d entries in the cgroup root after the refused requests, want %d", len(after), len(before))
+	}
+	if n := sliceSubgroups(usersPath); n != 0 {
+		t.Errorf("%d directories in usersPath after the refused requests, want none", n)
+	}
+	placedPath(t, request(t, selfPid+"|john.doe|standard"))
+}
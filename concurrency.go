@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+const (
+	defaultMaxConcurrency = 1024
+	// busyTimeout is how long a connection waits for a free handler before
+	// it is answered ERR busy.
+	busyTimeout = time.Second
+)
+
+// handlers holds a token for every connection being handled, bounding them
+// to -max-concurrency; nil means no bound.
+var handlers chan struct{}
+
+// acquireHandler waits up to busyTimeout for a free handler and reports
+// whether it got one. A true result is paired with releaseHandler.
+func acquireHandler(ctx context.Context) bool {
+	if handlers == nil {
+		return true
+	}
+	select {
+	case handlers <- struct{}{}:
+		return true
+	default:
+	}
+	timer := time.NewTimer(busyTimeout)
+	defer timer.Stop()
+	select {
+	case handlers <- struct{}{}:
+		return true
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+	return false
+}
+
+func releaseHandler() {
+	if handlers != nil {
+		<-handlers
+	}
+}
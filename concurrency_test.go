@@ -0,0 +1,87 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// limitConcurrency sets -max-concurrency for the test.
+func limitConcurrency(t *testing.T, max int) {
+	saved := handlers
+	handlers = make(chan struct{}, max)
+	t.Cleanup(func() { handlers = saved })
+}
+
+// assignConcurrently sends n assignments for user at once and returns a
+// function waiting for their replies.
+func assignConcurrently(t *testing.T, user string, n int) (replies func() []string) {
+	var wg sync.WaitGroup
+	got := make([]string, n)
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			got[i] = request(t, selfPid+"|"+user+"|standard")
+		}()
+	}
+	return func() []string {
+		wg.Wait()
+		return got
+	}
+}
+
+func TestConcurrencyCap(t *testing.T) {
+	tree := newTestTree(t)
+	limitConcurrency(t, 2)
+	release := tree.holdWrites("cgroup.procs")
+	replies := assignConcurrently(t, "alice", 3)
+
+	// Two assignments get as far as their subgroup while the third waits for
+	// a handler.
+	slice := usersPath + "alice.slice/"
+	if !waitFor(time.Second, func() bool { return sliceSubgroups(slice) == 2 }) {
+		t.Fatalf("%d subgroups being set up, want 2", sliceSubgroups(slice))
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n := sliceSubgroups(slice); n != 2 || len(handlers) != 2 {
+		t.Errorf("%d subgroups and %d handlers with a cap of 2", n, len(handlers))
+	}
+	release()
+	for _, reply := range replies() {
+		if !strings.HasPrefix(reply, "OK ") {
+			t.Errorf("an assignment that waited for a handler got %q", reply)
+		}
+	}
+	if len(handlers) != 0 {
+		t.Errorf("%d handlers still taken after the replies", len(handlers))
+	}
+}
+
+func TestConcurrencyCapAnswersBusy(t *testing.T) {
+	tree := newTestTree(t)
+	limitConcurrency(t, 1)
+	// A busy connection is answered before its request is read, which a
+	// net.Pipe client wouldn't get past writing.
+	_, addr := startTestServer(t)
+	release := tree.holdWrites("cgroup.procs")
+	defer release()
+	held := assignConcurrently(t, "alice", 1)
+	if !waitFor(time.Second, func() bool { return len(handlers) == 1 }) {
+		t.Fatal("the first assignment never got a handler")
+	}
+
+	start := time.Now()
+	reply := dial(t, addr, selfPid+"|bob|standard")
+	if !strings.HasPrefix(reply, "ERR unavailable busy") {
+		t.Errorf("got %q with every handler taken, want ERR unavailable busy", reply)
+	}
+	if waited := time.Since(start); waited < busyTimeout {
+		t.Errorf("answered busy after %s, want a wait of %s first", waited, busyTimeout)
+	}
+	release()
+	if got := held()[0]; !strings.HasPrefix(got, "OK ") {
+		t.Errorf("the held assignment got %q", got)
+	}
+}
@@ -0,0 +1,511 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/malumar/pguard/client"
+	"golang.org/x/sys/unix"
+)
+
+// Config is the content of the file given with -config:
+//
+//	{
+//	  "plans": {
+//	    "standard": {"cpuMax": "50000 100000", "cpuWeight": "50"},
+//	    "premium":  {"cpuMax": "90000 100000", "cpuWeight": "100", "procsFirst": true}
+//	  }
+//	}
+//
+// Plans from the file are added to the built-in ones, a plan with a built-in
+// name replaces it. A plan with "extends" starts out as a copy of the named
+// plan of the file or a built-in one and only sets what differs:
+//
+//	"batch-low": {"extends": "batch", "cpuWeight": "20"}
+//
+// Lines starting with "//" or "#" are comments, and $VAR or ${VAR} anywhere
+// in the file is replaced by the environment variable; "$$" is a literal "$".
+type Config struct {
+	Plans map[string]PlanConfig `json:"plans"`
+	// DefaultPlan names the plan of requests without one, in place of
+	// -default-plan.
+	DefaultPlan string `json:"defaultPlan,omitempty"`
+
+	// planKeys are the keys each plan of the file sets, so that a plan
+	// extending another can set a field to false or "" too.
+	planKeys map[string]map[string]json.RawMessage
+}
+
+// loadConfig reads and validates the config file. All problems found are
+// returned together, each with the line of the file it refers to.
+func loadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseConfig(path, data)
+}
+
+// parseConfig decodes and validates a config read from source, which names the
+// file or URL in error messages.
+func parseConfig(source string, data []byte) (*Config, error) {
+	data, err := expandConfig(stripComments(data))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", source, err)
+	}
+	var config Config
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&config); err != nil {
+		var syntaxErr *json.SyntaxError
+		var typeErr *json.UnmarshalTypeError
+		switch {
+		case errors.As(err, &syntaxErr):
+			return nil, fmt.Errorf("%s: %w\n%s", source, err, lineContext(data, syntaxErr.Offset))
+		case errors.As(err, &typeErr):
+			return nil, fmt.Errorf("%s: %w\n%s", source, err, lineContext(data, typeErr.Offset))
+		}
+		return nil, fmt.Errorf("%s: %w", source, err)
+	}
+	var keys struct {
+		Plans map[string]map[string]json.RawMessage `json:"plans"`
+	}
+	if err := json.NewDecoder(bytes.NewReader(data)).Decode(&keys); err != nil {
+		return nil, fmt.Errorf("%s: %w", source, err)
+	}
+	config.planKeys = keys.Plans
+
+	if err := config.resolveExtends(); err != nil {
+		return nil, fmt.Errorf("%s: %w", source, err)
+	}
+
+	var errs []error
+	for name, plan := range config.Plans {
+		if err := plan.applyCpuPeriod(); err != nil {
+			errs = append(errs, fmt.Errorf("%s: plan %q: %w\n%s", source, name, err, lineContext(data, keyOffset(data, name))))
+			continue
+		}
+		config.Plans[name] = plan
+		if err := validatePlan(name, plan); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w\n%s", source, err, lineContext(data, keyOffset(data, name))))
+			continue
+		}
+		for i, entry := range plan.IoMax {
+			resolved, err := resolveIoMax(entry)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: plan %q: ioMax: %w\n%s", source, name, err, lineContext(data, keyOffset(data, name))))
+				continue
+			}
+			plan.IoMax[i] = resolved
+		}
+	}
+	if config.DefaultPlan != "" && !config.hasPlan(config.DefaultPlan) {
+		errs = append(errs, fmt.Errorf("%s: defaultPlan %q is not a plan", source, config.DefaultPlan))
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return &config, nil
+}
+
+// stripComments blanks the comment lines of a config, keeping the line
+// numbers of the rest for error messages.
+func stripComments(data []byte) []byte {
+	lines := bytes.Split(data, []byte("\n"))
+	for i, line := range lines {
+		trimmed := bytes.TrimSpace(line)
+		if bytes.HasPrefix(trimmed, []byte("//")) || bytes.HasPrefix(trimmed, []byte("#")) {
+			lines[i] = nil
+		}
+	}
+	return bytes.Join(lines, []byte("\n"))
+}
+
+// expandConfig replaces $VAR and ${VAR} by the environment variables of
+// pguard. A variable that isn't set is an error instead of becoming empty,
+// which would silently drop a limit. Values are escaped for a JSON string, so
+// a quote or backslash in one can't end the string it is in and change the
+// rest of the file.
+func expandConfig(data []byte) ([]byte, error) {
+	var missing []string
+	expanded := os.Expand(string(data), func(name string) string {
+		if name == "$" {
+			return "$"
+		}
+		value, ok := os.LookupEnv(name)
+		if !ok && !slices.Contains(missing, name) {
+			missing = append(missing, name)
+		}
+		return jsonEscape(value)
+	})
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("environment variables not set: %s", strings.Join(missing, ", "))
+	}
+	return []byte(expanded), nil
+}
+
+// jsonEscape returns s escaped for the inside of a JSON string.
+func jsonEscape(s string) string {
+	var escaped bytes.Buffer
+	encoder := json.NewEncoder(&escaped)
+	encoder.SetEscapeHTML(false)
+	encoder.Encode(s)
+	quoted := bytes.TrimSpace(escaped.Bytes())
+	return string(quoted[1 : len(quoted)-1])
+}
+
+// resolveExtends replaces every plan that extends another one by the full
+// plan: each field it leaves out is taken from its base, which may extend
+// another plan in turn. Plans extending an unknown plan or, through a chain,
+// themselves are an error.
+func (c *Config) resolveExtends() error {
+	resolved := make(map[string]bool)
+	var resolve func(name string, chain []string) error
+	resolve = func(name string, chain []string) error {
+		if resolved[name] {
+			return nil
+		}
+		if slices.Contains(chain, name) {
+			return fmt.Errorf("plan %q: extends cycle %s", chain[0], strings.Join(append(chain, name), " -> "))
+		}
+		plan := c.Plans[name]
+		if plan.Extends == "" {
+			resolved[name] = true
+			return nil
+		}
+		base, ok := c.Plans[plan.Extends]
+		if ok {
+			if err := resolve(plan.Extends, append(chain, name)); err != nil {
+				return err
+			}
+			base = c.Plans[plan.Extends]
+		} else if base, ok = builtinPlans[plan.Extends]; !ok {
+			return fmt.Errorf("plan %q: extends unknown plan %q", name, plan.Extends)
+		}
+		c.Plans[name] = plan.inherit(base, c.planKeys[name])
+		resolved[name] = true
+		return nil
+	}
+	names := make([]string, 0, len(c.Plans))
+	for name := range c.Plans {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		if err := resolve(name, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hasPlan reports whether plan is one of the config's plans or a built-in one.
+func (c *Config) hasPlan(plan string) bool {
+	plan = strings.ToLower(plan)
+	if _, ok := builtinPlans[plan]; ok {
+		return true
+	}
+	for name := range c.Plans {
+		if strings.ToLower(name) == plan {
+			return true
+		}
+	}
+	return false
+}
+
+// apply makes the plans of the config, together with the built-in ones, the
+// plans requests are served with, and its default plan the default. Once the
+// cgroup tree is set up it also writes the system reserve again, so a reload
+// restores it.
+func (c *Config) apply() {
+	swapPlans(c.Plans)
+	setDefaultPlan(c.DefaultPlan)
+	if reserveApplied.Load() {
+		if err := applySystemReserve(); err != nil {
+			slog.Error("Failed to apply the system reserve", "err", err)
+		}
+	}
+}
+
+// configFile is the -config file SIGHUP and the reload command read again,
+// "" without one.
+var configFile string
+
+// reloadMu serializes reloads, so that the plans and the default plan of two
+// of them don't get mixed.
+var reloadMu sync.Mutex
+
+// reloadOnHangup calls hangUp on every SIGHUP. It is pguard's one SIGHUP
+// handler; with neither -config nor -audit-log the signal keeps its default.
+func reloadOnHangup() {
+	if configFile == "" && auditLog.path == "" {
+		return
+	}
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, unix.SIGHUP)
+	go func() {
+		for range hangup {
+			hangUp()
+		}
+	}()
+}
+
+// hangUp is what SIGHUP does: it reopens the audit log and reloads the config
+// file, whichever of them is in use.
+func hangUp() {
+	reopenAuditLog()
+	if configFile != "" {
+		reloadConfig(configFile)
+	}
+}
+
+// reloadConfig loads and validates the config file at path and applies it. A
+// file that fails is logged and the plans in effect are kept. Requests
+// already being served keep the plan they looked up.
+func reloadConfig(path string) (*Config, error) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	config, err := loadConfig(path)
+	if err != nil {
+		slog.Error("Failed to reload config, keeping the current plans", "path", path, "err", err)
+		metrics.Add("config_reloads", 1, "result", "failed")
+		return nil, err
+	}
+	config.apply()
+	enableControllers()
+	slog.Info("Config reloaded", "path", path, "plans", len(config.Plans))
+	metrics.Add("config_reloads", 1, "result", "updated")
+	return config, nil
+}
+
+// reloadCommand reloads the -config file like SIGHUP does, for tools that
+// hold a connection anyway. The reply is "reloaded <n> plans", or the error
+// the file failed with, the plans in effect being kept then.
+func reloadCommand(conn net.Conn, args []string) {
+	if len(args) != 0 {
+		reply(conn, "ERR %s expected reload", client.CodeBadRequest)
+		return
+	}
+	if configFile == "" {
+		reply(conn, "ERR %s no -config file to reload", client.CodeRejected)
+		return
+	}
+	config, err := reloadConfig(configFile)
+	if err != nil {
+		// A syntax error quotes the offending line below the message; the
+		// reply must stay one line.
+		reply(conn, "ERR %s %s", client.CodeRejected, strings.Join(strings.Fields(err.Error()), " "))
+		return
+	}
+	reply(conn, "reloaded %d plans", len(config.Plans))
+}
+
+// applyCpuPeriod completes a CpuMax or SliceCpuMax given as a bare quota, or
+// as a lone "max", with the plan's CpuPeriod.
+func (p *PlanConfig) applyCpuPeriod() error {
+	if p.CpuPeriod == "" {
+		return nil
+	}
+	period, err := strconv.ParseUint(p.CpuPeriod, 10, 64)
+	if err != nil || period < cpuPeriodMin || period > cpuPeriodMax {
+		return fmt.Errorf("cpuPeriod must be between %d and %d microseconds", cpuPeriodMin, cpuPeriodMax)
+	}
+	if p.CpuMax == "" && p.SliceCpuMax == "" {
+		return errors.New("cpuPeriod needs a cpuMax or sliceCpuMax")
+	}
+	for _, value := range []*string{&p.CpuMax, &p.SliceCpuMax} {
+		switch fields := strings.Fields(*value); {
+		case len(fields) == 1:
+			*value = fields[0] + " " + p.CpuPeriod
+		case len(fields) == 2 && fields[1] != p.CpuPeriod:
+			return fmt.Errorf("the period of %q differs from cpuPeriod %s", *value, p.CpuPeriod)
+		}
+	}
+	return nil
+}
+
+func validatePlan(name string, plan PlanConfig) error {
+	if name == "" || name != strings.ToLower(name) || strings.ContainsAny(name, "| \t") {
+		return fmt.Errorf("plan %q: name must be lower case without spaces or '|'", name)
+	}
+	if plan.CpuMax != "" {
+		if err := validateCpuMax(plan.CpuMax); err != nil {
+			return fmt.Errorf("plan %q: cpuMax: %w", name, err)
+		}
+	}
+	if plan.CpuBurst != "" {
+		if burst, err := strconv.ParseUint(plan.CpuBurst, 10, 64); err != nil || burst == 0 {
+			return fmt.Errorf("plan %q: cpuBurst must be a positive number of microseconds", name)
+		}
+		if quota, _, _ := strings.Cut(plan.CpuMax, " "); quota == "" || quota == "max" {
+			return fmt.Errorf("plan %q: cpuBurst needs a cpuMax with a quota", name)
+		}
+	}
+	if plan.CpuIdle && plan.CpuWeight != "" {
+		return fmt.Errorf("plan %q: cpuIdle and cpuWeight exclude each other", name)
+	}
+	if plan.CpuWeight != "" {
+		weight, err := strconv.Atoi(plan.CpuWeight)
+		if err != nil || weight < cpuWeightMin || weight > cpuWeightMax {
+			return fmt.Errorf("plan %q: cpuWeight must be a number between %d and %d", name, cpuWeightMin, cpuWeightMax)
+		}
+	}
+	if plan.MemoryMax != "" {
+		if err := validateMemoryMax(plan.MemoryMax); err != nil {
+			return fmt.Errorf("plan %q: memoryMax: %w", name, err)
+		}
+	}
+	if plan.MemoryHigh != "" {
+		if err := validateMemoryMax(plan.MemoryHigh); err != nil {
+			return fmt.Errorf("plan %q: memoryHigh: %w", name, err)
+		}
+	}
+	if plan.SwapMax != "" && plan.SwapMax != "0" {
+		if err := validateMemoryMax(plan.SwapMax); err != nil {
+			return fmt.Errorf("plan %q: swapMax: %w", name, err)
+		}
+	}
+	if plan.SliceCpuMax != "" {
+		if err := validateCpuMax(plan.SliceCpuMax); err != nil {
+			return fmt.Errorf("plan %q: sliceCpuMax: %w", name, err)
+		}
+	}
+	if plan.SliceMemoryMax != "" {
+		if err := validateMemoryMax(plan.SliceMemoryMax); err != nil {
+			return fmt.Errorf("plan %q: sliceMemoryMax: %w", name, err)
+		}
+	}
+	for _, entry := range plan.IoMax {
+		if err := validateIoMax(entry); err != nil {
+			return fmt.Errorf("plan %q: ioMax: %w", name, err)
+		}
+	}
+	if plan.IoWeight != "" {
+		weight, err := strconv.Atoi(plan.IoWeight)
+		if err != nil || weight < ioWeightMin || weight > ioWeightMax {
+			return fmt.Errorf("plan %q: ioWeight must be a number between %d and %d", name, ioWeightMin, ioWeightMax)
+		}
+	}
+	if plan.PidsMax != "" && plan.PidsMax != "max" {
+		if pids, err := strconv.ParseUint(plan.PidsMax, 10, 32); err != nil || pids == 0 {
+			return fmt.Errorf("plan %q: pidsMax must be a positive number or \"max\"", name)
+		}
+	}
+	if plan.Nice != nil && (*plan.Nice < niceMin || *plan.Nice > niceMax) {
+		return fmt.Errorf("plan %q: nice must be between %d and %d", name, niceMin, niceMax)
+	}
+	if plan.OomScoreAdj != nil && (*plan.OomScoreAdj < oomScoreAdjMin || *plan.OomScoreAdj > oomScoreAdjMax) {
+		return fmt.Errorf("plan %q: oomScoreAdj must be between %d and %d", name, oomScoreAdjMin, oomScoreAdjMax)
+	}
+	return nil
+}
+
+// validateCpuMax checks the "$MAX $PERIOD" format of cpu.max, where $MAX is
+// either a quota in microseconds or "max". A lone "max" keeps the period. The
+// kernel refuses periods outside 1ms to 1s and quotas below 1ms; a quota of
+// more than maxQuotaCpus periods could never be used up.
+func validateCpuMax(value string) error {
+	fields := strings.Fields(value)
+	if len(fields) == 1 && fields[0] == "max" {
+		return nil
+	}
+	if len(fields) != 2 {
+		return fmt.Errorf("expected \"quota period\" or \"max\", got %q", value)
+	}
+	period, err := strconv.ParseUint(fields[1], 10, 64)
+	if err != nil || period < cpuPeriodMin || period > cpuPeriodMax {
+		return fmt.Errorf("invalid period %q, expected %d to %d microseconds", fields[1], cpuPeriodMin, cpuPeriodMax)
+	}
+	if fields[0] == "max" {
+		return nil
+	}
+	quota, err := strconv.ParseUint(fields[0], 10, 64)
+	if err != nil || quota < cpuQuotaMin {
+		return fmt.Errorf("invalid quota %q, expected at least %d microseconds", fields[0], cpuQuotaMin)
+	}
+	if quota > period*maxQuotaCpus {
+		return fmt.Errorf("quota %d is more than %d CPUs of period %d", quota, maxQuotaCpus, period)
+	}
+	return nil
+}
+
+// validateMemoryMax checks a memory.max value: "max" or a number of bytes,
+// optionally with a K, M, G or T suffix as accepted by the kernel.
+func validateMemoryMax(value string) error {
+	if value == "max" {
+		return nil
+	}
+	number := strings.TrimRight(value, "KMGTkmgt")
+	if len(value)-len(number) > 1 {
+		return fmt.Errorf("invalid size %q", value)
+	}
+	if size, err := strconv.ParseUint(number, 10, 64); err != nil || size == 0 {
+		return fmt.Errorf("invalid size %q", value)
+	}
+	if _, ok := memoryBytes(value); !ok {
+		return fmt.Errorf("size %q doesn't fit in 64 bits", value)
+	}
+	return nil
+}
+
+// ioMaxKeys are the limits io.max accepts for a device.
+var ioMaxKeys = []string{"rbps", "wbps", "riops", "wiops"}
+
+// validateIoMax checks an io.max entry, "MAJ:MIN key=value ...", where each
+// value is a number or "max". Instead of MAJ:MIN the device may be given by a
+// path, which resolveIoMax turns into its number.
+func validateIoMax(entry string) error {
+	fields := strings.Fields(entry)
+	if len(fields) < 2 {
+		return fmt.Errorf("expected \"MAJ:MIN key=value ...\", got %q", entry)
+	}
+	if !strings.HasPrefix(fields[0], "/") {
+		major, minor, ok := strings.Cut(fields[0], ":")
+		if !ok {
+			return fmt.Errorf("invalid device %q, expected MAJ:MIN or a path", fields[0])
+		}
+		for _, number := range []string{major, minor} {
+			if _, err := strconv.ParseUint(number, 10, 32); err != nil {
+				return fmt.Errorf("invalid device %q, expected MAJ:MIN or a path", fields[0])
+			}
+		}
+	}
+	for _, field := range fields[1:] {
+		key, value, _ := strings.Cut(field, "=")
+		if !slices.Contains(ioMaxKeys, key) {
+			return fmt.Errorf("unknown limit %q, expected one of %s", key, strings.Join(ioMaxKeys, ", "))
+		}
+		if _, err := strconv.ParseUint(value, 10, 64); err != nil && value != "max" {
+			return fmt.Errorf("invalid %s value %q", key, value)
+		}
+	}
+	return nil
+}
+
+// lineContext describes the line of data containing offset.
+func lineContext(data []byte, offset int64) string {
+	offset = min(max(offset, 0), int64(len(data)))
+	line := bytes.Count(data[:offset], []byte("\n")) + 1
+	start := bytes.LastIndexByte(data[:offset], '\n') + 1
+	end := bytes.IndexByte(data[offset:], '\n')
+	if end < 0 {
+		end = len(data) - int(offset)
+	}
+	return fmt.Sprintf("  line %d: %s", line, strings.TrimSpace(string(data[start:int(offset)+end])))
+}
+
+// keyOffset returns the offset of the first occurrence of the JSON key name.
+func keyOffset(data []byte, name string) int64 {
+	key, _ := json.Marshal(name)
+	return int64(max(bytes.Index(data, key), 0))
+}
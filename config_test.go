@@ -0,0 +1,237 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// useConfigFile writes content to a -config file for the test and returns
+// its path.
+func useConfigFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "pguard.json")
+	writeConfigFile(t, path, content)
+	saved := configFile
+	configFile = path
+	t.Cleanup(func() { configFile = saved })
+	return path
+}
+
+func writeConfigFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// webPlan is a config with the plan "web" limited to cpuMax.
+func webPlan(cpuMax string) string {
+	return fmt.Sprintf(`{"plans": {"web": {"cpuMax": %q}}}`, cpuMax)
+}
+
+func TestReloadChangesPlan(t *testing.T) {
+	tree := newTestTree(t)
+	path := useConfigFile(t, webPlan("20000 100000"))
+	if reply := request(t, "reload"); !strings.HasPrefix(reply, "reloaded ") {
+		t.Fatalf("reload: %s", reply)
+	}
+	if got := tree.read(t, filepath.Join(assign(t, "alice", "web"), "cpu.max")); got != "20000 100000" {
+		t.Errorf("cpu.max %q, want the reloaded plan's", got)
+	}
+
+	// Assignments running during reloads get one version of the plan or the
+	// other, never a mix or a failure.
+	var wg sync.WaitGroup
+	for i := range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if i%4 == 0 {
+				writeConfigFile(t, path, webPlan(fmt.Sprintf("%d 100000", 20000+i)))
+				request(t, "reload")
+				return
+			}
+			reply := request(t, selfPid+"|bob|web")
+			if !strings.HasPrefix(reply, "OK ") {
+				t.Errorf("assignment during a reload: %s", reply)
+			}
+		}()
+	}
+	wg.Wait()
+
+	writeConfigFile(t, path, webPlan("30000 100000"))
+	if reply := request(t, "reload"); !strings.HasPrefix(reply, "reloaded ") {
+		t.Fatalf("reload: %s", reply)
+	}
+	if got := tree.read(t, filepath.Join(assign(t, "carol", "web"), "cpu.max")); got != "30000 100000" {
+		t.Errorf("cpu.max %q after the second reload, want the changed plan's", got)
+	}
+
+	writeConfigFile(t, path, `{"plans": {`)
+	if reply := request(t, "reload"); !strings.HasPrefix(reply, "ERR rejected ") {
+		t.Errorf("reload of a broken file: %s", reply)
+	}
+	if got := tree.read(t, filepath.Join(assign(t, "dave", "web"), "cpu.max")); got != "30000 100000" {
+		t.Errorf("cpu.max %q after a failed reload, want the plan in effect kept", got)
+	}
+}
+
+func TestReloadReappliesSystemReserve(t *testing.T) {
+	tree := newTestTree(t)
+	*systemReserve = 0.5
+	reserveApplied.Store(true)
+	t.Cleanup(func() { reserveApplied.Store(false) })
+	useConfigFile(t, webPlan("20000 100000"))
+	cpuMax := usersPath + "cpu.max"
+	if err := cgroupFiles.WriteFile(cpuMax, "max 100000"); err != nil {
+		t.Fatal(err)
+	}
+
+	if reply := request(t, "reload"); !strings.HasPrefix(reply, "reloaded ") {
+		t.Fatalf("reload: %s", reply)
+	}
+	quota := int64((float64(runtime.NumCPU()) - *systemReserve) * cpuPeriod)
+	if got, want := tree.read(t, cpuMax), fmt.Sprintf("%d %d", quota, cpuPeriod); got != want {
+		t.Errorf("cpu.max of the tenant tree %q after a reload, want the reserve's %q", got, want)
+	}
+}
+
+func TestExtendsOverridesWithZeroValues(t *testing.T) {
+	config, err := parseConfig("test", []byte(`{"plans": {
+		"batch": {"cpuMax": "20000 100000", "cpuIdle": true, "procsFirst": true, "memoryMax": "1G"},
+		"batch-low": {"extends": "batch", "cpuIdle": false, "cpuWeight": "20", "ProcsFirst": false, "memoryMax": ""},
+		"batch-lower": {"extends": "batch-low", "pidsMax": "64"}
+	}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]PlanConfig{
+		"batch-low":   {CpuMax: "20000 100000", CpuWeight: "20"},
+		"batch-lower": {CpuMax: "20000 100000", CpuWeight: "20", PidsMax: "64"},
+	} {
+		got := config.Plans[name]
+		if got.CpuMax != want.CpuMax || got.CpuWeight != want.CpuWeight || got.PidsMax != want.PidsMax ||
+			got.CpuIdle || got.ProcsFirst || got.MemoryMax != "" {
+			t.Errorf("plan %s: got %+v, want %+v", name, got, want)
+		}
+	}
+}
+
+func TestExpandConfig(t *testing.T) {
+	t.Setenv("PGUARD_MEMORY", "1G")
+	t.Setenv("PGUARD_QUOTED", `2G", "cpuIdle": true, "x": "\`)
+	for _, test := range []struct {
+		in, want, err string
+	}{
+		{in: `"${PGUARD_MEMORY}"`, want: `"1G"`},
+		{in: `"$PGUARD_MEMORY"`, want: `"1G"`},
+		{in: `"$$PGUARD_MEMORY"`, want: `"$PGUARD_MEMORY"`},
+		{in: `"$PGUARD_QUOTED"`, want: `"2G\", \"cpuIdle\": true, \"x\": \"\\"`},
+		{in: `"$PGUARD_UNSET_A $PGUARD_UNSET_B $PGUARD_UNSET_A"`, err: "environment variables not set: PGUARD_UNSET_A, PGUARD_UNSET_B"},
+	} {
+		got, err := expandConfig([]byte(test.in))
+		switch {
+		case test.err != "":
+			if err == nil || err.Error() != test.err {
+				t.Errorf("expandConfig(%s): error %v, want %q", test.in, err, test.err)
+			}
+		case err != nil:
+			t.Errorf("expandConfig(%s): %v", test.in, err)
+		case string(got) != test.want:
+			t.Errorf("expandConfig(%s) = %s, want %s", test.in, got, test.want)
+		}
+	}
+}
+
+func TestParseConfigExpandsAndStripsComments(t *testing.T) {
+	t.Setenv("PGUARD_MEMORY", `1G"`)
+	_, err := parseConfig("test", []byte(`{"plans": {
+		// sized per host
+		# "ignored": {"cpuMax": "$PGUARD_UNSET"},
+		"batch": {"cpuMax": "50000 100000", "memoryMax": "${PGUARD_MEMORY}"}
+	}}`))
+	if err == nil || !strings.Contains(err.Error(), `memoryMax`) {
+		t.Errorf("a memoryMax with a quote from the environment: error %v, want it rejected as a memoryMax", err)
+	}
+
+	t.Setenv("PGUARD_MEMORY", "1G")
+	config, err := parseConfig("test", []byte(`{"plans": {
+		// sized per host
+		"batch": {"cpuMax": "50000 100000", "memoryMax": "${PGUARD_MEMORY}"}
+	}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := config.Plans["batch"].MemoryMax; got != "1G" {
+		t.Errorf("memoryMax %q, want the environment's 1G", got)
+	}
+}
+
+func TestCustomCpuPeriod(t *testing.T) {
+	tree := newTestTree(t)
+	config, err := parseConfig("test", []byte(`{"plans": {"latency": {"cpuMax": "10000", "cpuPeriod": "20000"}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := config.Plans["latency"].CpuMax; got != "10000 20000" {
+		t.Errorf("cpuMax %q, want the quota completed with the period", got)
+	}
+	usePlans(t, config.Plans)
+	if got := tree.read(t, filepath.Join(assign(t, "alice", "latency"), "cpu.max")); got != "10000 20000" {
+		t.Errorf("cpu.max = %q, want \"10000 20000\"", got)
+	}
+}
+
+func TestApplyCpuPeriod(t *testing.T) {
+	for _, test := range []struct {
+		plan          PlanConfig
+		cpuMax, slice string
+		ok            bool
+	}{
+		{plan: PlanConfig{CpuMax: "50000 100000"}, cpuMax: "50000 100000", ok: true},
+		{plan: PlanConfig{CpuMax: "5000", CpuPeriod: "10000"}, cpuMax: "5000 10000", ok: true},
+		{plan: PlanConfig{CpuMax: "max", SliceCpuMax: "20000", CpuPeriod: "10000"}, cpuMax: "max 10000", slice: "20000 10000", ok: true},
+		{plan: PlanConfig{CpuMax: "5000 10000", CpuPeriod: "10000"}, cpuMax: "5000 10000", ok: true},
+		{plan: PlanConfig{CpuMax: "5000 20000", CpuPeriod: "10000"}},
+		{plan: PlanConfig{CpuMax: "5000", CpuPeriod: "999"}},
+		{plan: PlanConfig{CpuMax: "5000", CpuPeriod: "ten"}},
+		{plan: PlanConfig{CpuPeriod: "10000"}},
+	} {
+		plan := test.plan
+		err := plan.applyCpuPeriod()
+		switch {
+		case test.ok && err != nil:
+			t.Errorf("%+v: %v", test.plan, err)
+		case !test.ok && err == nil:
+			t.Errorf("%+v: accepted, want an error", test.plan)
+		case test.ok && (plan.CpuMax != test.cpuMax || plan.SliceCpuMax != test.slice):
+			t.Errorf("%+v: cpuMax %q sliceCpuMax %q, want %q and %q", test.plan, plan.CpuMax, plan.SliceCpuMax, test.cpuMax, test.slice)
+		}
+	}
+}
+
+func TestValidateCpuMax(t *testing.T) {
+	for value, ok := range map[string]bool{
+		"max":            true,
+		"max 20000":      true,
+		"10000 20000":    true,
+		"1000 1000":      true,
+		"20480000 20000": true,
+		"20480001 20000": false,
+		"999 20000":      false,
+		"10000 999":      false,
+		"10000 1000001":  false,
+		"10000":          false,
+		"10000 20000 1":  false,
+		"half 20000":     false,
+	} {
+		if err := validateCpuMax(value); (err == nil) != ok {
+			t.Errorf("validateCpuMax(%q) = %v, want ok %v", value, err, ok)
+		}
+	}
+}
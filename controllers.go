@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync/atomic"
+)
+
+// planControllers are the controllers plan limits are written to, the ones
+// -controllers may name.
+var planControllers = []string{"cpu", "io", "memory", "pids"}
+
+// enabledControllers are the controllers of -controllers. Only these are
+// enabled and have their limits written; nil allows all of them.
+var enabledControllers []string
+
+// parseControllers parses the comma separated -controllers list.
+func parseControllers(list string) ([]string, error) {
+	var controllers []string
+	for _, controller := range strings.Split(list, ",") {
+		controller = strings.TrimSpace(controller)
+		if !slices.Contains(planControllers, controller) {
+			return nil, fmt.Errorf("unknown controller %q, expected %s", controller, strings.Join(planControllers, ", "))
+		}
+		controllers = append(controllers, controller)
+	}
+	slices.Sort(controllers)
+	return slices.Compact(controllers), nil
+}
+
+// controllerEnabled reports whether -controllers allows controller. The
+// threaded cpuset and perf_event aren't written by plans and stay allowed.
+func controllerEnabled(controller string) bool {
+	return enabledControllers == nil || !slices.Contains(planControllers, controller) ||
+		slices.Contains(enabledControllers, controller)
+}
+
+// availableControllers holds the controllers delegatedRoot offers, read from
+// its cgroup.controllers whenever the controllers are enabled. It is nil with
+// cgroup v1 or when the file can't be read, and every controller is taken to
+// be available then.
+var availableControllers atomic.Pointer[map[string]bool]
+
+// readAvailableControllers reads the controllers the kernel offers below
+// delegatedRoot. A kernel built without one, e.g. io without the block
+// controller, doesn't list it.
+func readAvailableControllers() {
+	content, err := cgroupFiles.ReadFile(filepath.Join(delegatedRoot, "cgroup.controllers"))
+	if err != nil {
+		slog.Warn("Can't read the available controllers, assuming all are", "path", delegatedRoot, "err", err)
+		availableControllers.Store(nil)
+		return
+	}
+	available := make(map[string]bool)
+	for _, controller := range strings.Fields(string(content)) {
+		available[controller] = true
+	}
+	availableControllers.Store(&available)
+}
+
+// controllerAvailable reports whether controller is enabled by -controllers
+// and offered by the kernel.
+func controllerAvailable(controller string) bool {
+	if !controllerEnabled(controller) {
+		return false
+	}
+	available := availableControllers.Load()
+	return available == nil || (*available)[controller]
+}
+
+// usableControllers returns the controllers the plans need that are
+// available. Only these are written to cgroup.subtree_control: a single
+// missing one makes the kernel refuse the whole write.
+func usableControllers() []string {
+	var usable []string
+	for _, controller := range neededControllers() {
+		if controllerAvailable(controller) {
+			usable = append(usable, controller)
+		}
+	}
+	return usable
+}
+
+// withoutUnavailable clears the limits of config whose controller isn't
+// available or is left out of -controllers, so that their files, which the
+// subgroup subDir doesn't have, aren't written.
+func withoutUnavailable(subDir string, config PlanConfig) PlanConfig {
+	for _, controller := range config.controllers() {
+		if controllerAvailable(controller) {
+			continue
+		}
+		slog.Debug("Controller not available, skipping its limits", "path", subDir, "controller", controller)
+		switch controller {
+		case "cpu":
+			config.CpuMax, config.CpuBurst, config.CpuIdle, config.CpuWeight = "", "", false, ""
+		case "memory":
+			config.MemoryMax, config.MemoryHigh, config.SwapMax, config.OomGroup = "", "", "", nil
+		case "io":
+			config.IoMax, config.IoWeight = nil, ""
+		case "pids":
+			config.PidsMax = ""
+		}
+	}
+	return config
+}
+
+// warnUnavailable logs the controllers the plans need, or the ones of
+// -controllers, that the kernel doesn't offer; the limits using them are not
+// applied.
+func warnUnavailable() {
+	controllers := enabledControllers
+	if controllers == nil {
+		controllers = neededControllers()
+	}
+	for _, controller := range controllers {
+		if !controllerAvailable(controller) {
+			slog.Warn("Controller not available, limits using it are skipped", "controller", controller, "path", delegatedRoot)
+		}
+	}
+}
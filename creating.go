@@ -0,0 +1,44 @@
+package main
+
+import (
+	"path/filepath"
+	"sync"
+)
+
+// creating counts the createCgroup calls using a path, the user slice and the
+// subgroup being set up. Both are empty until the process is moved in, so the
+// cleanup sweep and the inotify handler must leave them alone; they check and
+// remove a path with creatingMu held, so no createCgroup can start using it in
+// between.
+var (
+	creatingMu sync.Mutex
+	creating   = make(map[string]int)
+)
+
+// beginCreating marks path as in use by a createCgroup call.
+func beginCreating(path string) {
+	creatingMu.Lock()
+	creating[filepath.Clean(path)]++
+	creatingMu.Unlock()
+}
+
+// endCreating undoes beginCreating.
+func endCreating(path string) {
+	creatingMu.Lock()
+	endCreatingLocked(path)
+	creatingMu.Unlock()
+}
+
+// endCreatingLocked is endCreating with creatingMu held.
+func endCreatingLocked(path string) {
+	path = filepath.Clean(path)
+	if creating[path]--; creating[path] <= 0 {
+		delete(creating, path)
+	}
+}
+
+// isCreating reports whether a createCgroup call uses path. creatingMu must be
+// held.
+func isCreating(path string) bool {
+	return creating[filepath.Clean(path)] > 0
+}
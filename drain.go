@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+	"sync"
+
+	"github.com/malumar/pguard/client"
+)
+
+// errUserDrained is returned by createCgroup for a user drained with the
+// drain command.
+var errUserDrained = errors.New("user is drained")
+
+// drainedUsers are the users no new subgroups are created for. The set lives
+// in memory only: sweeps leave it alone, a restart empties it.
+var drainedUsers struct {
+	mu    sync.Mutex
+	users map[string]bool
+}
+
+// drainCommand quiesces a user for maintenance: after "drain|user" assignments
+// that would create a subgroup for the user are answered "ERR unavailable
+// draining". The user's running subgroups are left alone and cleaned up as
+// usual. The reply is "drained <user>".
+func drainCommand(conn net.Conn, args []string) {
+	if len(args) != 1 || !validUsername(args[0]) {
+		reply(conn, "ERR %s expected drain|user", client.CodeBadRequest)
+		return
+	}
+	drainedUsers.mu.Lock()
+	if drainedUsers.users == nil {
+		drainedUsers.users = make(map[string]bool)
+	}
+	drainedUsers.users[args[0]] = true
+	drainedUsers.mu.Unlock()
+	slog.Warn("User drained, new subgroups are refused", "user", args[0])
+	reply(conn, "drained %s", args[0])
+}
+
+// undrainCommand ends "drain|user" with "undrain|user". The reply is
+// "undrained <user>", or an error if the user wasn't drained.
+func undrainCommand(conn net.Conn, args []string) {
+	if len(args) != 1 || !validUsername(args[0]) {
+		reply(conn, "ERR %s expected undrain|user", client.CodeBadRequest)
+		return
+	}
+	drainedUsers.mu.Lock()
+	drained := drainedUsers.users[args[0]]
+	delete(drainedUsers.users, args[0])
+	drainedUsers.mu.Unlock()
+	if !drained {
+		reply(conn, "ERR %s %s is not drained", client.CodeRejected, args[0])
+		return
+	}
+	slog.Info("User undrained", "user", args[0])
+	reply(conn, "undrained %s", args[0])
+}
+
+func userDrained(user string) bool {
+	drainedUsers.mu.Lock()
+	defer drainedUsers.mu.Unlock()
+	return drainedUsers.users[user]
+}
@@ -0,0 +1,18 @@
+package main
+
+import "log/slog"
+
+// dryRun turns the operations that change the cgroup tree into log lines.
+// Reads still go to the real files, so the logged operations are the ones
+// pguard would perform on this host.
+var dryRun bool
+
+// skipInDryRun logs the operation on path that would have happened and reports
+// whether the caller must skip it.
+func skipInDryRun(op, path string, args ...any) bool {
+	if !dryRun {
+		return false
+	}
+	slog.Info("Dry run: would "+op, append([]any{"path", path}, args...)...)
+	return true
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net"
+	"net/url"
+
+	"github.com/malumar/pguard/client"
+)
+
+// effectiveConfig is the configuration pguard runs with, as logged at startup
+// and answered by the config command. Values that could carry credentials,
+// like URLs, go through redactURL.
+type effectiveConfig struct {
+	Version             string                   `json:"version"`
+	Layout              string                   `json:"layout"`
+	CgroupMount         string                   `json:"cgroupMount"`
+	DelegatedRoot       string                   `json:"delegatedRoot"`
+	Controllers         []string                 `json:"controllers"`
+	UsersPath           string                   `json:"usersPath"`
+	Socket              string                   `json:"socket"`
+	Listen              string                   `json:"listen,omitempty"`
+	CleanupInterval     string                   `json:"cleanupInterval"`
+	DryRun              bool                     `json:"dryRun"`
+	SliceMemoryMax      string                   `json:"sliceMemoryMax"`
+	SystemReserve       float64                  `json:"systemReserve"`
+	MaxSubgroupsPerUser int                      `json:"maxSubgroupsPerUser"`
+	WriteRetries        int                      `json:"writeRetries"`
+	WriteRetryDelay     string                   `json:"writeRetryDelay"`
+	WriteTimeout        string                   `json:"writeTimeout"`
+	FailureAction       string                   `json:"failureAction"`
+	FailureWebhook      string                   `json:"failureWebhook,omitempty"`
+	PlansURL            string                   `json:"plansURL,omitempty"`
+	Plans               map[string]effectivePlan `json:"plans"`
+}
+
+// effectivePlan is a plan with its defaults filled in.
+type effectivePlan struct {
+	// Limits are the values written to every subgroup of the plan, as in
+	// the response of an assignment.
+	Limits map[string]string `json:"limits"`
+	// Slice are the values written to the user slice.
+	Slice      map[string]string `json:"slice"`
+	ProcsFirst bool              `json:"procsFirst,omitempty"`
+}
+
+// currentConfig collects the effective configuration.
+func currentConfig() effectiveConfig {
+	config := effectiveConfig{
+		Version:             versionString(),
+		Layout:              "cgroup2",
+		CgroupMount:         cgroupMount,
+		DelegatedRoot:       delegatedRoot,
+		Controllers:         neededControllers(),
+		UsersPath:           usersPath,
+		Socket:              getSocketAddress(),
+		Listen:              remoteOpts.addr,
+		CleanupInterval:     cleanupInterval().String(),
+		DryRun:              dryRun,
+		SliceMemoryMax:      memoryMax,
+		SystemReserve:       *systemReserve,
+		MaxSubgroupsPerUser: maxSubgroupsPerUser,
+		WriteRetries:        writeRetries,
+		WriteRetryDelay:     writeRetryDelay.String(),
+		WriteTimeout:        writeTimeout.String(),
+		FailureAction:       failureAction,
+		FailureWebhook:      redactURL(failureWebhook),
+		PlansURL:            redactURL(plansURL),
+		Plans:               make(map[string]effectivePlan),
+	}
+	if _, ok := layout.(cgroupV1); ok {
+		config.Layout = "cgroup1"
+	}
+	for name, plan := range currentPlans() {
+		slice := map[string]string{"cpu.max": plan.sliceCpuMax(), "memory.max": plan.sliceMemoryMax()}
+		if plan.IoWeight != "" {
+			slice["io.weight"] = plan.IoWeight
+		}
+		config.Plans[name] = effectivePlan{
+			Limits:     subgroupLimits(plan),
+			Slice:      slice,
+			ProcsFirst: plan.ProcsFirst,
+		}
+	}
+	return config
+}
+
+// redactURL hides the password and the query of a URL, where tokens usually
+// are.
+func redactURL(raw string) string {
+	if raw == "" {
+		return ""
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "REDACTED"
+	}
+	if u.RawQuery != "" {
+		u.RawQuery = "REDACTED"
+	}
+	return u.Redacted()
+}
+
+// logConfig logs the effective configuration at startup.
+func logConfig() {
+	line, err := json.Marshal(currentConfig())
+	if err != nil {
+		slog.Error("Failed to encode configuration", "err", err)
+		return
+	}
+	slog.Info("Effective configuration", "config", string(line))
+}
+
+// configCommand answers the effective configuration as a JSON line, so it is
+// obvious which limits a plan really has, e.g. after it fell back to a
+// default.
+func configCommand(conn net.Conn, _ []string) {
+	line, err := json.Marshal(currentConfig())
+	if err != nil {
+		slog.Error("Failed to encode configuration", "err", err)
+		reply(conn, "ERR %s %v", client.CodeInternal, err)
+		return
+	}
+	reply(conn, "%s", line)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/malumar/pguard/client"
+	"golang.org/x/sys/unix"
+)
+
+const defaultEvacuateGrace = 30 * time.Second
+
+// draining is set by evacuate; from then on assignment requests are refused
+// until pguard is restarted.
+var draining atomic.Bool
+
+// evacuateCommand guides the decommissioning of a host. It enters drain mode,
+// streams every managed subgroup as a snapshot JSON line, so an orchestrator
+// can place the processes elsewhere, and with "evacuate|kill[|grace]" sends
+// SIGTERM to the processes still running after the grace period (default
+// 30s). Progress is reported one line at a time, the last line is "done".
+func evacuateCommand(conn net.Conn, args []string) {
+	kill := len(args) > 0 && args[0] == "kill"
+	if len(args) > 0 && !kill || len(args) > 2 {
+		reply(conn, "ERR %s expected evacuate or evacuate|kill[|grace]", client.CodeBadRequest)
+		return
+	}
+	grace := defaultEvacuateGrace
+	if len(args) == 2 {
+		var err error
+		if grace, err = time.ParseDuration(args[1]); err != nil || grace < 0 {
+			reply(conn, "ERR %s invalid grace period %q", client.CodeBadRequest, args[1])
+			return
+		}
+	}
+
+	draining.Store(true)
+	slog.Warn("Evacuating, new assignments are refused", "kill", kill, "grace", grace)
+	reply(conn, "draining")
+
+	entries := takeSnapshot()
+	pids := 0
+	for _, entry := range entries {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			slog.Error("Failed to encode snapshot entry", "path", entry.Path, "err", err)
+			continue
+		}
+		reply(conn, "%s", line)
+		pids += len(entry.Pids)
+	}
+	reply(conn, "subgroups=%d pids=%d", len(entries), pids)
+
+	if kill {
+		reply(conn, "terminating in %s", grace)
+		time.Sleep(grace)
+		terminated := 0
+		walkSubgroups(func(user, dir string) {
+			for _, pid := range readPids(dir) {
+				if terminateProcess(pid) {
+					terminated++
+				}
+			}
+		})
+		slog.Warn("Evacuation terminated remaining processes", "terminated", terminated)
+		reply(conn, "terminated=%d", terminated)
+	}
+	reply(conn, "done")
+}
+
+// terminateProcess sends SIGTERM to pid and reports whether it was delivered.
+// A process that exited in the meantime is not an error.
+func terminateProcess(pid string) bool {
+	id, err := strconv.Atoi(pid)
+	if err != nil || id <= 0 {
+		return false
+	}
+	if err := unix.Kill(id, unix.SIGTERM); err != nil {
+		if !errors.Is(err, unix.ESRCH) {
+			slog.Error("Failed to terminate process", "pid", pid, "err", err)
+		}
+		return false
+	}
+	return true
+}
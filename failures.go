@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Reasons a cgroup assignment can fail with.
+const (
+	reasonUnknownPlan     = "unknown-plan"
+	reasonPidGone         = "pid-gone"
+	reasonNotDelegated    = "controller-not-delegated"
+	reasonRejectedByLimit = "rejected-by-limit"
+	reasonExhausted       = "resource-exhausted"
+	reasonInternal        = "internal"
+)
+
+// maxFailureEvents bounds the memory used by a failure storm.
+const maxFailureEvents = 10000
+
+// failures counts failed assignments per reason over a rolling window.
+var failures = &failureLog{window: time.Hour}
+
+type failureEvent struct {
+	at     time.Time
+	reason string
+}
+
+type failureLog struct {
+	mu     sync.Mutex
+	window time.Duration
+	events []failureEvent
+}
+
+// failureReason maps an error returned by createCgroup to its reason.
+func failureReason(err error) string {
+	switch {
+	case errors.Is(err, errUnknownPlan):
+		return reasonUnknownPlan
+	case errors.Is(err, unix.ESRCH):
+		return reasonPidGone
+	case errors.Is(err, unix.ENOENT), errors.Is(err, unix.EOPNOTSUPP):
+		// The control file is missing because the controller isn't enabled
+		// in the parent's cgroup.subtree_control.
+		return reasonNotDelegated
+	case errors.Is(err, errCgroupExhausted):
+		return reasonExhausted
+	case errors.Is(err, errTooManySubgroups):
+		return reasonRejectedByLimit
+	case errors.Is(err, unix.ENOSPC), errors.Is(err, unix.EAGAIN):
+		return reasonRejectedByLimit
+	case errors.Is(err, errValueRejected):
+		return reasonRejectedByLimit
+	}
+	return reasonInternal
+}
+
+func (f *failureLog) record(reason string) {
+	metrics.Add("create_failures", 1, "reason", reason)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.prune(time.Now())
+	if len(f.events) >= maxFailureEvents {
+		f.events = f.events[1:]
+	}
+	f.events = append(f.events, failureEvent{at: time.Now(), reason: reason})
+}
+
+// counts returns the number of failures per reason within the window.
+func (f *failureLog) counts() map[string]int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.prune(time.Now())
+	counts := make(map[string]int)
+	for _, event := range f.events {
+		counts[event.reason]++
+	}
+	return counts
+}
+
+func (f *failureLog) prune(now time.Time) {
+	i := 0
+	for i < len(f.events) && now.Sub(f.events[i].at) > f.window {
+		i++
+	}
+	f.events = f.events[i:]
+}
+
+// Actions taken on a user whose requests keep failing.
+const (
+	actionWarn       = "warn"
+	actionWebhook    = "webhook"
+	actionQuarantine = "quarantine"
+)
+
+var (
+	failureThreshold int
+	failureAction    string
+	failureWebhook   string
+	quarantineFor    time.Duration
+
+	userFailuresMu sync.Mutex
+	// userFailures counts the consecutive failed requests per user.
+	userFailures = make(map[string]int)
+	// quarantine holds the users whose requests are rejected until the time.
+	quarantine = make(map[string]time.Time)
+
+	webhookClient = &http.Client{Timeout: 5 * time.Second}
+)
+
+// userFailed counts a failed request of user and takes the -failureAction
+// once -failureThreshold consecutive requests failed. The count starts over
+// after the action.
+func userFailed(user string, err error) {
+	if failureThreshold <= 0 {
+		return
+	}
+	userFailuresMu.Lock()
+	userFailures[user]++
+	count := userFailures[user]
+	if count < failureThreshold {
+		userFailuresMu.Unlock()
+		return
+	}
+	delete(userFailures, user)
+	if failureAction == actionQuarantine {
+		quarantine[user] = time.Now().Add(quarantineFor)
+	}
+	userFailuresMu.Unlock()
+
+	slog.Warn("Requests of user keep failing", "user", user, "failures", count, "action", failureAction, "err", err)
+	metrics.Add("failure_actions", 1, "action", failureAction)
+	if failureAction == actionWebhook {
+		go postFailureWebhook(user, count, err)
+	}
+}
+
+// userSucceeded resets the consecutive failure count of user.
+func userSucceeded(user string) {
+	if failureThreshold <= 0 {
+		return
+	}
+	userFailuresMu.Lock()
+	delete(userFailures, user)
+	userFailuresMu.Unlock()
+}
+
+// quarantinedUntil reports whether requests of user are rejected and until
+// when.
+func quarantinedUntil(user string) (time.Time, bool) {
+	userFailuresMu.Lock()
+	defer userFailuresMu.Unlock()
+	until, ok := quarantine[user]
+	if ok && time.Now().After(until) {
+		delete(quarantine, user)
+		return time.Time{}, false
+	}
+	return until, ok
+}
+
+func postFailureWebhook(user string, count int, err error) {
+	body, _ := json.Marshal(map[string]any{
+		"user":     user,
+		"failures": count,
+		"error":    err.Error(),
+		"reason":   failureReason(err),
+	})
+	resp, postErr := webhookClient.Post(failureWebhook, "application/json", bytes.NewReader(body))
+	if postErr != nil {
+		slog.Error("Failed to call failure webhook", "url", failureWebhook, "err", postErr)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		slog.Error("Failure webhook rejected the report", "url", failureWebhook, "status", resp.Status)
+	}
+}
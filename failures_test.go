@@ -0,0 +1,45 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// quarantineAfter sets -failureThreshold to n with the quarantine action for
+// the test.
+func quarantineAfter(t *testing.T, n int) {
+	saved := struct {
+		threshold int
+		action    string
+		duration  time.Duration
+	}{failureThreshold, failureAction, quarantineFor}
+	failureThreshold, failureAction, quarantineFor = n, actionQuarantine, time.Minute
+	t.Cleanup(func() {
+		failureThreshold, failureAction, quarantineFor = saved.threshold, saved.action, saved.duration
+		userFailuresMu.Lock()
+		clear(userFailures)
+		clear(quarantine)
+		userFailuresMu.Unlock()
+	})
+}
+
+func TestDeadPidsQuarantineUser(t *testing.T) {
+	newTestTree(t)
+	quarantineAfter(t, 3)
+	useFakeProc(t, map[string]string{"88": processStat})
+	for range 3 {
+		if reply := request(t, "4242|alice|standard"); !strings.HasPrefix(reply, "ERR no-such-pid ") {
+			t.Fatalf("assigning an exited pid: %s", reply)
+		}
+	}
+	if reply := request(t, "88|alice|standard"); !strings.HasPrefix(reply, "ERR quarantined ") {
+		t.Errorf("after 3 exited pids: %s, want alice quarantined", reply)
+	}
+	placedPath(t, request(t, "88|bob|standard"))
+
+	// A pid rejected with an invalid user name counts for no one.
+	if reply := request(t, "4242|../alice|standard"); !strings.HasPrefix(reply, "ERR bad-request ") {
+		t.Errorf("invalid user with an exited pid: %s, want the user refused first", reply)
+	}
+}
@@ -2,7 +2,6 @@ module github.com/malumar/pguard
 
 go 1.22
 
-require (
-	github.com/glottis/inotify v0.0.0-20210411212035-96099cf7ee5c // indirect
-	golang.org/x/sys v0.0.0-20210403161142-5e06dd20ab57 // indirect
-)
+require github.com/glottis/inotify v0.0.0-20210411212035-96099cf7ee5c
+
+require golang.org/x/sys v0.0.0-20210403161142-5e06dd20ab57
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// sysDevBlock links every block device number to its directory in sysfs.
+const sysDevBlock = "/sys/dev/block"
+
+// resolveIoMax replaces the device of an io.max entry given by path with its
+// MAJ:MIN. The path is either a block device, e.g. /dev/nvme0n1, or any path
+// on a filesystem, e.g. the mount point /srv, meaning the device the
+// filesystem is on. io.max only takes whole disks, so a partition is replaced
+// by its disk. Entries already starting with MAJ:MIN are returned unchanged.
+func resolveIoMax(entry string) (string, error) {
+	fields := strings.Fields(entry)
+	if len(fields) == 0 || !strings.HasPrefix(fields[0], "/") {
+		return entry, nil
+	}
+	device := fields[0]
+
+	var st unix.Stat_t
+	if err := unix.Stat(device, &st); err != nil {
+		return "", &os.PathError{Op: "stat", Path: device, Err: err}
+	}
+	dev := st.Dev
+	if st.Mode&unix.S_IFMT == unix.S_IFBLK {
+		dev = st.Rdev
+	}
+	number := fmt.Sprintf("%d:%d", unix.Major(dev), unix.Minor(dev))
+	disk, err := wholeDisk(number)
+	if err != nil {
+		return "", fmt.Errorf("%s (%s): %w", device, number, err)
+	}
+	return strings.Join(append([]string{disk}, fields[1:]...), " "), nil
+}
+
+// wholeDisk returns the MAJ:MIN of the disk a partition is on, or number
+// itself if it is a whole disk.
+func wholeDisk(number string) (string, error) {
+	dir, err := filepath.EvalSymlinks(filepath.Join(sysDevBlock, number))
+	if err != nil {
+		return "", fmt.Errorf("not a block device: %w", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "partition")); errors.Is(err, fs.ErrNotExist) {
+		return number, nil
+	}
+	parent, err := os.ReadFile(filepath.Join(filepath.Dir(dir), "dev"))
+	if err != nil {
+		return "", fmt.Errorf("can't find the disk of partition: %w", err)
+	}
+	return strings.TrimSpace(string(parent)), nil
+}
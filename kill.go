@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/malumar/pguard/client"
+	"golang.org/x/sys/unix"
+)
+
+// killWait is how long killCommand waits for the killed processes to leave
+// their subgroups; SIGKILL is delivered asynchronously.
+const killWait = 5 * time.Second
+
+// killCommand terminates everything a user runs, e.g. when offboarding them:
+// "kill|user" writes 1 to the slice's cgroup.kill, which SIGKILLs every
+// process below it, and then removes the emptied subgroups and the slice. On
+// kernels before 5.14, and with cgroup v1, there is no cgroup.kill and the
+// processes are sent SIGKILL one by one instead. It is authorized like an
+// assignment to the user. The reply is "killed subgroups=N", the number of
+// subgroups removed.
+func killCommand(conn net.Conn, args []string) {
+	if len(args) != 1 || !validUsername(args[0]) {
+		reply(conn, "ERR %s expected kill|user", client.CodeBadRequest)
+		return
+	}
+	username := args[0]
+	if cred, err := peerCredentials(conn); err == nil || len(assignGids) > 0 {
+		if err := authorizeCreate(cred, username); err != nil {
+			slog.Error("Kill not authorized", "user", username, "err", err)
+			reply(conn, "ERR %s unauthorized: %v", client.CodeUnauthorized, err)
+			return
+		}
+	}
+	slice := filepath.Join(usersPath, username+".slice")
+	entries, err := os.ReadDir(slice)
+	if err != nil {
+		reply(conn, "ERR %s unknown user %s", client.CodeBadRequest, username)
+		return
+	}
+	var subDirs []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			subDirs = append(subDirs, filepath.Join(slice, entry.Name()))
+		}
+	}
+
+	if err := killCgroup(slice, subDirs); err != nil {
+		slog.Error("Failed to kill user slice", "path", slice, "err", err)
+		reply(conn, "ERR %s %v", errorCode(err), err)
+		return
+	}
+	waitUnpopulated(subDirs, killWait)
+
+	removed := 0
+	for _, subDir := range subDirs {
+		if cleanupSubgroup(subDir, activeWatcher) {
+			removed++
+		}
+	}
+	if removed == len(subDirs) {
+		removeSlice(slice)
+	}
+	slog.Warn("User slice killed", "user", username, "subgroups", len(subDirs), "removed", removed)
+	reply(conn, "killed subgroups=%d", removed)
+}
+
+// killCgroup SIGKILLs the processes below path, which are those of subDirs,
+// through cgroup.kill if the kernel has it.
+func killCgroup(path string, subDirs []string) error {
+	dir, err := openCgroupDir(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	if dir.exists("cgroup.kill") {
+		return dir.write("cgroup.kill", "1")
+	}
+	slog.Debug("No cgroup.kill, killing processes one by one", "path", path)
+	for _, subDir := range subDirs {
+		for _, pid := range readPids(subDir) {
+			if skipInDryRun("kill", subDir, "pid", pid) {
+				continue
+			}
+			if id, err := strconv.Atoi(pid); err == nil && id > 0 {
+				if err := unix.Kill(id, unix.SIGKILL); err != nil && !errors.Is(err, unix.ESRCH) {
+					slog.Error("Failed to kill process", "pid", pid, "err", err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// waitUnpopulated waits until no processes are left in subDirs, at most for
+// timeout.
+func waitUnpopulated(subDirs []string, timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for _, subDir := range subDirs {
+		for layout.populated(subDir) && time.Now().Before(deadline) {
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+}
+
+// removeSlice removes the emptied user slice unless an assignment is setting
+// it up again meanwhile.
+func removeSlice(slice string) {
+	creatingMu.Lock()
+	defer creatingMu.Unlock()
+	if isCreating(slice) || skipInDryRun("remove", slice) {
+		return
+	}
+	if err := layout.remove(slice); err != nil {
+		slog.Error("Failed to remove user slice", "path", slice, "err", err)
+		return
+	}
+	forgetSlice(slice)
+	forgetSubgroupCount(slice)
+}
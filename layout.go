@@ -0,0 +1,227 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// cgroupLayout is what differs between the cgroup versions. The rest of
+// pguard works with the directories below usersPath, which is in the unified
+// hierarchy with cgroup v2 and in the memory hierarchy with v1; a layout
+// translates the limits into the files of its version and keeps whatever
+// other hierarchies it uses in step.
+type cgroupLayout interface {
+	// enable makes controllers available to the user slices below usersPath.
+	enable(controllers []string) error
+	// mkdir creates the cgroup at path.
+	mkdir(path string, mode os.FileMode) error
+	// setupSlice writes the limits of a user slice set up for a plan,
+	// logging and joining the failed writes.
+	setupSlice(slice string, config PlanConfig) error
+	// applyLimits writes the plan's limits to the open subgroup dir.
+	applyLimits(dir *cgroupDir, subDir string, config PlanConfig) error
+	// moveProcess moves pid into the open subgroup dir.
+	moveProcess(dir *cgroupDir, subDir, pid string) error
+	// populated reports whether processes are left in the cgroup at path.
+	populated(path string) bool
+	// remove removes the empty cgroup at path.
+	remove(path string) error
+}
+
+// layout is chosen at startup, see detectLayout.
+var layout cgroupLayout = cgroupV2{}
+
+// detectLayout picks the cgroup version of cgroupMount: v2 if it has
+// cgroup.controllers, otherwise v1 with the hierarchies found in mountinfo.
+func detectLayout(mountinfo string) (cgroupLayout, error) {
+	if _, err := os.Stat(filepath.Join(cgroupMount, "cgroup.controllers")); err == nil {
+		return cgroupV2{}, nil
+	}
+	mounts, err := findCgroup1Mounts(mountinfo)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := mounts["memory"]; !ok {
+		return nil, errors.New("neither cgroup v2 nor the cgroup v1 memory hierarchy is mounted")
+	}
+	return cgroupV1{mounts: mounts}, nil
+}
+
+// cgroupV2 is the unified hierarchy.
+type cgroupV2 struct{}
+
+// enable writes the cgroup.subtree_control of every cgroup from delegatedRoot
+// down to usersPath: a controller reaches the user slices only if each of their
+// ancestors passes it on. setupSlice does the same for the subgroups of a
+// slice.
+func (cgroupV2) enable(controllers []string) error {
+	value := subtreeControl(controllers)
+	dir := delegatedRoot
+	var errs []error
+	if err := writeToFile(filepath.Join(dir, "cgroup.subtree_control"), value); err != nil {
+		errs = append(errs, err)
+	}
+	rel, err := filepath.Rel(delegatedRoot, filepath.Clean(usersPath))
+	if err != nil || rel == "." {
+		return errors.Join(errs...)
+	}
+	for _, name := range strings.Split(rel, "/") {
+		dir = filepath.Join(dir, name)
+		if err := writeToFile(filepath.Join(dir, "cgroup.subtree_control"), value); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (cgroupV2) mkdir(path string, mode os.FileMode) error {
+	return cgroupFiles.Mkdir(path, mode)
+}
+
+func (cgroupV2) setupSlice(slice string, config PlanConfig) error {
+	var errs []error
+	if err := writeToFile(slice+"cgroup.subtree_control", subtreeControl(usableControllers())); err != nil {
+		slog.Error("Failed to write cgroup.subtree_control", "path", slice, "err", err)
+		errs = append(errs, err)
+	}
+	if !controllerAvailable("cpu") {
+		slog.Debug("Controller not available, skipping cpu.max", "path", slice)
+	} else if err := writeToFile(slice+"cpu.max", config.sliceCpuMax()); err != nil {
+		slog.Error("Failed to write cpu.max", "path", slice, "err", err)
+		errs = append(errs, err)
+	}
+	if !controllerAvailable("memory") {
+		slog.Debug("Controller not available, skipping memory.max", "path", slice)
+	} else if err := writeToFile(slice+"memory.max", config.sliceMemoryMax()); err != nil {
+		slog.Error("Failed to write memory.max", "path", slice, "err", err)
+		errs = append(errs, err)
+	}
+	if config.IoWeight != "" {
+		if _, err := cgroupFiles.ReadFile(slice + "io.weight"); err != nil {
+			slog.Debug("No io.weight, the IO scheduler has no weights", "path", slice)
+		} else if err := writeToFile(slice+"io.weight", config.IoWeight); err != nil {
+			slog.Error("Failed to write io.weight", "path", slice, "err", err)
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (cgroupV2) applyLimits(dir *cgroupDir, subDir string, config PlanConfig) error {
+	config = withoutUnavailable(subDir, config)
+	var errs []error
+	if config.CpuMax != "" {
+		if err := dir.write("cpu.max", config.CpuMax); err != nil {
+			slog.Error("Failed to write cpu.max", "path", subDir, "err", err)
+			errs = append(errs, err)
+		}
+	}
+	if config.CpuBurst != "" {
+		if err := dir.write("cpu.max.burst", config.CpuBurst); err != nil {
+			slog.Error("Failed to write cpu.max.burst", "path", subDir, "err", err)
+			errs = append(errs, err)
+		}
+	}
+	// cpu.idle goes first: the kernel refuses a cpu.weight while it is 1.
+	if config.CpuIdle {
+		if err := dir.write("cpu.idle", "1"); err != nil {
+			slog.Error("Failed to write cpu.idle", "path", subDir, "err", err)
+			errs = append(errs, err)
+		}
+	} else if dir.exists("cpu.idle") {
+		if err := dir.write("cpu.idle", "0"); err != nil {
+			slog.Error("Failed to reset cpu.idle", "path", subDir, "err", err)
+			errs = append(errs, err)
+		}
+	}
+	if config.CpuWeight != "" {
+		if err := dir.write("cpu.weight", config.CpuWeight); err != nil {
+			slog.Error("Failed to write cpu.weight", "path", subDir, "err", err)
+			errs = append(errs, err)
+		}
+	}
+	if config.MemoryMax != "" {
+		if err := dir.write("memory.max", config.MemoryMax); err != nil {
+			slog.Error("Failed to write memory.max", "path", subDir, "err", err)
+			errs = append(errs, err)
+		}
+	}
+	if config.MemoryHigh != "" {
+		if err := dir.write("memory.high", config.MemoryHigh); err != nil {
+			slog.Error("Failed to write memory.high", "path", subDir, "err", err)
+			errs = append(errs, err)
+		}
+	}
+	if config.SwapMax != "" {
+		if !dir.exists("memory.swap.max") {
+			slog.Debug("No memory.swap.max, swap is not limited", "path", subDir)
+		} else if err := dir.write("memory.swap.max", config.SwapMax); err != nil {
+			slog.Error("Failed to write memory.swap.max", "path", subDir, "err", err)
+			errs = append(errs, err)
+		}
+	}
+	if value := config.oomGroup(); value != "" {
+		if err := dir.write("memory.oom.group", value); err != nil {
+			slog.Error("Failed to write memory.oom.group", "path", subDir, "err", err)
+			errs = append(errs, err)
+		}
+	}
+	for _, entry := range config.IoMax {
+		if err := dir.write("io.max", entry); err != nil {
+			slog.Error("Failed to write io.max", "path", subDir, "entry", entry, "err", err)
+			errs = append(errs, err)
+		}
+	}
+	if config.IoWeight != "" {
+		if !dir.exists("io.weight") {
+			slog.Debug("No io.weight, the IO scheduler has no weights", "path", subDir)
+		} else if err := dir.write("io.weight", config.IoWeight); err != nil {
+			slog.Error("Failed to write io.weight", "path", subDir, "err", err)
+			errs = append(errs, err)
+		}
+	}
+	// Without a plan value pids.max is reset to "max". That is also the
+	// kernel default, so failing to write it (e.g. the pids controller isn't
+	// enabled because no plan uses it) doesn't fail the request. A pids
+	// controller left out by -controllers isn't written at all.
+	if !controllerAvailable("pids") {
+		return errors.Join(errs...)
+	}
+	if err := dir.write("pids.max", config.pidsMax()); err != nil {
+		if config.PidsMax != "" {
+			slog.Error("Failed to write pids.max", "path", subDir, "err", err)
+			errs = append(errs, err)
+		} else {
+			slog.Debug("Failed to reset pids.max", "path", subDir, "err", err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (cgroupV2) moveProcess(dir *cgroupDir, subDir, pid string) error {
+	if err := dir.write("cgroup.procs", pid); err != nil {
+		slog.Error("Failed to write cgroup.procs", "path", subDir, "err", err)
+		return err
+	}
+	return nil
+}
+
+func (cgroupV2) populated(path string) bool {
+	return processExists(filepath.Join(path, "cgroup.events"))
+}
+
+// remove removes the cgroup at path along with the thread cgroups placeThread
+// created in it, which are empty once the process is gone.
+func (cgroupV2) remove(path string) error {
+	threads, _ := filepath.Glob(filepath.Join(path, threadPrefix+"*"))
+	for _, thread := range threads {
+		if err := cgroupFiles.Remove(thread); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return cgroupFiles.Remove(path)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestEnableDelegatesDownToNestedUsersPath(t *testing.T) {
+	tree := newTestTree(t)
+	hosting := filepath.Join(delegatedRoot, "hosting.slice")
+	users := filepath.Join(hosting, usersDir)
+	for _, dir := range []string{hosting, users} {
+		if err := tree.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	usersPath = users + "/"
+	enableControllers()
+
+	want := strings.Join(usableControllers(), " ")
+	for _, dir := range []string{delegatedRoot, hosting, users} {
+		if got := tree.read(t, filepath.Join(dir, "cgroup.subtree_control")); got != want {
+			t.Errorf("cgroup.subtree_control of %s = %q, want %q", dir, got, want)
+		}
+	}
+
+	subDir := assign(t, "alice", planStandard)
+	if got := tree.read(t, filepath.Join(subDir, "cpu.max")); got != cpuMaxStandard {
+		t.Errorf("cpu.max = %q, want %q", got, cpuMaxStandard)
+	}
+	// The slice delegates its controllers before the subgroup's limits are
+	// written, or the subgroup would have no files to write them to.
+	slice := filepath.Dir(subDir)
+	tree.mu.Lock()
+	delegated, limited := -1, -1
+	for i, write := range tree.writes {
+		switch {
+		case write.path == filepath.Join(slice, "cgroup.subtree_control") && delegated < 0:
+			delegated = i
+		case filepath.Dir(write.path) == subDir && limited < 0:
+			limited = i
+		}
+	}
+	tree.mu.Unlock()
+	if delegated < 0 || limited < 0 || delegated > limited {
+		t.Errorf("slice cgroup.subtree_control written at %d, first subgroup write at %d; want the slice first", delegated, limited)
+	}
+	if order := tree.writeOrder(subDir); !slices.Contains(order, "cpu.max") {
+		t.Errorf("subgroup writes %v, want cpu.max among them", order)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/malumar/pguard/client"
+)
+
+const (
+	// loadtestSlice can't collide with a tenant: user names never start
+	// with a dot.
+	loadtestSlice        = ".loadtest"
+	loadtestMaxCgroups   = 1000
+	loadtestMaxSleep     = time.Minute
+	loadtestDefaultSleep = time.Second
+)
+
+var enableLoadtest *bool
+
+// loadtestCommand exercises the create, inotify and cleanup paths under
+// volume, e.g. "loadtest|200|2s": it starts N sleeper processes, places each
+// of them into its own subgroup through createCgroup and, once they have
+// exited, sweeps and removes the throwaway slice. It is only registered with
+// -enableLoadtest and refuses to run without an active cleanup cycle or once
+// shutdown has begun; shutdown waits for a running one to remove its slice.
+func loadtestCommand(conn net.Conn, args []string) {
+	if len(args) < 1 || len(args) > 2 {
+		reply(conn, "ERR %s expected loadtest|count[|sleep]", client.CodeBadRequest)
+		return
+	}
+	count, err := strconv.Atoi(args[0])
+	if err != nil || count < 1 || count > loadtestMaxCgroups {
+		reply(conn, "ERR %s count must be between 1 and %d", client.CodeBadRequest, loadtestMaxCgroups)
+		return
+	}
+	sleep := loadtestDefaultSleep
+	if len(args) == 2 {
+		if sleep, err = time.ParseDuration(args[1]); err != nil || sleep <= 0 || sleep > loadtestMaxSleep {
+			reply(conn, "ERR %s sleep must be a duration up to %s", client.CodeBadRequest, loadtestMaxSleep)
+			return
+		}
+	}
+	if cleanupTicker == nil {
+		reply(conn, "ERR %s cleanup is not running", client.CodeUnavailable)
+		return
+	}
+	if !beginSetup() {
+		reply(conn, "ERR %s shutting down", client.CodeUnavailable)
+		return
+	}
+	defer setups.Done()
+
+	slog.Warn("Load test started", "count", count, "sleep", sleep)
+	start := time.Now()
+	slice := fmt.Sprintf("%s%s.slice/", usersPath, loadtestSlice)
+	var (
+		wg      sync.WaitGroup
+		created int
+		failed  int
+	)
+	for range count {
+		sleeper := exec.Command("sleep", strconv.FormatFloat(sleep.Seconds(), 'f', -1, 64))
+		if err := sleeper.Start(); err != nil {
+			slog.Error("Failed to start sleeper", "err", err)
+			failed++
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sleeper.Wait()
+		}()
+		if _, err := createCgroup(slog.Default(), slice, planStandard, []string{strconv.Itoa(sleeper.Process.Pid)}, priorityNormal); err != nil {
+			failed++
+			continue
+		}
+		created++
+	}
+	wg.Wait()
+
+	_, removed := cleanupAllSubgroups(activeWatcher, loadtestSlice+".slice")
+	if err := layout.remove(slice); err != nil {
+		slog.Error("Failed to remove load test slice", "path", slice, "err", err)
+	} else {
+		forgetSlice(slice)
+	}
+	elapsed := time.Since(start)
+	slog.Warn("Load test finished", "created", created, "failed", failed, "removed", removed, "elapsed", elapsed)
+	reply(conn, "created=%d failed=%d removed=%d elapsed=%s", created, failed, removed, elapsed)
+}
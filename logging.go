@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"os"
+)
+
+// setupLogging configures the default slog logger. The text format keeps the
+// handler of the standard log package and only changes its level; json
+// replaces it with one JSON object per line on stderr, which the log package
+// then writes through as well.
+func setupLogging(format, level string) error {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("-log-level %q: expected debug, info, warn or error", level)
+	}
+	switch format {
+	case "text":
+		slog.SetLogLoggerLevel(lvl)
+	case "json":
+		slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: lvl})))
+	default:
+		return fmt.Errorf("-log-format %q: expected text or json", format)
+	}
+	return nil
+}
+
+// connectionLogger returns the logger of one connection: every line carries a
+// short random request id, and the peer's pid where SO_PEERCRED gives one, so
+// the lines of concurrent requests can be told apart.
+func connectionLogger(conn net.Conn) *slog.Logger {
+	attrs := []any{"request", fmt.Sprintf("%08x", rand.Uint32())}
+	if cred, err := peerCredentials(conn); err == nil {
+		attrs = append(attrs, "peer_pid", cred.Pid)
+	}
+	return slog.With(attrs...)
+}
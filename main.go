@@ -1,22 +1,37 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"github.com/glottis/inotify"
+	"github.com/malumar/pguard/client"
+	"io"
+	"io/fs"
 	"log"
 	"log/slog"
+	"math/rand/v2"
 	"net"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
+
+	"golang.org/x/sys/unix"
 )
 
 const (
-	usersPath                   = "/sys/fs/cgroup/usery/"
+	defaultCgroupMount          = "/sys/fs/cgroup"
+	usersDir                    = "usery"
 	protocol                    = "unix"
 	TestAddr                    = "/tmp/pguard.webserver.socket"
 	ProdAddr                    = "/var/run/pguard.webserver.socket"
@@ -25,36 +40,464 @@ const (
 	cpuMaxBusiness              = "70000 100000"
 	cpuWeightBus                = "75"
 	maxMemoryGb                 = 2
+	cpuWeightMin                = 1
+	cpuWeightMax                = 10000
+	ioWeightMin                 = 1
+	ioWeightMax                 = 10000
+	niceMin                     = -20
+	niceMax                     = 19
+	oomScoreAdjMin              = -1000
+	oomScoreAdjMax              = 1000
 	connectionDeadLineInSeconds = 2
+	maxRequestSize              = 4096
+	sweepBatchSize              = 64
+	defaultMaxNameLength        = 64
+	cpuPeriod                   = 100000
+	cpuPeriodMin                = 1000
+	cpuPeriodMax                = 1000000
+	cpuQuotaMin                 = 1000
+	maxQuotaCpus                = 1024
+	defaultCleanupInterval      = 10 * time.Second
+	minCleanupInterval          = time.Second
+	maxCleanupInterval          = time.Hour
 
 	defaultUid = 2003
 	defaultGid = 2003
+
+	defaultSocketMode = 0660
+
+	priorityLow    = "low"
+	priorityNormal = "normal"
+	priorityHigh   = "high"
 )
 
 var (
-	deleteAtRun  *bool
-	removeSlices *bool
-	uid          *int
-	gid          *int
-	started      = fmt.Sprintf("%d_", time.Now().UnixNano())
-	counter      atomic.Uint64
-	memoryMax    = strconv.FormatUint((1024*maxMemoryGb)*1024*1024, 10)
+	// cgroupMount is where the cgroup2 filesystem is mounted and usersPath the
+	// tree pguard manages under it; both are set at startup.
+	cgroupMount = defaultCgroupMount
+	usersPath   = filepath.Join(cgroupMount, usersDir) + "/"
+	// delegatedRoot is the topmost cgroup pguard writes to: the mountpoint,
+	// or the cgroup -cgroup-delegate names when e.g. systemd delegates one.
+	delegatedRoot = cgroupMount
+
+	// cleanupRestartDelay is the pause before a panicked cleanup cycle is
+	// started again.
+	cleanupRestartDelay = 5 * time.Second
+
+	// socketPath overrides the uid based choice of getSocketAddress.
+	socketPath string
+	// socketMode is the mode the socket file is created with.
+	socketMode os.FileMode = defaultSocketMode
+
+	// readTimeout bounds reading a request, replyTimeout every line written
+	// back, so a client that stops reading doesn't hold its connection
+	// forever.
+	readTimeout  time.Duration
+	replyTimeout time.Duration
+
+	deleteAtRun      *bool
+	removeSlices     *bool
+	cleanupOnExit    *bool
+	reconcileAtStart *bool
+	selftestAtStart  *bool
+	disableInotify   *bool
+	uid              *int
+	gid              *int
+	chownCgroups     *bool
+	started          = strconv.FormatInt(time.Now().Unix(), 36)
+	counter          atomic.Uint64
+	sweepMu          sync.Mutex
+	activeWatcher    *inotify.Watcher
+	cleanupTicker    *time.Ticker
+	memoryMax        string
+
+	cleanupIntervalNs atomic.Int64
+	// cleanupJitter spreads the sweeps of hosts started together: each
+	// interval is drawn uniformly from ±this fraction around the configured
+	// one, so the average stays the same.
+	cleanupJitter float64
+
+	coalesceWindow     *time.Duration
+	allowKernelThreads *bool
+	standbyOf          *string
+	standbyInterval    *time.Duration
+	sweepPause         *time.Duration
+	systemReserve      *float64
+	sliceSetupsMu      sync.Mutex
+	sliceSetups        = make(map[string]*sliceSetup)
+
+	// sliceLocks holds a *sliceLock per user slice path. Concurrent requests
+	// of a user serialize on it, so one of them creates the slice and writes
+	// its limits while the others wait for it. forgetSlice drops it with the
+	// slice.
+	sliceLocks sync.Map
+
+	// priorityWeightFactor multiplies the plan's cpu.weight for jobs that ask
+	// for a different priority within the same plan.
+	priorityWeightFactor = map[string]float64{
+		priorityLow:    0.5,
+		priorityNormal: 1,
+		priorityHigh:   2,
+	}
 )
 
+// errCgroupExhausted means the kernel refused to create another cgroup because
+// it ran out of cgroup IDs or memory (see also cgroup.max.descendants).
+var errCgroupExhausted = errors.New("cgroup resource exhausted")
+
+// sliceLock guards the setup of a user slice.
+type sliceLock struct {
+	mu sync.Mutex
+	// configured is the subtree_control and the limits the slice was set up
+	// with, empty until a setup succeeded.
+	configured string
+}
+
+// sliceSetup is a slice setup shared by the requests coalesced into it; err is
+// valid once done is closed.
+type sliceSetup struct {
+	started time.Time
+	done    chan struct{}
+	err     error
+}
+
 // main function initializes the flags and starts the server.
 func main() {
 	initializeFlags()
-	setupWatcher()
-	runServer()
+	ctx, stop := signal.NotifyContext(context.Background(), unix.SIGINT, unix.SIGTERM)
+	defer stop()
+	daemonCtx = ctx
+	if pidfilePath != "" {
+		if err := writePidfile(pidfilePath); err != nil {
+			log.Fatalf("Can't write -pidfile: %v", err)
+		}
+	}
+	if !skipInDryRun("create", usersPath) {
+		if err := prepareUsersPath(); err != nil {
+			log.Fatalf("Can't use %s, no request could be served: %v", usersPath, err)
+		}
+	}
+	if *selftestAtStart {
+		if dryRun {
+			log.Fatalf("-selftest writes to the cgroup tree, it can't run with -dry-run")
+		}
+		enableControllers()
+		if err := runSelftest(); err != nil {
+			log.Fatalf("Self-test failed, no request could be served: %v", err)
+		}
+		slog.Info("Self-test passed", "path", usersPath)
+	}
+	if *standbyOf != "" {
+		go mirrorActive(*standbyOf)
+	} else {
+		if *reconcileAtStart {
+			reconcile()
+		}
+		setupWatcher()
+	}
+	runServer(ctx)
+}
+
+// prepareUsersPath creates usersPath unless it exists and checks that it is a
+// directory pguard can create slices in.
+func prepareUsersPath() error {
+	if err := os.Mkdir(usersPath, 0755); err != nil && !errors.Is(err, unix.EEXIST) {
+		return err
+	}
+	info, err := os.Stat(usersPath)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return errors.New("not a directory")
+	}
+	return unix.Access(usersPath, unix.W_OK)
 }
 
 func initializeFlags() {
 	deleteAtRun = flag.Bool("delete", false, "Remove unused cgroups before startup")
 	removeSlices = flag.Bool("removeSlices", false, fmt.Sprintf("Remove %s", usersPath))
+	disableInotify = flag.Bool("disable-inotify", false, "Don't watch subgroups with inotify, remove empty ones only in the cleanup cycle")
+	selftestAtStart = flag.Bool("selftest", false, "Create, check and remove a throwaway subgroup at startup, exiting if that fails")
+	reconcileAtStart = flag.Bool("reconcile", false, "Write the current plan limits to the populated subgroups found at startup")
+	cleanupOnExit = flag.Bool("cleanupOnExit", false, "Remove unused cgroups on shutdown (by default a restart leaves them intact)")
+	interval := flag.Duration("cleanup-interval", defaultCleanupInterval, "Time between cleanup sweeps")
+	flag.Float64Var(&cleanupJitter, "cleanup-jitter", 0.1, "Vary each time between cleanup sweeps randomly by up to this fraction of -cleanup-interval (0 disables)")
+	maxConcurrency := flag.Int("max-concurrency", defaultMaxConcurrency, fmt.Sprintf("Connections handled at once, more wait up to %s and are then answered ERR busy (0 disables)", busyTimeout))
+	flag.IntVar(&maxSubgroupsPerUser, "max-subgroups-per-user", 0, "Refuse new subgroups for a user slice that has this many (0 disables)")
+	flag.IntVar(&writeRetries, "writeRetries", 2, "Retries of a cgroup write failing with ENOENT, EBUSY, EAGAIN or EINTR (0 disables)")
+	flag.DurationVar(&readTimeout, "read-timeout", connectionDeadLineInSeconds*time.Second, "Time a client has to send its request")
+	flag.DurationVar(&replyTimeout, "write-timeout", 5*time.Second, "Time a client has to take each line of a response (0 waits forever)")
+	flag.DurationVar(&writeTimeout, "writeTimeout", 5*time.Second, "Give up on a cgroup write that takes longer and fail the request (0 waits forever)")
+	flag.DurationVar(&writeRetryDelay, "writeRetryDelay", 5*time.Millisecond, "Pause before the first retry of a cgroup write, doubled for every further one")
+	coalesceWindow = flag.Duration("coalesceWindow", 0, "Set up a user slice once per window for bursts of requests of the same user (0 disables)")
+	promAddr := flag.String("metrics-addr", "", "Serve Prometheus metrics on http://host:port/metrics (empty disables)")
+	statsdAddr := flag.String("statsdAddr", "", "Send metrics as StatsD packets to this host:port (empty disables)")
+	flag.BoolVar(&dryRun, "dry-run", false, "Log the cgroup operations instead of performing them")
+	flag.StringVar(&adoptRoot, "adoptRoot", "", "cgroup directory besides the managed tree whose subgroups the adopt command may take over")
+	mountFlag := flag.String("cgroupMount", "", "cgroup2 mountpoint (detected from /proc/self/mountinfo by default)")
+	controllersFlag := flag.String("controllers", "", "Comma separated controllers to enable and write the plan limits of, among cpu, io, memory and pids (empty uses all the plans need)")
+	delegateFlag := flag.String("cgroup-delegate", "", "Cgroup delegated to pguard, e.g. with systemd's Delegate=; controllers are enabled from it down to the managed tree instead of from the mountpoint")
+	rootFlag := flag.String("cgroup-root", "", fmt.Sprintf("Directory below the cgroup mountpoint holding the user slices (default <mount>/%s)", usersDir))
+	flag.StringVar(&socketPath, "socket", "", fmt.Sprintf("Unix socket to listen on, @name for an abstract one (default %s as root, %s otherwise)", ProdAddr, TestAddr))
+	socketModeFlag := flag.String("socket-mode", fmt.Sprintf("%04o", defaultSocketMode), "Permissions of the socket file, in octal")
+	flag.StringVar(&remoteOpts.addr, "listen", "", "Also accept requests on tcp://host:port, needs -listenTokenFile or -listenClientCA")
+	flag.StringVar(&remoteOpts.tokenFile, "listenTokenFile", "", "File with the token remote clients send as \"AUTH <token>\" before their request")
+	flag.StringVar(&remoteOpts.cert, "listenCert", "", "TLS certificate of the -listen address")
+	flag.StringVar(&remoteOpts.key, "listenKey", "", "TLS key of the -listen address")
+	flag.StringVar(&remoteOpts.clientCA, "listenClientCA", "", "Require remote clients to present a certificate signed by these CAs")
+	flag.StringVar(&remoteOpts.access, "listenAccess", capWrite.String(), "Highest capability of remote clients: read, write or admin")
+	socketAccess := flag.String("socketAccess", capAdmin.String(), "Highest capability of clients of the socket: read, write or admin")
+	allowUidsFlag := flag.String("allowUids", "", "Comma separated uids whose connections are accepted, others are closed unread (empty accepts all)")
+	assignGidsFlag := flag.String("assignGids", "", "Comma separated gids whose members may assign processes to their own user, besides root (empty allows everyone)")
+	adminUidsFlag := flag.String("adminUids", "", "Comma separated uids allowed to run admin commands besides root (empty allows everyone)")
+	allowKernelThreads = flag.Bool("allowKernelThreads", false, "Pass kernel thread pids on to the kernel instead of rejecting them")
+	standbyOf = flag.String("standbyOf", "", "Run as warm standby of the pguard listening on this unix socket")
+	standbyInterval = flag.Duration("standbyInterval", 30*time.Second, "How often a standby pulls the snapshot of the active pguard")
+	flag.IntVar(&failureThreshold, "failureThreshold", 0, "Act on a user after this many consecutive failed requests (0 disables)")
+	flag.StringVar(&failureAction, "failureAction", actionWarn, "What to do with a user over -failureThreshold: warn, webhook or quarantine")
+	flag.StringVar(&failureWebhook, "failureWebhook", "", "URL the webhook action POSTs a JSON report to")
+	flag.DurationVar(&quarantineFor, "quarantineFor", time.Minute, "How long the quarantine action rejects a user's requests")
+	flag.IntVar(&maxNameLength, "maxNameLength", defaultMaxNameLength, "Maximum length of subgroup directory names")
+	flag.StringVar(&memoryMax, "sliceMemoryMax", strconv.FormatUint((1024*maxMemoryGb)*1024*1024, 10), "memory.max of every user slice, in bytes or \"max\"")
+	configPath := flag.String("config", "", "Load plans from this JSON file")
+	validateConfig := flag.Bool("validateConfig", false, "Validate the -config file and exit without starting the server")
+	sweepPause = flag.Duration("sweepPause", 0, fmt.Sprintf("Pause after every %d subgroups of a cleanup sweep (0 only yields)", sweepBatchSize))
+	systemReserve = flag.Float64("systemReserve", 0, fmt.Sprintf("CPUs kept free for the system by capping cpu.max of %s (0 disables)", usersPath))
+	failureWindow := flag.Duration("failureWindow", time.Hour, "Time window over which the failures command counts failed requests")
+	flag.StringVar(&plansURL, "plansURL", "", "Fetch the plans config from this HTTP(S) URL instead of -config")
+	flag.DurationVar(&plansRefresh, "plansRefresh", 5*time.Minute, "How often the config at -plansURL is fetched again (0 fetches it only at startup)")
+	flag.StringVar(&defaultPlanFlag, "default-plan", "", "Plan of requests that name none, unless the config sets defaultPlan (empty refuses them)")
+	procsFirst := flag.String("procsFirst", "", "Comma separated plans whose process is moved before the limits are written")
+	enableLoadtest = flag.Bool("enableLoadtest", false, "Register the loadtest admin command, which creates throwaway cgroups (never use in production)")
+	auditLogPath := flag.String("audit-log", "", "Append a JSON line for every assignment to this file")
+	metaIndexPath := flag.String("metaIndex", "", "Keep subgroup metadata in this append-only index file instead of xattrs")
 	uid = flag.Int("uid", defaultUid, fmt.Sprintf("Set uid of %s (default %d)", usersPath, defaultUid))
 	gid = flag.Int("gid", defaultGid, fmt.Sprintf("Set git of %s (default %d)", usersPath, defaultGid))
+	chownCgroups = flag.Bool("chown-cgroups", false, "Give the created slices and subgroups to -uid/-gid when running as root, for delegated management")
+	flag.StringVar(&pidfilePath, "pidfile", "", "Write the pid to this file, refusing to start while the pguard it names runs")
+	runCheck := flag.Bool("check", false, "Check that the host is ready for pguard, print a summary and exit")
+	showVersion := flag.Bool("version", false, "Print the version and exit")
+	logFormat := flag.String("log-format", "text", "Log format: text or json")
+	logLevel := flag.String("log-level", "info", "Lowest level logged: debug, info, warn or error")
 	flag.Parse()
 
+	if *showVersion {
+		fmt.Println(versionString())
+		os.Exit(0)
+	}
+
+	if err := setupLogging(*logFormat, *logLevel); err != nil {
+		log.Fatal(err)
+	}
+
+	if *enableLoadtest {
+		slog.Warn("Load testing enabled, the loadtest command creates throwaway cgroups")
+		commands["loadtest"] = command{loadtestCommand, capAdmin}
+	}
+
+	for _, plan := range strings.Split(*procsFirst, ",") {
+		if plan != "" {
+			procsFirstPlans = append(procsFirstPlans, strings.ToLower(plan))
+		}
+	}
+	swapPlans(nil)
+	setDefaultPlan("")
+
+	if *validateConfig && *configPath == "" {
+		fmt.Fprintln(os.Stderr, "-validateConfig requires -config")
+		os.Exit(2)
+	}
+	if *configPath != "" {
+		config, err := loadConfig(*configPath)
+		if *validateConfig {
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			fmt.Printf("%s: ok, %d plans\n", *configPath, len(config.Plans))
+			os.Exit(0)
+		}
+		if err != nil {
+			log.Fatalf("Invalid config: %v", err)
+		}
+		config.apply()
+		configFile = *configPath
+	}
+
+	if mode, err := strconv.ParseUint(*socketModeFlag, 8, 32); err != nil || mode > 0777 {
+		log.Fatalf("Invalid -socket-mode %q: expected octal permissions like 0660", *socketModeFlag)
+	} else {
+		socketMode = os.FileMode(mode)
+	}
+
+	if err := validateMemoryMax(memoryMax); err != nil {
+		log.Fatalf("Invalid -sliceMemoryMax: %v", err)
+	}
+	if *configPath != "" && plansURL != "" {
+		log.Fatal("-config and -plansURL are mutually exclusive")
+	}
+	if plansURL != "" {
+		refreshPlans()
+		if plansRefresh > 0 {
+			go refreshPlansCycle()
+		}
+	}
+
+	for _, plan := range procsFirstPlans {
+		if _, ok := currentPlans()[plan]; !ok {
+			log.Fatalf("Unknown plan in -procsFirst: %s", plan)
+		}
+	}
+	if plan := getDefaultPlan(); plan != "" {
+		if _, ok := currentPlans()[plan]; !ok {
+			log.Fatalf("Unknown plan in -default-plan: %s", plan)
+		}
+	}
+
+	failures.window = *failureWindow
+
+	switch failureAction {
+	case actionWarn, actionQuarantine:
+	case actionWebhook:
+		if failureWebhook == "" {
+			log.Fatal("-failureAction webhook requires -failureWebhook")
+		}
+	default:
+		log.Fatalf("Invalid -failureAction %q", failureAction)
+	}
+
+	if maxNameLength < 2 || maxNameLength > 255 {
+		log.Fatalf("-maxNameLength must be between 2 and 255, got %d", maxNameLength)
+	}
+
+	var err error
+	if listenerCapability, err = parseCapability(*socketAccess); err != nil {
+		log.Fatalf("Invalid -socketAccess: %v", err)
+	}
+	if adminUids, err = parseUids(*adminUidsFlag); err != nil {
+		log.Fatalf("Invalid -adminUids: %v", err)
+	}
+	if allowUids, err = parseUids(*allowUidsFlag); err != nil {
+		log.Fatalf("Invalid -allowUids: %v", err)
+	}
+	if assignGids, err = parseUids(*assignGidsFlag); err != nil {
+		log.Fatalf("Invalid -assignGids: %v", err)
+	}
+	if *maxConcurrency < 0 {
+		log.Fatalf("-max-concurrency must not be negative, got %d", *maxConcurrency)
+	}
+	if *maxConcurrency > 0 {
+		handlers = make(chan struct{}, *maxConcurrency)
+	}
+	if readTimeout <= 0 {
+		log.Fatalf("-read-timeout must be positive, got %s", readTimeout)
+	}
+	if writeRetries < 0 || writeRetryDelay < 0 || writeTimeout < 0 || replyTimeout < 0 {
+		log.Fatalf("-writeRetries, -writeRetryDelay, -writeTimeout and -write-timeout must not be negative")
+	}
+	if *auditLogPath != "" {
+		if err := openAuditLog(*auditLogPath); err != nil {
+			log.Fatalf("Can't open -audit-log: %v", err)
+		}
+	}
+	reloadOnHangup()
+	if *interval < minCleanupInterval || *interval > maxCleanupInterval {
+		log.Fatalf("-cleanup-interval must be between %s and %s, got %s", minCleanupInterval, maxCleanupInterval, *interval)
+	}
+	cleanupIntervalNs.Store(int64(*interval))
+	if cleanupJitter < 0 || cleanupJitter >= 1 {
+		log.Fatalf("-cleanup-jitter must be at least 0 and below 1, got %g", cleanupJitter)
+	}
+
+	if *mountFlag != "" {
+		cgroupMount = filepath.Clean(*mountFlag)
+	} else {
+		mount, err := findCgroup2Mount("/proc/self/mountinfo")
+		if err != nil {
+			v1, v1Err := findCgroup1Mounts("/proc/self/mountinfo")
+			if v1Err != nil || v1["memory"] == "" {
+				log.Fatalf("Can't find the cgroup2 mountpoint, set it with -cgroupMount: %v", err)
+			}
+			mount = v1["memory"]
+		}
+		cgroupMount = mount
+	}
+	if layout, err = detectLayout("/proc/self/mountinfo"); err != nil {
+		log.Fatalf("Can't use %s: %v", cgroupMount, err)
+	}
+	usersPath = filepath.Join(cgroupMount, usersDir) + "/"
+	if *rootFlag != "" {
+		root := filepath.Clean(*rootFlag)
+		if !strings.HasPrefix(root, cgroupMount+"/") {
+			log.Fatalf("-cgroup-root %s is not below the cgroup mountpoint %s", root, cgroupMount)
+		}
+		usersPath = root + "/"
+	}
+	if *controllersFlag != "" {
+		if _, ok := layout.(cgroupV1); ok {
+			log.Fatalf("-controllers needs cgroup v2")
+		}
+		controllers, err := parseControllers(*controllersFlag)
+		if err != nil {
+			log.Fatalf("Invalid -controllers: %v", err)
+		}
+		enabledControllers = controllers
+	}
+	delegatedRoot = cgroupMount
+	if *delegateFlag != "" {
+		if _, ok := layout.(cgroupV1); ok {
+			log.Fatalf("-cgroup-delegate needs cgroup v2")
+		}
+		delegatedRoot = filepath.Clean(*delegateFlag)
+		if delegatedRoot != cgroupMount && !strings.HasPrefix(delegatedRoot, cgroupMount+"/") {
+			log.Fatalf("-cgroup-delegate %s is not below the cgroup mountpoint %s", delegatedRoot, cgroupMount)
+		}
+		if !strings.HasPrefix(usersPath, delegatedRoot+"/") || filepath.Clean(usersPath) == delegatedRoot {
+			log.Fatalf("The managed tree %s is not below -cgroup-delegate %s, set -cgroup-root", usersPath, delegatedRoot)
+		}
+		// Without the controllers no limit could be applied; better not
+		// to start than to accept requests that all fail.
+		if err := checkControllers(); err != nil {
+			log.Fatalf("Can't use -cgroup-delegate: %v", err)
+		}
+	}
+	if _, ok := layout.(cgroupV1); ok {
+		slog.Warn("Only cgroup v1 is available, limits are written to the v1 hierarchies", "memory", cgroupMount, "path", usersPath)
+	} else {
+		slog.Info("Using cgroup2", "mount", cgroupMount, "delegated", delegatedRoot, "path", usersPath)
+	}
+
+	if *runCheck {
+		if err := runChecks(); err != nil {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if *metaIndexPath != "" {
+		if index, err = openMetaIndex(*metaIndexPath); err != nil {
+			log.Fatalf("Can't open metadata index: %v", err)
+		}
+	}
+
+	if *statsdAddr != "" {
+		statsd, err := newStatsdMetrics(*statsdAddr)
+		if err != nil {
+			log.Fatalf("Can't set up statsd metrics: %v", err)
+		}
+		metrics.backends = append(metrics.backends, statsd)
+	}
+	if *promAddr != "" {
+		prom := newPromMetrics()
+		if err := servePromMetrics(prom, *promAddr); err != nil {
+			log.Fatalf("Can't serve Prometheus metrics: %v", err)
+		}
+		metrics.backends = append(metrics.backends, prom)
+	}
+
+	logConfig()
+
 	if *deleteAtRun {
 		cleanupAllSubgroups(nil, "")
 		if *removeSlices {
@@ -64,30 +507,103 @@ func initializeFlags() {
 }
 
 func setupWatcher() {
+	if *disableInotify {
+		// The cleanup functions take a nil watcher: nothing is watched and
+		// empty subgroups wait for the next sweep.
+		slog.Info("inotify disabled, empty subgroups are removed by the cleanup cycle only", "interval", cleanupInterval())
+		cleanupTicker = time.NewTicker(jitteredInterval())
+		go superviseCleaningCycle(daemonCtx, nil, cleanupTicker)
+		return
+	}
 	watcher, err := inotify.NewWatcher()
 	if err != nil {
 		slog.Error("Failed to create watcher", "err", err)
 		return
 	}
-	defer watcher.Close()
-	defer cleanupAllSubgroups(watcher, "")
-
-	go startCleaningCycle(watcher)
+	activeWatcher = watcher
+	watchExisting(watcher)
+	cleanupTicker = time.NewTicker(jitteredInterval())
+	go superviseCleaningCycle(daemonCtx, watcher, cleanupTicker)
 	go handleEvents(watcher)
 }
 
-func startCleaningCycle(watcher *inotify.Watcher) {
+// superviseCleaningCycle keeps the cleanup cycle running. A panic in a sweep
+// would otherwise end the cycle silently and leave empty subgroups piling up,
+// so it is logged with its stack, counted in cleanup_panics and the cycle is
+// restarted after cleanupRestartDelay.
+func superviseCleaningCycle(ctx context.Context, watcher *inotify.Watcher, ticker *time.Ticker) {
+	for ctx.Err() == nil {
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					slog.Error("Cleanup cycle panicked, restarting it", "panic", r, "delay", cleanupRestartDelay, "stack", string(debug.Stack()))
+					metrics.Add("cleanup_panics", 1)
+				}
+			}()
+			startCleaningCycle(ctx, watcher, ticker)
+		}()
+		select {
+		case <-ctx.Done():
+		case <-time.After(cleanupRestartDelay):
+		}
+	}
+}
+
+// startCleaningCycle sweeps the tree on every tick until ctx is cancelled.
+func startCleaningCycle(ctx context.Context, watcher *inotify.Watcher, ticker *time.Ticker) {
 	for {
-		slog.Info("Performing cyclic cleaning", "path", usersPath)
+		slog.Info("Performing cyclic cleaning", "path", usersPath, "watches", watchCount())
 		cleanupAllSubgroups(watcher, "")
-		time.Sleep(10 * time.Second)
+		cleanupAdopted(watcher)
+		if dropped := reconcileWatches(watcher); dropped > 0 {
+			slog.Warn("Dropped watches of removed paths", "dropped", dropped, "watches", watchCount())
+		}
+		metrics.Set("watches", float64(watchCount()))
+		metrics.Set("active_subgroups", float64(countSubgroups()))
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			ticker.Reset(jitteredInterval())
+		}
 	}
 }
 
+func cleanupInterval() time.Duration {
+	return time.Duration(cleanupIntervalNs.Load())
+}
+
+// jitteredInterval returns the time until the next sweep, the cleanup
+// interval varied by -cleanup-jitter.
+func jitteredInterval() time.Duration {
+	d := cleanupInterval()
+	if cleanupJitter <= 0 {
+		return d
+	}
+	return d + time.Duration((rand.Float64()*2-1)*cleanupJitter*float64(d))
+}
+
+// setCleanupInterval changes the time between cleanup sweeps; the next sweep
+// happens one new interval from now.
+func setCleanupInterval(d time.Duration) error {
+	if d < minCleanupInterval || d > maxCleanupInterval {
+		return fmt.Errorf("interval must be between %s and %s", minCleanupInterval, maxCleanupInterval)
+	}
+	if cleanupTicker == nil {
+		return errors.New("cleanup is not running")
+	}
+	cleanupIntervalNs.Store(int64(d))
+	cleanupTicker.Reset(d)
+	return nil
+}
+
 func handleEvents(watcher *inotify.Watcher) {
 	for {
 		select {
-		case event := <-watcher.Events:
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
 			handleEvent(event, watcher)
 		case err, ok := <-watcher.Errors:
 			if !ok {
@@ -98,62 +614,59 @@ func handleEvents(watcher *inotify.Watcher) {
 	}
 }
 
+// handleEvent removes a subgroup as soon as the kernel reports it empty in its
+// cgroup.events, instead of leaving it to the next sweep.
 func handleEvent(event inotify.Event, watcher *inotify.Watcher) {
-	if event.Op&inotify.Write == inotify.Write && !processExists(event.Name) {
-		parentDir := filepath.Dir(event.Name)
-		if strings.HasPrefix(parentDir, strings.TrimSuffix(usersPath, "/")) {
-			if err := os.Remove(parentDir); err != nil {
-				slog.Error("Failed to delete path", "err", err)
-			}
-		}
+	if event.Op&inotify.Write != inotify.Write || filepath.Base(event.Name) != "cgroup.events" {
+		return
+	}
+	subgroup := filepath.Dir(event.Name)
+	if !strings.HasPrefix(subgroup, usersPath) && !isAdopted(subgroup) {
+		return
+	}
+	if cleanupSubgroup(subgroup, watcher) {
+		slog.Debug("Removed emptied subgroup", "path", subgroup)
 	}
 }
 
-func runServer() {
-	addr := getSocketAddress()
-	if err := os.Mkdir(usersPath, 0755); err != nil {
-		slog.Error("Failed to create directory", "err", err)
-	}
+// runServer serves the socket until ctx is cancelled, then shuts down.
+func runServer(ctx context.Context) {
 	setupCgroupConfig()
-
-	listener, err := net.Listen(protocol, addr)
+	server, err := startServer(ctx, getSocketAddress())
 	if err != nil {
 		log.Fatalf("Error starting server: %v", err)
 	}
-
-	if os.Getuid() == 0 {
-		if err := os.Chown(addr, *uid, *gid); err != nil {
-			slog.Error("can't chown addr path", "addr", addr, "err", err)
-		}
-	}
-
-	defer listener.Close()
-
-	slog.Info("Server launched", "address", addr)
-	for {
-		conn, err := listener.Accept()
-		if err != nil {
-			slog.Error("Failed to accept connection", "err", err)
-			continue
-		}
-		go handleConnection(conn)
-	}
+	<-ctx.Done()
+	server.Shutdown(context.Background())
 }
 
 func getSocketAddress() string {
+	if socketPath != "" {
+		return socketPath
+	}
 	if os.Getuid() == 0 {
 		return ProdAddr
 	}
 	return TestAddr
 }
 
+// isAbstractSocket reports whether addr names a socket in the Linux abstract
+// namespace, "@name", which has no file in the filesystem.
+func isAbstractSocket(addr string) bool {
+	return strings.HasPrefix(addr, "@")
+}
+
 func setupCgroupConfig() {
-	err := writeToFile("/sys/fs/cgroup/cgroup.subtree_control", "+cpu +io +memory +pids")
-	if err != nil {
-		log.Printf("Failed to write cgroup config: %v", err)
+	enableControllers()
+	if err := applySystemReserve(); err != nil {
+		log.Fatal(err)
 	}
+	reserveApplied.Store(true)
 
 	socketAddress := getSocketAddress()
+	if isAbstractSocket(socketAddress) {
+		return
+	}
 	if _, err := os.Stat(socketAddress); err == nil {
 		if err := os.RemoveAll(socketAddress); err != nil {
 			log.Fatal(err)
@@ -161,144 +674,794 @@ func setupCgroupConfig() {
 	}
 }
 
-func handleConnection(conn net.Conn) {
+// enableControllers enables the controllers the plans need below the cgroup
+// root. It runs again whenever the plans change.
+func enableControllers() {
+	if _, ok := layout.(cgroupV1); !ok {
+		readAvailableControllers()
+		warnUnavailable()
+	}
+	if err := layout.enable(usableControllers()); err != nil {
+		log.Printf("Failed to write cgroup config: %v", err)
+	}
+}
+
+// reserveApplied is set once setupCgroupConfig applied the system reserve;
+// from then on every config applied applies it again.
+var reserveApplied atomic.Bool
+
+// applySystemReserve caps the CPU of all tenants together, leaving
+// -systemReserve CPUs to the host and pguard itself. It fails only for a
+// reserve of all the CPUs there are.
+func applySystemReserve() error {
+	if *systemReserve <= 0 {
+		return nil
+	}
+	if _, ok := layout.(cgroupV1); ok {
+		slog.Error("-systemReserve needs cgroup v2, ignoring it")
+		return nil
+	}
+	cpus := float64(runtime.NumCPU())
+	if *systemReserve >= cpus {
+		return fmt.Errorf("-systemReserve %g must be lower than the number of CPUs (%g)", *systemReserve, cpus)
+	}
+	quota := int64((cpus - *systemReserve) * cpuPeriod)
+	value := fmt.Sprintf("%d %d", quota, cpuPeriod)
+	if err := writeToFile(usersPath+"cpu.max", value); err != nil {
+		slog.Error("Failed to write cpu.max", "path", usersPath, "err", err)
+		return nil
+	}
+	slog.Info("System reserve applied", "path", usersPath, "reserve", *systemReserve, "cpu.max", value)
+	return nil
+}
+
+func handleConnection(ctx context.Context, conn net.Conn) {
 	defer conn.Close()
-	if err := conn.SetReadDeadline(time.Now().Add(connectionDeadLineInSeconds * time.Second)); err != nil {
-		slog.Error("can't SetReadDeadline", "err", err, "seconds", connectionDeadLineInSeconds)
+	logger := connectionLogger(conn)
+	if !acquireHandler(ctx) {
+		logger.Warn("Too many connections, rejecting", "max", cap(handlers))
+		metrics.Add("connections_busy", 1)
+		reply(conn, "ERR %s busy", client.CodeUnavailable)
+		return
+	}
+	defer releaseHandler()
+	// A client that hasn't sent its request when shutdown starts is cut off.
+	stopRead := context.AfterFunc(ctx, func() { conn.SetReadDeadline(time.Now()) })
+	defer stopRead()
+	// The response is written after the read deadline may have passed,
+	// reply sets a write deadline of its own.
+	if err := conn.SetReadDeadline(time.Now().Add(readTimeout)); err != nil {
+		logger.Error("can't SetReadDeadline", "err", err, "timeout", readTimeout)
 	}
 
-	buf := make([]byte, 512)
-	n, err := conn.Read(buf)
+	request, err := readRequest(conn)
 	if err != nil {
-		slog.Debug("Connection read error", "err", err)
+		logger.Debug("Connection read error", "err", err)
+		if errors.Is(err, bufio.ErrBufferFull) {
+			reply(conn, "ERR %s request longer than %d bytes", client.CodeBadRequest, maxRequestSize)
+		}
 		return
 	}
-
-	request := strings.TrimSpace(string(buf[:n]))
 	args := strings.Split(request, "|")
-	if len(args) != 3 {
-		slog.Error("Expected 3 arguments in request", "args", args)
+	if len(args) == 1 && strings.Contains(request, "=") {
+		args = parseKeyValueRequest(request)
+	}
+	granted := connectionCapability(conn)
+	if command, ok := commands[strings.ToLower(args[0])]; ok {
+		if granted < command.capability {
+			logger.Error("Command forbidden", "command", args[0], "capability", granted)
+			reply(conn, "ERR %s forbidden", client.CodeUnauthorized)
+			return
+		}
+		command.run(conn, args[1:])
+		return
+	}
+	if isVerb(args[0]) {
+		unknownCommand(conn, args[0], granted)
+		return
+	}
+
+	start := time.Now()
+	format := formatText
+	if len(args) >= 5 && args[4] != "" {
+		format = strings.ToLower(args[4])
+	}
+	if granted < capWrite {
+		logger.Error("Request forbidden", "capability", granted)
+		respond(conn, format, start, Response{Status: statusForbidden, Message: "forbidden"})
+		return
+	}
+	if len(args) < 3 || len(args) > 6 {
+		logger.Error("Expected 3 to 6 arguments in request", "args", args)
+		respond(conn, format, start, Response{Status: statusBadRequest, Message: "expected pid|user|plan[|priority[|format[|tid]]]"})
+		return
+	}
+	if format != formatText && format != formatJSON {
+		logger.Error("unknown response format", "arg", args[4])
+		respond(conn, formatText, start, Response{Status: statusBadRequest, Message: "unknown format " + args[4]})
 		return
 	}
 
 	if len(args[0]) == 0 {
-		slog.Error("i expected pid", "arg", args[0])
+		logger.Error("i expected pid", "arg", args[0])
+		respond(conn, format, start, Response{Status: statusBadRequest, Message: "missing pid"})
 		return
 
 	}
 	if len(args[1]) == 0 {
-		slog.Error("i expected user", args[1])
+		logger.Error("i expected user", "arg", args[1])
+		respond(conn, format, start, Response{Status: statusBadRequest, Message: "missing user"})
+		return
+	}
+	if !validUsername(args[1]) {
+		logger.Error("Invalid user name", "arg", args[1])
+		respond(conn, format, start, Response{Status: statusBadRequest, Message: "invalid user " + args[1]})
 		return
 	}
+	// Several processes, e.g. a job and its helper, go into one subgroup
+	// as "pid,pid|user|plan".
+	pids := strings.Split(args[0], ",")
+	for _, pid := range pids {
+		if !validPid(pid) {
+			logger.Error("Invalid pid", "arg", pid)
+			respond(conn, format, start, Response{Status: statusBadRequest, Message: "invalid pid " + pid})
+			return
+		}
+		if !processAlive(pid) {
+			logger.Error("No such process", "pid", pid)
+			failures.record(reasonPidGone)
+			// A client that keeps sending pids of exited processes counts
+			// towards -failureThreshold like any other failure.
+			userFailed(args[1], fmt.Errorf("no such process %s: %w", pid, unix.ESRCH))
+			respond(conn, format, start, Response{Status: statusRejected, Code: client.CodeNoSuchPid, Message: "no such process " + pid})
+			return
+		}
+	}
+	if len(args[2]) == 0 {
+		args[2] = getDefaultPlan()
+	}
+	if len(args[2]) == 0 {
+		logger.Error("i expected plan", "arg", args[2])
+		respond(conn, format, start, Response{Status: statusBadRequest, Message: "missing plan"})
+		return
+	}
+	if cred, err := peerCredentials(conn); err == nil || len(assignGids) > 0 {
+		err := authorizeCreate(cred, args[1])
+		if err == nil {
+			err = authorizePids(cred, pids)
+		}
+		if err != nil {
+			logger.Error("Request not authorized", "user", args[1], "err", err)
+			respond(conn, format, start, Response{Status: statusForbidden, Message: err.Error()})
+			return
+		}
+	}
 
-	userSlice := fmt.Sprintf("%s/%s.slice/", usersPath, args[1])
-	createCgroup(userSlice, args[2], args[0])
-}
+	if !*allowKernelThreads {
+		for _, pid := range pids {
+			if kthread, err := isKernelThread(pid); err == nil && kthread {
+				logger.Error("Refusing to move a kernel thread", "pid", pid)
+				respond(conn, format, start, Response{Status: statusRejected, Message: "kernel thread"})
+				return
+			}
+		}
+	}
 
-func createCgroup(slice, plan, pid string) {
-	if err := CreateCgroupDir(slice, 0755); err != nil {
-		slog.Error("Failed to create user slice", "path", slice, "err", err)
+	var tid string
+	if len(args) == 6 && args[5] != "" {
+		tid = args[5]
+		if err := checkThread(pids, tid); err != nil {
+			logger.Error("Refusing thread placement", "pid", args[0], "tid", tid, "err", err)
+			respond(conn, format, start, Response{Status: statusBadRequest, Message: err.Error()})
+			return
+		}
+	}
+
+	priority := priorityNormal
+	if len(args) >= 4 && len(args[3]) > 0 {
+		priority = strings.ToLower(args[3])
+	}
+	if _, ok := priorityWeightFactor[priority]; !ok {
+		logger.Error("unknown priority", "arg", args[3])
+		respond(conn, format, start, Response{Status: statusBadRequest, Message: "unknown priority " + args[3]})
+		return
+	}
+
+	if until, ok := quarantinedUntil(args[1]); ok {
+		logger.Error("User is quarantined", "user", args[1], "until", until)
+		respond(conn, format, start, Response{Status: statusQuarantined, Message: "until " + until.Format(time.RFC3339)})
 		return
 	}
 
-	cpuMax, cpuWeight := getPlanConfig(plan)
-	subDir := fmt.Sprintf("%s%s_%d", slice, started, counter.Add(1))
-	if err := CreateCgroupDir(subDir, 0755); err != nil {
-		slog.Error("Failed to create user slice subdir", "path", subDir, "err", err)
+	if draining.Load() {
+		logger.Error("Refusing assignment while draining", "user", args[1], "pid", args[0])
+		respond(conn, format, start, Response{Status: statusUnavailable, Message: "draining"})
 		return
 	}
 
-	applyCgroupConfig(slice, subDir, cpuMax, cpuWeight, pid)
-	slog.Info("Cgroup setup complete", "userSlice", slice, "subDir", subDir)
+	userSlice := fmt.Sprintf("%s%s.slice/", usersPath, args[1])
+	if !beginSetup() {
+		respond(conn, format, start, Response{Status: statusUnavailable, Message: "shutting down"})
+		return
+	}
+	var placed placement
+	if tid != "" {
+		placed, err = placeThread(logger, userSlice, args[2], pids[0], tid, priority)
+	} else {
+		placed, err = createCgroup(logger, userSlice, args[2], pids, priority)
+	}
+	setups.Done()
+	if err != nil {
+		metrics.Add("requests", 1, "result", "failed")
+		// Refusing a drained user is intended, not a failure that should
+		// count towards quarantining them.
+		if !errors.Is(err, errUserDrained) {
+			failures.record(failureReason(err))
+			userFailed(args[1], err)
+		}
+		respond(conn, format, start, failureResponse(err))
+		return
+	}
+	if tid == "" {
+		reapExited(logger, placed.subDir)
+	}
+	userSucceeded(args[1])
+	metrics.Add("requests", 1, "result", "created")
+	observeAssignment(logger, start, placed.timing)
+	respond(conn, format, start, placementResponse(placed))
 }
 
-func applyCgroupConfig(slice, subDir, cpuMax, cpuWeight, pid string) {
-	if err := writeToFile(slice+"cpu.max", "max"); err != nil {
-		slog.Error("Failed to write cpu.max", "path", slice, "err", err)
+// reapExited removes the subgroup subDir processes were just moved into if
+// they have all exited already. The kernel reported the subgroup empty
+// before it was watched, so the watcher won't remove it before the next
+// sweep.
+func reapExited(logger *slog.Logger, subDir string) {
+	if dryRun || layout.populated(subDir) {
+		return
 	}
-	if err := writeToFile(slice+"memory.max", memoryMax); err != nil {
-		slog.Error("Failed to write memory.max", "path", slice, "err", err)
+	if cleanupSubgroup(subDir, activeWatcher) {
+		logger.Info("Processes exited right after the move, removed their subgroup", "path", subDir)
 	}
-	if err := writeToFile(subDir+"cpu.max", cpuMax); err != nil {
-		slog.Error("Failed to write cpu.max", "path", subDir, "err", err)
+}
+
+// placement is where createCgroup put a process and the limits it applied.
+type placement struct {
+	subDir string
+	plan   string
+	config PlanConfig
+	pids   int
+	timing assignTiming
+}
+
+// assignTiming is where createCgroup spent its time: setting up the user
+// slice, creating the subgroup directory, which is 0 for a reused one, and
+// writing the limits and cgroup.procs.
+type assignTiming struct {
+	slice, mkdir, writes time.Duration
+}
+
+// observeAssignment logs and records how long an assignment received at start
+// took, in total and per phase.
+func observeAssignment(logger *slog.Logger, start time.Time, timing assignTiming) {
+	total := time.Since(start)
+	logger.Debug("Assignment timing", "total", total, "slice", timing.slice, "mkdir", timing.mkdir, "writes", timing.writes)
+	metrics.Observe("assignment_duration", total)
+	metrics.Observe("assignment_phase_duration", timing.slice, "phase", "slice")
+	metrics.Observe("assignment_phase_duration", timing.mkdir, "phase", "mkdir")
+	metrics.Observe("assignment_phase_duration", timing.writes, "phase", "writes")
+}
+
+// requestKeys are the fields of an assignment in the order of the pipe
+// separated format.
+var requestKeys = []string{"pid", "user", "plan", "priority", "format", "tid"}
+
+// parseKeyValueRequest turns an assignment given as key=value pairs, e.g.
+// "pid=1234 user=alice plan=business priority=high", into the fields of the
+// pipe separated format. Keys the daemon doesn't know are ignored, so clients
+// can send fields only newer pguards understand.
+func parseKeyValueRequest(request string) []string {
+	values := make(map[string]string)
+	for _, field := range strings.Fields(request) {
+		key, value, _ := strings.Cut(field, "=")
+		key = strings.ToLower(key)
+		if !slices.Contains(requestKeys, key) {
+			slog.Debug("Ignoring unknown request key", "key", key)
+			continue
+		}
+		values[key] = value
 	}
-	if err := writeToFile(subDir+"cpu.weight", cpuWeight); err != nil {
-		slog.Error("Failed to write cpu.weight", "path", subDir, "err", err)
+	n := 3
+	for i, key := range requestKeys {
+		if _, ok := values[key]; ok && i >= n {
+			n = i + 1
+		}
 	}
-	if err := writeToFile(subDir+"cgroup.procs", pid); err != nil {
-		slog.Error("Failed to write cgroup.procs", "path", subDir, "err", err)
+	args := make([]string, n)
+	for i := range args {
+		args[i] = values[requestKeys[i]]
 	}
+	return args
 }
 
-func getPlanConfig(plan string) (string, string) {
-	switch strings.ToLower(plan) {
-	case "business":
-		return cpuMaxBusiness, cpuWeightBus
+// readRequest reads a request terminated by a newline. Older clients don't
+// terminate theirs; such a request is taken as complete when the client
+// closes its side of the connection or the read deadline passes.
+func readRequest(conn net.Conn) (string, error) {
+	reader := bufio.NewReaderSize(conn, maxRequestSize)
+	line, err := reader.ReadSlice('\n')
+	switch {
+	case err == nil:
+	case errors.Is(err, bufio.ErrBufferFull):
+		return "", err
+	case len(line) > 0 && (errors.Is(err, io.EOF) || errors.Is(err, os.ErrDeadlineExceeded)):
+		slog.Debug("Unterminated request", "err", err)
 	default:
-		return cpuMaxStandard, cpuWeightStd
+		return "", err
 	}
+	return strings.TrimSpace(string(line)), nil
 }
 
-func cleanupAllSubgroups(watcher *inotify.Watcher, userSlice string) {
-	dir := usersPath
-	if userSlice != "" {
-		dir = filepath.Join(usersPath, userSlice)
+func createCgroup(logger *slog.Logger, slice, plan string, pids []string, priority string) (placed placement, err error) {
+	defer func() { audit(slice, plan, pids, placed, err) }()
+	if userDrained(strings.TrimSuffix(filepath.Base(slice), ".slice")) {
+		return placement{}, errUserDrained
 	}
-	entries, err := os.ReadDir(dir)
+	beginCreating(slice)
+	defer endCreating(slice)
+	config, ok := getPlanConfig(plan)
+	if !ok {
+		logger.Error("Unknown plan", "plan", plan, "userSlice", slice)
+		return placement{}, fmt.Errorf("%w %q", errUnknownPlan, plan)
+	}
+	var timing assignTiming
+	phase := time.Now()
+	if err := setupSliceCoalesced(slice, config); err != nil {
+		logger.Error("Failed to create user slice", "path", slice, "err", err)
+		return placement{}, err
+	}
+	timing.slice = time.Since(phase)
+
+	config.CpuWeight = weightForPriority(config.CpuWeight, priority)
+	subDir := claimEmptySubgroup(slice, resolvePlan(plan), priority)
+	if subDir != "" {
+		defer endCreating(subDir)
+		logger.Debug("Reusing empty subgroup", "path", subDir)
+		metrics.Add("cgroups_reused", 1, "plan", resolvePlan(plan))
+	} else {
+		if err := reserveSubgroup(slice); err != nil {
+			logger.Error("Refusing to create subgroup", "path", slice, "max", maxSubgroupsPerUser, "err", err)
+			return placement{}, err
+		}
+		var label string
+		if len(pids) > 0 {
+			label = pids[0]
+		}
+		phase = time.Now()
+		subDir, err = createSubgroupDir(slice, label)
+		timing.mkdir = time.Since(phase)
+		if err != nil {
+			logger.Error("Failed to create user slice subdir", "path", slice, "err", err)
+			forgetSubgroupCount(slice)
+			return placement{}, err
+		}
+		defer endCreating(subDir)
+		if err := setMeta(subDir, metaPlan, resolvePlan(plan)); err != nil {
+			logger.Error("Failed to record plan", "path", subDir, "err", err)
+		}
+		if err := setMeta(subDir, metaPriority, priority); err != nil {
+			logger.Error("Failed to record priority", "path", subDir, "err", err)
+		}
+	}
+
+	phase = time.Now()
+	err = applyCgroupConfig(logger, subDir, config, pids)
+	timing.writes = time.Since(phase)
 	if err != nil {
-		slog.Error("Failed to read directory", "dir", dir, "err", err)
+		if writesPending(subDir) {
+			// A timed out write may still move the process in, so the
+			// subgroup is settled once it returns.
+			beginCreating(subDir)
+			go settlePendingSubgroup(logger, slice, subDir)
+			return placement{}, fmt.Errorf("%w: %w", errWritePending, err)
+		}
+		// Moving the process in commits the subgroup. If no process made it,
+		// the subgroup is removed now rather than by a later sweep.
+		if !layout.populated(subDir) && !skipInDryRun("remove", subDir) {
+			if err := layout.remove(subDir); err != nil {
+				logger.Error("Failed to remove unused subgroup", "path", subDir, "err", err)
+			} else {
+				forgetMeta(subDir)
+			}
+		}
+		forgetSubgroupCount(slice)
+		return placement{}, err
+	}
+	if activeWatcher != nil && !dryRun {
+		if err := addWatch(activeWatcher, subDir); err != nil {
+			logger.Error("Failed to watch subgroup", "path", subDir, "err", err)
+		}
+	}
+	for _, pid := range pids {
+		if config.Nice != nil {
+			applyNice(subDir, pid, *config.Nice)
+		}
+		if config.OomScoreAdj != nil {
+			applyOomScoreAdj(subDir, pid, *config.OomScoreAdj)
+		}
+	}
+	metrics.Add("cgroups_created", 1, "plan", resolvePlan(plan))
+	attrs := []any{"userSlice", slice, "subDir", subDir, "pids.max", config.pidsMax()}
+	if value := config.oomGroup(); value != "" {
+		attrs = append(attrs, "memory.oom.group", value)
+	}
+	logger.Info("Cgroup setup complete", attrs...)
+	return placement{subDir: subDir, plan: resolvePlan(plan), config: config, pids: len(pids), timing: timing}, nil
+}
+
+// setupSlice creates the user slice and writes the limits of the plan's users.
+// That happens once per slice, and again only when the plans need other
+// controllers, the plan has another slice limit or the slice was removed in
+// the meantime. Failing limit writes are logged but don't fail the request;
+// the next one tries again.
+func setupSlice(slice string, config PlanConfig) error {
+	value, _ := sliceLocks.LoadOrStore(filepath.Clean(slice), &sliceLock{})
+	lock := value.(*sliceLock)
+	lock.mu.Lock()
+	defer lock.mu.Unlock()
+
+	config = sliceLimits(slice, config)
+	state := strings.Join([]string{subtreeControl(usableControllers()), config.sliceCpuMax(), config.sliceMemoryMax(), config.IoWeight}, "\n")
+	if lock.configured == state {
+		if _, err := os.Stat(slice); err == nil {
+			return nil
+		}
+	}
+	if err := CreateCgroupDir(slice, 0755); err != nil {
+		return err
+	}
+	if err := layout.setupSlice(slice, config); err != nil {
+		lock.configured = ""
+		return nil
+	}
+	lock.configured = state
+	return nil
+}
+
+// forgetSlice drops the setup state of the removed user slice, so it doesn't
+// pile up for every user ever served. Slices are only removed while no
+// assignment uses them, so none holds its lock.
+func forgetSlice(slice string) {
+	slice = filepath.Clean(slice)
+	sliceLocks.Delete(slice)
+	sliceSetupsMu.Lock()
+	delete(sliceSetups, slice+"/")
+	sliceSetupsMu.Unlock()
+}
+
+// errWritePending fails a createCgroup whose writes timed out but may still
+// land, so the process may yet end up in the subgroup.
+var errWritePending = errors.New("cgroup write pending")
+
+// settlePendingSubgroup waits for the timed out writes to subDir of a failed
+// createCgroup, which marked it as being created, and then watches it if a
+// late write moved a process in, or removes it otherwise.
+func settlePendingSubgroup(logger *slog.Logger, slice, subDir string) {
+	awaitPendingWrites(subDir)
+	defer forgetSubgroupCount(slice)
+	creatingMu.Lock()
+	defer creatingMu.Unlock()
+	endCreatingLocked(subDir)
+	if layout.populated(subDir) {
+		logger.Warn("Process moved in after its request failed", "path", subDir)
+		if activeWatcher != nil && !dryRun {
+			if err := addWatch(activeWatcher, subDir); err != nil {
+				logger.Error("Failed to watch subgroup", "path", subDir, "err", err)
+			}
+		}
+		return
+	}
+	if isCreating(subDir) || skipInDryRun("remove", subDir) {
 		return
 	}
+	if err := layout.remove(subDir); err != nil {
+		logger.Error("Failed to remove unused subgroup", "path", subDir, "err", err)
+		return
+	}
+	forgetMeta(subDir)
+}
 
+// sliceLimits returns the slice limits for a request with config: the largest
+// of the ones of config and of the plans of the slice's populated subgroups.
+// A user alternating plans then keeps the limits of the largest plan in use
+// rather than having them rewritten with every request.
+func sliceLimits(slice string, config PlanConfig) PlanConfig {
+	limits := PlanConfig{SliceCpuMax: config.sliceCpuMax(), SliceMemoryMax: config.sliceMemoryMax(), IoWeight: config.IoWeight}
+	entries, err := os.ReadDir(slice)
+	if err != nil {
+		return limits
+	}
 	for _, entry := range entries {
-		if entry.IsDir() {
-			cleanupSubgroup(filepath.Join(dir, entry.Name()), watcher)
+		subDir := slice + entry.Name()
+		if !entry.IsDir() || !layout.populated(subDir) {
+			continue
 		}
+		plan := metaValue(subDir, metaPlan)
+		if plan == "" {
+			continue
+		}
+		used, _ := getPlanConfig(plan)
+		limits.SliceCpuMax = largerCpuMax(limits.SliceCpuMax, used.sliceCpuMax())
+		limits.SliceMemoryMax = largerMemoryMax(limits.SliceMemoryMax, used.sliceMemoryMax())
+		limits.IoWeight = largerWeight(limits.IoWeight, used.IoWeight)
 	}
+	return limits
 }
 
-func cleanupSubgroup(path string, watcher *inotify.Watcher) {
-	if !processExists(filepath.Join(path, "cgroup.events")) {
-		if err := watcher.Remove(path); err != nil {
-			slog.Error("watcher remove", "path", path, "err", err)
+// setupSliceCoalesced runs setupSlice at most once per -coalesceWindow for a
+// slice. Requests arriving while the setup is in progress, or shortly after it,
+// wait for and share its result instead of repeating the slice writes.
+func setupSliceCoalesced(slice string, config PlanConfig) error {
+	if *coalesceWindow <= 0 {
+		return setupSlice(slice, config)
+	}
+
+	sliceSetupsMu.Lock()
+	setup, ok := sliceSetups[slice]
+	if ok && time.Since(setup.started) <= *coalesceWindow {
+		sliceSetupsMu.Unlock()
+		<-setup.done
+		return setup.err
+	}
+	setup = &sliceSetup{started: time.Now(), done: make(chan struct{})}
+	sliceSetups[slice] = setup
+	for other, s := range sliceSetups {
+		if time.Since(s.started) > *coalesceWindow {
+			delete(sliceSetups, other)
 		}
-		if err := os.Remove(path); err != nil {
-			slog.Error("can't remove watcher path", "path", path, "err", err)
+	}
+	sliceSetupsMu.Unlock()
+
+	setup.err = setupSlice(slice, config)
+	close(setup.done)
+	return setup.err
+}
+
+// applyCgroupConfig writes the plan's limits to subDir and moves the processes
+// into it, in the order given. Every limit write is attempted; the returned
+// error joins the failed ones. The first pid that can't be moved fails the
+// request, the ones moved before it stay in the subgroup.
+func applyCgroupConfig(logger *slog.Logger, subDir string, config PlanConfig, pids []string) error {
+	dir, err := openCgroupDir(subDir)
+	if err != nil {
+		logger.Error("Failed to open subgroup", "path", subDir, "err", err)
+		return err
+	}
+	defer dir.Close()
+	dir.log = logger
+
+	move := func() error {
+		for i, pid := range pids {
+			if err := layout.moveProcess(dir, subDir, pid); err != nil {
+				if len(pids) == 1 {
+					if errors.Is(err, unix.ESRCH) {
+						return fmt.Errorf("no such process %s, it exited before the move: %w", pid, err)
+					}
+					return err
+				}
+				return fmt.Errorf("moved %d of %d pids, pid %s: %w", i, len(pids), pid, err)
+			}
 		}
+		return nil
+	}
+
+	var errs []error
+	if config.ProcsFirst {
+		errs = append(errs, move())
 	}
+	errs = append(errs, layout.applyLimits(dir, subDir, config))
+	if !config.ProcsFirst {
+		errs = append(errs, move())
+	}
+	return errors.Join(errs...)
 }
 
+// cleanupAllSubgroups removes the unused subgroups of every user slice, or of
+// userSlice only, and reports how many directories it looked at and how many
+// of them were removed. A user slice is removed once all of its subgroups are,
+// never while one of them is left. Only one sweep runs at a time.
+func cleanupAllSubgroups(watcher *inotify.Watcher, userSlice string) (scanned, removed int) {
+	sweepMu.Lock()
+	defer sweepMu.Unlock()
+	defer func(start time.Time) {
+		metrics.Observe("sweep_duration", time.Since(start))
+	}(time.Now())
+
+	userSlices := []string{userSlice}
+	if userSlice == "" {
+		entries, err := readSweepDir(usersPath)
+		if err != nil {
+			return
+		}
+		userSlices = userSlices[:0]
+		for _, entry := range entries {
+			if entry.IsDir() {
+				userSlices = append(userSlices, entry.Name())
+			}
+		}
+	}
+
+	for _, name := range userSlices {
+		slice := filepath.Join(usersPath, name)
+		entries, err := readSweepDir(slice)
+		if err != nil {
+			continue
+		}
+		left := 0
+		for _, entry := range entries {
+			if !entry.IsDir() {
+				continue
+			}
+			scanned++
+			if cleanupSubgroup(filepath.Join(slice, entry.Name()), watcher) {
+				removed++
+			} else {
+				left++
+			}
+			if scanned%sweepBatchSize == 0 {
+				yieldSweep()
+			}
+		}
+		if left > 0 {
+			continue
+		}
+		scanned++
+		if cleanupSubgroup(slice, watcher) {
+			removed++
+		}
+	}
+	return
+}
+
+// readSweepDir reads a directory of the sweep. An error means the directory is
+// skipped and the sweep goes on with the next one; it is logged unless the
+// directory is gone, e.g. a slice removed since it was listed, which leaves
+// nothing to clean.
+func readSweepDir(dir string) ([]os.DirEntry, error) {
+	entries, err := os.ReadDir(dir)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		slog.Debug("Directory gone before the sweep reached it", "dir", dir)
+	case err != nil:
+		slog.Error("Failed to read directory", "dir", dir, "err", err)
+		metrics.Add("sweep_errors", 1)
+	}
+	return entries, err
+}
+
+// yieldSweep lets request handling run between batches of a large sweep, so
+// the sweep never holds the CPU for long and doesn't add to request latency.
+func yieldSweep() {
+	if *sweepPause > 0 {
+		time.Sleep(*sweepPause)
+		return
+	}
+	runtime.Gosched()
+}
+
+func cleanupSubgroup(path string, watcher *inotify.Watcher) bool {
+	creatingMu.Lock()
+	defer creatingMu.Unlock()
+	if isCreating(path) || layout.populated(path) {
+		return false
+	}
+	if skipInDryRun("remove", path) {
+		return true
+	}
+	// -delete sweeps before there is a watcher.
+	if watcher != nil {
+		if err := removeWatch(watcher, path); err != nil {
+			slog.Error("watcher remove", "path", path, "err", err)
+		}
+	}
+	if err := layout.remove(path); err != nil {
+		slog.Error("can't remove watcher path", "path", path, "err", err)
+		return false
+	}
+	forgetMeta(path)
+	forgetSubgroupCount(filepath.Dir(path))
+	if filepath.Dir(filepath.Clean(path)) == filepath.Clean(usersPath) {
+		forgetSlice(path)
+	}
+	metrics.Add("cgroups_removed", 1)
+	return true
+}
+
+// processExists reports whether the cgroup control file says processes are
+// in the cgroup: cgroup.procs lists at least one pid, cgroup.events has a
+// "populated 1" line. Any other file, or one that can't be read, counts as
+// empty.
 func processExists(file string) bool {
-	content, err := os.ReadFile(file)
-	if err != nil || len(content) < 21 {
+	content, err := cgroupFiles.ReadFile(file)
+	if err != nil {
 		return false
 	}
-	for i := 10; i < len(content); i++ {
-		if content[i] == 0x0a {
-			// Do we have only one character and it's zero
-			if i == 11 && content[i-1] == 0x30 {
-				//fmt.Println("usun folder", filename)
-				return false
+	isProcs := filepath.Base(file) == "cgroup.procs"
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if isProcs {
+			if line != "" {
+				return true
 			}
-			break
+			continue
+		}
+		if value, ok := strings.CutPrefix(line, "populated "); ok {
+			return value != "0"
 		}
 	}
-	return true
+	return false
 }
 
+// CreateCgroupDir creates the cgroup directory path unless it already exists.
+// When the kernel is out of cgroup resources the error wraps
+// errCgroupExhausted. Only when the mkdir finds the path taken is it checked,
+// with an lstat, to be a directory; anything else fails with ENOTDIR.
 func CreateCgroupDir(path string, mode os.FileMode) error {
-	if _, err := os.Stat(path); os.IsNotExist(err) {
-		return os.Mkdir(path, mode)
+	err := createNewCgroupDir(path, mode)
+	if !errors.Is(err, unix.EEXIST) {
+		return err
+	}
+	if info, err := os.Lstat(path); err != nil {
+		return err
+	} else if !info.IsDir() {
+		return &os.PathError{Op: "mkdir", Path: path, Err: unix.ENOTDIR}
 	}
 	return nil
 }
 
+// createNewCgroupDir is CreateCgroupDir for a cgroup that must not exist yet:
+// an existing path is an error wrapping EEXIST.
+func createNewCgroupDir(path string, mode os.FileMode) error {
+	if skipInDryRun("create", path) {
+		return nil
+	}
+	err := layout.mkdir(path, mode)
+	switch {
+	case err == nil:
+		if *chownCgroups && os.Getuid() == 0 {
+			chownCgroup(path)
+		}
+		return nil
+	case errors.Is(err, unix.ENOSPC), errors.Is(err, unix.ENOMEM):
+		metrics.Add("cgroup_exhausted", 1)
+		return fmt.Errorf("%w: %w", errCgroupExhausted, err)
+	}
+	return err
+}
+
+// delegatedFiles are the files of a cgroup its delegatee needs to write, see
+// "Delegation" in the cgroup v2 documentation.
+var delegatedFiles = []string{"", "cgroup.procs", "cgroup.threads", "cgroup.subtree_control"}
+
+// chownCgroup gives the cgroup at path and its delegated files to -uid/-gid.
+// Failures are logged, the cgroup stays usable by root.
+func chownCgroup(path string) {
+	for _, name := range delegatedFiles {
+		file := filepath.Join(path, name)
+		if err := os.Chown(file, *uid, *gid); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			slog.Error("Failed to chown cgroup", "path", file, "uid", *uid, "gid", *gid, "err", err)
+		}
+	}
+}
+
+// writeToFile writes data to a cgroup control file, retrying transient
+// failures.
 func writeToFile(path, data string) error {
-	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0644)
+	if skipInDryRun("write", path, "value", data) {
+		return nil
+	}
+	err := retryWrite(path, func() error { return cgroupFiles.WriteFile(path, data) })
 	if err != nil {
-		return err
+		metrics.Add("write_errors", 1, "file", filepath.Base(path))
 	}
-	defer file.Close()
-	_, err = file.WriteString(data)
 	return err
 }
@@ -0,0 +1,658 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestMain(m *testing.M) {
+	// The flags initializeFlags registers, at their defaults.
+	deleteAtRun, removeSlices, cleanupOnExit = new(bool), new(bool), new(bool)
+	reconcileAtStart, selftestAtStart, disableInotify = new(bool), new(bool), new(bool)
+	chownCgroups, allowKernelThreads, enableLoadtest = new(bool), new(bool), new(bool)
+	uid, gid = new(int), new(int)
+	*uid, *gid = defaultUid, defaultGid
+	coalesceWindow, sweepPause = new(time.Duration), new(time.Duration)
+	standbyOf, standbyInterval = new(string), new(time.Duration)
+	systemReserve = new(float64)
+	readTimeout, replyTimeout = time.Second, time.Second
+	cleanupIntervalNs.Store(int64(defaultCleanupInterval))
+	memoryMax = strconv.FormatUint((1024*maxMemoryGb)*1024*1024, 10)
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	os.Exit(m.Run())
+}
+
+// request sends line to handleConnection and returns the reply.
+func request(t testing.TB, line string) string {
+	t.Helper()
+	server, client := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		handleConnection(context.Background(), server)
+		close(done)
+	}()
+	defer func() {
+		client.Close()
+		<-done
+	}()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := fmt.Fprintf(client, "%s\n", line); err != nil {
+		t.Fatal(err)
+	}
+	reply, err := io.ReadAll(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimSpace(string(reply))
+}
+
+// usePlans makes plans, besides the built-in ones, the plans in effect and
+// enables their controllers, as a config file would.
+func usePlans(t testing.TB, plans map[string]PlanConfig) {
+	t.Helper()
+	swapPlans(plans)
+	enableControllers()
+}
+
+// selfPid is a live pid for assignments, the test process itself: the fake
+// tree only records the cgroup.procs writes.
+var selfPid = strconv.Itoa(os.Getpid())
+
+// placedPath returns the path of the subgroup an OK reply names, failing the
+// test for any other reply.
+func placedPath(t testing.TB, reply string) string {
+	t.Helper()
+	rel, ok := strings.CutPrefix(reply, "OK ")
+	if !ok {
+		t.Fatalf("assignment failed: %s", reply)
+	}
+	return filepath.Join(usersPath, rel)
+}
+
+// assign assigns selfPid to user with plan and returns the path of the
+// subgroup it was placed in, failing the test unless the reply is OK.
+func assign(t testing.TB, user, plan string) string {
+	t.Helper()
+	return placedPath(t, request(t, selfPid+"|"+user+"|"+plan))
+}
+
+func TestAssignmentWritesPlan(t *testing.T) {
+	for _, plan := range []string{planStandard, planBusiness} {
+		t.Run(plan, func(t *testing.T) {
+			tree := newTestTree(t)
+			config := builtinPlans[plan]
+			subDir := assign(t, "alice", plan)
+
+			want := map[string]string{
+				"cpu.max":      config.CpuMax,
+				"cpu.weight":   config.CpuWeight,
+				"cgroup.procs": selfPid,
+			}
+			for name, value := range want {
+				if got := tree.read(t, filepath.Join(subDir, name)); got != value {
+					t.Errorf("%s = %q, want %q", name, got, value)
+				}
+			}
+			slice := filepath.Dir(subDir)
+			if got := tree.read(t, filepath.Join(slice, "memory.max")); got != config.sliceMemoryMax() {
+				t.Errorf("slice memory.max = %q, want %q", got, config.sliceMemoryMax())
+			}
+			if got := tree.read(t, filepath.Join(slice, "cgroup.subtree_control")); got != strings.Join(usableControllers(), " ") {
+				t.Errorf("slice cgroup.subtree_control = %q, want %v", got, usableControllers())
+			}
+		})
+	}
+}
+
+func TestAssignmentWritesConfiguredPlan(t *testing.T) {
+	tree := newTestTree(t)
+	usePlans(t, map[string]PlanConfig{
+		"tight": {CpuMax: "20000 100000", CpuWeight: "20", MemoryMax: "1073741824", MemoryHigh: "805306368", IoWeight: "50", PidsMax: "64"},
+	})
+	subDir := assign(t, "bob", "tight")
+	for name, value := range map[string]string{
+		"cpu.max":     "20000 100000",
+		"cpu.weight":  "20",
+		"memory.max":  "1073741824",
+		"memory.high": "805306368",
+		"io.weight":   "50",
+		"pids.max":    "64",
+	} {
+		if got := tree.read(t, filepath.Join(subDir, name)); got != value {
+			t.Errorf("%s = %q, want %q", name, got, value)
+		}
+	}
+	if got := tree.read(t, filepath.Join(usersPath, "cgroup.subtree_control")); got != "cpu io memory pids" {
+		t.Errorf("cgroup.subtree_control of %s = %q, want all four controllers", usersPath, got)
+	}
+}
+
+func TestUnlimitedCpuPlanWritesMax(t *testing.T) {
+	tree := newTestTree(t)
+	usePlans(t, map[string]PlanConfig{"compute": {CpuMax: "max", MemoryMax: "1073741824", IoWeight: "50"}})
+	subDir := assign(t, "alice", "compute")
+	if got := tree.written(filepath.Join(subDir, "cpu.max")); !slices.Equal(got, []string{"max"}) {
+		t.Errorf("cpu.max writes %q, want \"max\" written", got)
+	}
+	if got := tree.read(t, filepath.Join(subDir, "memory.max")); got != "1073741824" {
+		t.Errorf("memory.max = %q, want the plan's limit kept", got)
+	}
+
+	// A limit left on the subgroup is cleared when it is reused.
+	tree.exit(t, subDir)
+	if err := tree.WriteFile(filepath.Join(subDir, "cpu.max"), "20000 100000"); err != nil {
+		t.Fatal(err)
+	}
+	if again := assign(t, "alice", "compute"); again != subDir {
+		t.Fatalf("assignment placed in %s, want %s reused", again, subDir)
+	}
+	if got := tree.read(t, filepath.Join(subDir, "cpu.max")); got != "max" {
+		t.Errorf("reused subgroup cpu.max = %q, want \"max\"", got)
+	}
+}
+
+func TestAssignmentWriteOrder(t *testing.T) {
+	tree := newTestTree(t)
+	limits := PlanConfig{CpuMax: "20000 100000", MemoryMax: "1073741824", PidsMax: "64"}
+	procsFirst := limits
+	procsFirst.ProcsFirst = true
+	usePlans(t, map[string]PlanConfig{"limitsfirst": limits, "procsfirst": procsFirst})
+
+	for plan, first := range map[string]bool{"limitsfirst": false, "procsfirst": true} {
+		order := tree.writeOrder(assign(t, "alice", plan))
+		want := len(order) - 1
+		if first {
+			want = 0
+		}
+		if len(order) < 2 || slices.Index(order, "cgroup.procs") != want {
+			t.Errorf("%s: subgroup writes %v, want cgroup.procs at %d", plan, order, want)
+		}
+		if !slices.Contains(order, "cpu.max") || !slices.Contains(order, "pids.max") {
+			t.Errorf("%s: subgroup writes %v, want the plan's limits among them", plan, order)
+		}
+	}
+}
+
+func TestAssignmentSkipsUnavailableControllers(t *testing.T) {
+	tree := newTestTree(t, "cpu", "memory")
+	usePlans(t, map[string]PlanConfig{
+		"tight": {CpuMax: "20000 100000", MemoryMax: "1073741824", IoWeight: "50", PidsMax: "64"},
+	})
+	if got := tree.read(t, filepath.Join(usersPath, "cgroup.subtree_control")); got != "cpu memory" {
+		t.Errorf("cgroup.subtree_control of %s = %q, want only the available controllers", usersPath, got)
+	}
+	var skipped []string
+	tree.intercept = func(path, _ string) error {
+		if name := filepath.Base(path); strings.HasPrefix(name, "io.") || strings.HasPrefix(name, "pids.") {
+			skipped = append(skipped, path)
+		}
+		return nil
+	}
+	subDir := assign(t, "bob", "tight")
+	if len(skipped) > 0 {
+		t.Errorf("%v written without their controllers", skipped)
+	}
+	if got := tree.read(t, filepath.Join(subDir, "cpu.max")); got != "20000 100000" {
+		t.Errorf("cpu.max = %q, want the plan's", got)
+	}
+	if got := tree.read(t, filepath.Join(subDir, "memory.max")); got != "1073741824" {
+		t.Errorf("memory.max = %q, want the plan's", got)
+	}
+}
+
+func TestAssignmentRejectsBadRequests(t *testing.T) {
+	tree := newTestTree(t)
+	for _, line := range []string{
+		selfPid + "|../etc|standard",
+		selfPid + "|alice|nosuchplan",
+		"x|alice|standard",
+	} {
+		if reply := request(t, line); !strings.HasPrefix(reply, "ERR ") {
+			t.Errorf("%q: got %q, want an ERR", line, reply)
+		}
+	}
+	if tree.exists(usersPath + "alice.slice") {
+		t.Error("a rejected request created the user slice")
+	}
+}
+
+func TestAssignmentOfExitedProcess(t *testing.T) {
+	tree := newTestTree(t)
+	tree.failWrites("cgroup.procs", unix.ESRCH)
+	reply := request(t, selfPid+"|alice|standard")
+	if !strings.HasPrefix(reply, "ERR no-such-pid ") {
+		t.Errorf("got %q, want ERR no-such-pid", reply)
+	}
+	entries, err := os.ReadDir(usersPath + "alice.slice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			t.Errorf("subgroup %s left behind for the exited process", entry.Name())
+		}
+	}
+}
+
+func TestAssignmentWithCgroupsExhausted(t *testing.T) {
+	for _, errno := range []unix.Errno{unix.ENOSPC, unix.ENOMEM} {
+		t.Run(errno.Error(), func(t *testing.T) {
+			tree := newTestTree(t)
+			slice := usersPath + "alice.slice"
+			tree.failMkdirs(slice, errno)
+			if err := CreateCgroupDir(slice+"/job", 0755); !errors.Is(err, errCgroupExhausted) || !errors.Is(err, errno) {
+				t.Errorf("CreateCgroupDir: %v, want errCgroupExhausted wrapping %v", err, errno)
+			}
+			if reply := request(t, selfPid+"|alice|standard"); !strings.HasPrefix(reply, "ERR unavailable cgroup resource exhausted") {
+				t.Errorf("assignment: %s, want ERR unavailable cgroup resource exhausted", reply)
+			}
+			tree.failMkdirs(slice, nil)
+			assign(t, "alice", planStandard)
+		})
+	}
+}
+
+func TestSweepForgetsSliceState(t *testing.T) {
+	tree := newTestTree(t)
+	subDir := assign(t, "alice", planStandard)
+	slice := filepath.Dir(subDir)
+	if _, ok := sliceLocks.Load(slice); !ok {
+		t.Fatalf("no slice lock for %s after its setup", slice)
+	}
+	tree.exit(t, subDir)
+	cleanupAllSubgroups(nil, "")
+	if tree.exists(slice) {
+		t.Fatalf("the emptied slice %s wasn't swept", slice)
+	}
+	if _, ok := sliceLocks.Load(slice); ok {
+		t.Error("the slice lock outlived the slice")
+	}
+	sliceSetupsMu.Lock()
+	_, ok := sliceSetups[slice+"/"]
+	sliceSetupsMu.Unlock()
+	if ok {
+		t.Error("the coalesced setup outlived the slice")
+	}
+}
+
+func TestCoalescedSliceSetup(t *testing.T) {
+	for _, window := range []time.Duration{0, time.Minute} {
+		t.Run(window.String(), func(t *testing.T) {
+			tree := newTestTree(t)
+			saved := *coalesceWindow
+			*coalesceWindow = window
+			t.Cleanup(func() { *coalesceWindow = saved })
+
+			// A slice setup that fails is tried again by the next request,
+			// unless the request was coalesced into it.
+			cpuMax := filepath.Join(usersPath, "alice.slice", "cpu.max")
+			attempts := 0
+			tree.intercept = func(path, _ string) error {
+				if path != cpuMax {
+					return nil
+				}
+				attempts++
+				return unix.EBUSY
+			}
+			const n = 10
+			var wg sync.WaitGroup
+			for range n {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					if reply := request(t, selfPid+"|alice|standard"); !strings.HasPrefix(reply, "OK ") {
+						t.Errorf("assignment: %s", reply)
+					}
+				}()
+			}
+			wg.Wait()
+
+			want := n
+			if window > 0 {
+				want = 1
+			}
+			tree.mu.Lock()
+			defer tree.mu.Unlock()
+			if attempts != want {
+				t.Errorf("slice cpu.max written %d times for %d requests, want %d", attempts, n, want)
+			}
+		})
+	}
+}
+
+func TestSweepSparesSubgroupBeingCreated(t *testing.T) {
+	tree := newTestTree(t)
+	release := tree.holdWrites("cgroup.procs")
+	defer release()
+	replied := make(chan string, 1)
+	go func() { replied <- request(t, selfPid+"|alice|standard") }()
+
+	// The subgroup exists, still empty, while its process isn't moved in.
+	slice := usersPath + "alice.slice/"
+	if !waitFor(5*time.Second, func() bool { return sliceSubgroups(slice) == 1 }) {
+		t.Fatal("the subgroup was never created")
+	}
+	if _, removed := cleanupAllSubgroups(nil, ""); removed != 0 {
+		t.Errorf("the sweep removed %d directories during the creation", removed)
+	}
+	release()
+	subDir := placedPath(t, <-replied)
+	if got := tree.read(t, subDir+"/cgroup.procs"); got != selfPid {
+		t.Errorf("cgroup.procs = %q after the sweep, want %s", got, selfPid)
+	}
+}
+
+func TestCleanupWithoutWatcher(t *testing.T) {
+	tree := newTestTree(t)
+	busy := assign(t, "alice", planStandard)
+	idle := assign(t, "bob", planStandard)
+	tree.exit(t, idle)
+
+	// -delete sweeps before the watcher is set up.
+	if cleanupSubgroup(busy, nil) {
+		t.Error("cleanupSubgroup removed a populated subgroup")
+	}
+	if !cleanupSubgroup(idle, nil) {
+		t.Fatal("cleanupSubgroup kept an empty subgroup")
+	}
+	if tree.exists(idle) {
+		t.Errorf("%s still there after its cleanup", idle)
+	}
+	if _, removed := cleanupAllSubgroups(nil, ""); removed != 1 {
+		t.Errorf("sweep removed %d directories, want bob's emptied slice", removed)
+	}
+	if !tree.exists(busy) || tree.exists(filepath.Dir(idle)) {
+		t.Error("the sweep without a watcher didn't keep alice's subgroup and remove bob's slice")
+	}
+}
+
+func TestSweepKeepsSliceWithBusySubgroup(t *testing.T) {
+	tree := newTestTree(t)
+	busy := assign(t, "alice", planStandard)
+	idle := assign(t, "alice", planStandard)
+	gone := []string{idle, assign(t, "bob", planStandard), assign(t, "bob", planStandard)}
+	for _, subDir := range gone {
+		tree.exit(t, subDir)
+	}
+
+	cleanupAllSubgroups(nil, "")
+	if !tree.exists(busy) {
+		t.Errorf("the populated %s was removed", busy)
+	}
+	for _, subDir := range gone {
+		if tree.exists(subDir) {
+			t.Errorf("the empty %s was kept", subDir)
+		}
+	}
+	if tree.exists(usersPath + "bob.slice") {
+		t.Error("bob's slice was kept with all of its subgroups removed")
+	}
+	if n := sliceSubgroups(usersPath + "alice.slice/"); n != 1 {
+		t.Errorf("alice's slice has %d subgroups after the sweep, want the populated one", n)
+	}
+}
+
+// countingMetrics counts what is added to each counter, by name.
+type countingMetrics struct {
+	mu     sync.Mutex
+	counts map[string]float64
+}
+
+func (m *countingMetrics) Add(name string, delta float64, _ ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.counts[name] += delta
+}
+
+func (*countingMetrics) Set(string, float64, ...string) {}
+
+func (*countingMetrics) Observe(string, time.Duration, ...string) {}
+
+func (m *countingMetrics) count(name string) float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.counts[name]
+}
+
+// countMetrics adds a countingMetrics backend for the rest of the test.
+func countMetrics(t *testing.T) *countingMetrics {
+	counter := &countingMetrics{counts: make(map[string]float64)}
+	saved := metrics.backends
+	metrics.backends = append(slices.Clip(saved), counter)
+	t.Cleanup(func() { metrics.backends = saved })
+	return counter
+}
+
+// sweepChangingFS is a cgroup tree where the first read of a cgroup.events
+// calls change, letting a test alter the tree in the middle of a sweep.
+type sweepChangingFS struct {
+	cgroupFS
+	change  func()
+	changed atomic.Bool
+}
+
+func (f *sweepChangingFS) ReadFile(path string) ([]byte, error) {
+	if filepath.Base(path) == "cgroup.events" && f.changed.CompareAndSwap(false, true) {
+		f.change()
+	}
+	return f.cgroupFS.ReadFile(path)
+}
+
+func TestSweepSkipsUnreadableAndVanishedSlices(t *testing.T) {
+	tree := newTestTree(t)
+	idle := assign(t, "alice", planStandard)
+	tree.exit(t, idle)
+	vanishing := filepath.Dir(assign(t, "bob", planStandard))
+	unreadable := filepath.Dir(assign(t, "carol", planStandard))
+	counter := countMetrics(t)
+
+	// Slices are swept in name order: once the sweep reaches alice's, bob's
+	// is removed and carol's turns into a file that can't be listed.
+	changing := &sweepChangingFS{cgroupFS: cgroupFiles, change: func() {
+		if err := os.RemoveAll(vanishing); err != nil {
+			t.Error(err)
+		}
+		if err := os.RemoveAll(unreadable); err != nil {
+			t.Error(err)
+		}
+		if err := os.WriteFile(unreadable, nil, 0644); err != nil {
+			t.Error(err)
+		}
+	}}
+	cgroupFiles = changing
+
+	if _, removed := cleanupAllSubgroups(nil, ""); removed != 2 {
+		t.Errorf("sweep removed %d directories, want alice's subgroup and slice", removed)
+	}
+	if !changing.changed.Load() {
+		t.Fatal("the sweep never read a cgroup.events")
+	}
+	if tree.exists(idle) || tree.exists(filepath.Dir(idle)) {
+		t.Error("alice's emptied slice wasn't swept")
+	}
+	if n := counter.count("sweep_errors"); n != 1 {
+		t.Errorf("sweep_errors = %g, want 1 for carol's unreadable slice only", n)
+	}
+}
+
+// panickingFS is a cgroup tree whose first read of a cgroup.events panics.
+type panickingFS struct {
+	cgroupFS
+	panicked atomic.Bool
+}
+
+func (f *panickingFS) ReadFile(path string) ([]byte, error) {
+	if filepath.Base(path) == "cgroup.events" && f.panicked.CompareAndSwap(false, true) {
+		panic("injected sweep panic")
+	}
+	return f.cgroupFS.ReadFile(path)
+}
+
+func TestCleanupCycleResumesAfterPanic(t *testing.T) {
+	tree := newTestTree(t)
+	idle := assign(t, "alice", planStandard)
+	tree.exit(t, idle)
+	faulty := &panickingFS{cgroupFS: cgroupFiles}
+	cgroupFiles = faulty
+	saved := cleanupRestartDelay
+	cleanupRestartDelay = 10 * time.Millisecond
+	t.Cleanup(func() { cleanupRestartDelay = saved })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ticker := time.NewTicker(time.Hour)
+	done := make(chan struct{})
+	go func() {
+		superviseCleaningCycle(ctx, nil, ticker)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+		ticker.Stop()
+	}()
+
+	if !waitFor(5*time.Second, func() bool { return !tree.exists(idle) }) {
+		t.Fatal("the cleanup cycle never swept again after its panic")
+	}
+	if !faulty.panicked.Load() {
+		t.Error("the sweep didn't run into the injected panic")
+	}
+}
+
+func TestProcessExists(t *testing.T) {
+	newTestTree(t)
+	dir := t.TempDir()
+	for _, test := range []struct {
+		name, content string
+		want          bool
+	}{
+		{name: "cgroup.procs", content: ""},
+		{name: "cgroup.procs", content: "\n"},
+		{name: "cgroup.procs", content: "4242\n", want: true},
+		{name: "cgroup.procs", content: "4242\n4243\n31337\n", want: true},
+		{name: "cgroup.procs", content: "1", want: true},
+		{name: "cgroup.events", content: "populated 0\nfrozen 0\n"},
+		{name: "cgroup.events", content: "populated 1\nfrozen 0\n", want: true},
+		{name: "cgroup.events", content: "frozen 1\npopulated 1\n", want: true},
+		{name: "cgroup.events", content: ""},
+		{name: "cgroup.events", content: "frozen 0\n"},
+		{name: "cpu.max", content: "max 100000\n"},
+	} {
+		path := filepath.Join(dir, test.name)
+		if err := os.WriteFile(path, []byte(test.content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if got := processExists(path); got != test.want {
+			t.Errorf("processExists(%s with %q) = %v, want %v", test.name, test.content, got, test.want)
+		}
+	}
+	if processExists(filepath.Join(dir, "gone", "cgroup.events")) {
+		t.Error("processExists of a missing file reported processes")
+	}
+}
+
+func TestCreateCgroupDirOverFile(t *testing.T) {
+	newTestTree(t)
+	file := usersPath + "alice.slice"
+	if err := os.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := CreateCgroupDir(file, 0755); !errors.Is(err, unix.ENOTDIR) {
+		t.Errorf("CreateCgroupDir over a file: %v, want ENOTDIR", err)
+	}
+	dir := usersPath + "bob.slice"
+	for range 2 {
+		if err := CreateCgroupDir(dir, 0755); err != nil {
+			t.Errorf("CreateCgroupDir of a new or existing cgroup: %v", err)
+		}
+	}
+}
+
+// BenchmarkAssignment measures assignments against the fake tree. Each
+// subgroup is emptied afterwards, so the steady state of a client that
+// reconnects is measured, reusing it.
+func BenchmarkAssignment(b *testing.B) {
+	tree := newTestTree(b)
+	b.ResetTimer()
+	for range b.N {
+		subDir := placedPath(b, request(b, selfPid+"|alice|standard"))
+		b.StopTimer()
+		tree.exit(b, subDir)
+		b.StartTimer()
+	}
+	b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "assignments/s")
+}
+
+// BenchmarkAssignmentDuringSweep measures the assignment latency on its own
+// and while sweeps go through a large tree over and over, which must not
+// hold up requests.
+func BenchmarkAssignmentDuringSweep(b *testing.B) {
+	for _, sweeping := range []bool{false, true} {
+		name := "idle"
+		if sweeping {
+			name = "sweeping"
+		}
+		b.Run(name, func(b *testing.B) {
+			tree := newTestTree(b)
+			// Populated tenants the sweep has to look at and keep.
+			for i := range 25 {
+				slice := fmt.Sprintf("%stenant%d.slice", usersPath, i)
+				if err := tree.Mkdir(slice, 0755); err != nil {
+					b.Fatal(err)
+				}
+				for j := range 20 {
+					subDir := fmt.Sprintf("%s/started_%d", slice, j)
+					if err := tree.Mkdir(subDir, 0755); err != nil {
+						b.Fatal(err)
+					}
+					if err := tree.WriteFile(subDir+"/cgroup.procs", selfPid); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+			stop := make(chan struct{})
+			swept := make(chan struct{})
+			go func() {
+				defer close(swept)
+				for sweeping {
+					select {
+					case <-stop:
+						return
+					default:
+						cleanupAllSubgroups(nil, "")
+					}
+				}
+			}()
+			latencies := make([]time.Duration, 0, b.N)
+			b.ResetTimer()
+			for range b.N {
+				start := time.Now()
+				subDir := placedPath(b, request(b, selfPid+"|alice|standard"))
+				latencies = append(latencies, time.Since(start))
+				b.StopTimer()
+				tree.exit(b, subDir)
+				b.StartTimer()
+			}
+			b.StopTimer()
+			close(stop)
+			<-swept
+			slices.Sort(latencies)
+			b.ReportMetric(float64(latencies[len(latencies)*99/100].Microseconds()), "p99-µs")
+		})
+	}
+}
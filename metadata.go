@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+
+	"golang.org/x/sys/unix"
+)
+
+// Metadata about a subgroup is kept in user xattrs on the cgroup directory
+// itself, so it disappears together with the subgroup and needs no cleanup.
+// With -metaIndex it is kept in the index file instead (see metaIndex) and
+// xattrs are only read for subgroups the index doesn't know, e.g. ones created
+// before the index was enabled.
+const metaPrefix = "user.pguard."
+
+const (
+	metaPlan        = "plan"
+	metaPriority    = "priority"
+	metaNice        = "nice"
+	metaOomScoreAdj = "oom_score_adj"
+)
+
+func setMeta(dir, key, value string) error {
+	if skipInDryRun("record "+key, dir, "value", value) {
+		return nil
+	}
+	if index != nil {
+		return index.set(dir, key, value)
+	}
+	return unix.Setxattr(dir, metaPrefix+key, []byte(value), 0)
+}
+
+// getMeta returns the value stored under key, or an empty string when the
+// subgroup carries no such attribute.
+func getMeta(dir, key string) (string, error) {
+	if index != nil {
+		if value, ok := index.get(dir, key); ok {
+			return value, nil
+		}
+	}
+	buf := make([]byte, 256)
+	for {
+		n, err := unix.Getxattr(dir, metaPrefix+key, buf)
+		switch {
+		case errors.Is(err, unix.ERANGE):
+			buf = make([]byte, len(buf)*2)
+			continue
+		case errors.Is(err, unix.ENODATA):
+			return "", nil
+		case err != nil:
+			return "", err
+		}
+		return string(buf[:n]), nil
+	}
+}
+
+// metaValue returns the value stored under key, or an empty string when it
+// can't be read.
+func metaValue(dir, key string) string {
+	value, _ := getMeta(dir, key)
+	return value
+}
+
+// forgetMeta drops the metadata of a removed subgroup. xattrs go away with
+// the directory, only index entries have to be removed.
+func forgetMeta(dir string) {
+	if index == nil {
+		return
+	}
+	if err := index.remove(dir); err != nil {
+		slog.Error("Failed to remove metadata", "path", dir, "err", err)
+	}
+}
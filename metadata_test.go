@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// checkPlanRecorded checks that the subgroup at subDir is recorded with plan
+// and priority and that planstats counts it under the plan.
+func checkPlanRecorded(t *testing.T, subDir, plan, priority string) {
+	t.Helper()
+	for key, want := range map[string]string{metaPlan: plan, metaPriority: priority} {
+		if got, err := getMeta(subDir, key); err != nil || got != want {
+			t.Errorf("%s of %s = %q, %v; want %q", key, subDir, got, err, want)
+		}
+	}
+	var usage map[string]planUsage
+	if err := json.Unmarshal([]byte(request(t, "planstats")), &usage); err != nil {
+		t.Fatal(err)
+	}
+	if usage[plan].Cgroups != 1 {
+		t.Errorf("planstats counts %d cgroups of %s, want 1: %v", usage[plan].Cgroups, plan, usage)
+	}
+}
+
+func TestPlanMetaXattrRoundTrip(t *testing.T) {
+	tree := newTestTree(t)
+	if err := unix.Setxattr(tree.root, metaPrefix+"probe", []byte("1"), 0); errors.Is(err, unix.ENOTSUP) {
+		t.Skip("the temporary directory has no user xattrs")
+	}
+	reply := request(t, selfPid+"|alice|business|high")
+	subDir := placedPath(t, reply)
+	checkPlanRecorded(t, subDir, planBusiness, priorityHigh)
+}
+
+func TestPlanMetaIndexRoundTrip(t *testing.T) {
+	newTestTree(t)
+	path := filepath.Join(t.TempDir(), "meta.index")
+	opened, err := openMetaIndex(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index = opened
+	t.Cleanup(func() { index = nil })
+
+	subDir := placedPath(t, request(t, selfPid+"|alice|business|high"))
+	checkPlanRecorded(t, subDir, planBusiness, priorityHigh)
+
+	// A restart reads the records back from the file.
+	index.file.Close()
+	if index, err = openMetaIndex(path); err != nil {
+		t.Fatal(err)
+	}
+	checkPlanRecorded(t, subDir, planBusiness, priorityHigh)
+	if value, err := unix.Getxattr(subDir, metaPrefix+metaPlan, make([]byte, 64)); err == nil {
+		t.Errorf("the plan went to an xattr too (%d bytes)", value)
+	}
+}
+
+func TestMetaIndexRecoversFromTruncatedRecord(t *testing.T) {
+	dirs := t.TempDir()
+	alice, bob := filepath.Join(dirs, "alice"), filepath.Join(dirs, "bob")
+	for _, dir := range []string{alice, bob} {
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	path := filepath.Join(t.TempDir(), "meta.index")
+	x, err := openMetaIndex(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, record := range []indexRecord{
+		{Dir: alice, Key: metaPlan, Value: planBusiness},
+		{Dir: alice, Key: metaPriority, Value: priorityHigh},
+		{Dir: bob, Key: metaPlan, Value: planStandard},
+	} {
+		if err := x.set(record.Dir, record.Key, record.Value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	x.file.Close()
+
+	// A crash in the middle of bob's record, after a record that was
+	// garbled on the disk.
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data = append([]byte("{\"dir\": garbled\n"), data[:len(data)-5]...)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if x, err = openMetaIndex(path); err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]string{metaPlan: planBusiness, metaPriority: priorityHigh} {
+		if got, ok := x.get(alice, key); !ok || got != want {
+			t.Errorf("%s of alice = %q, %v after the recovery; want %q", key, got, ok, want)
+		}
+	}
+	if got, ok := x.get(bob, metaPlan); ok {
+		t.Errorf("bob's truncated record was read as %q", got)
+	}
+
+	// The index was rewritten, so a new record isn't glued to the partial
+	// one.
+	if err := x.set(bob, metaPlan, planStandard); err != nil {
+		t.Fatal(err)
+	}
+	x.file.Close()
+	if x, err = openMetaIndex(path); err != nil {
+		t.Fatal(err)
+	}
+	defer x.file.Close()
+	if got, ok := x.get(bob, metaPlan); !ok || got != planStandard {
+		t.Errorf("plan of bob = %q, %v after the reopen; want %q", got, ok, planStandard)
+	}
+	if _, ok := x.get(alice, metaPriority); !ok {
+		t.Error("alice's priority was lost by the rewrite")
+	}
+}
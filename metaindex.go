@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// metaIndex keeps the metadata of all subgroups in a single append-only file
+// outside of the cgroup tree, one JSON record per line. It is read once at
+// startup, so importing thousands of subgroups costs one read instead of
+// several xattr calls per subgroup.
+//
+// A record is written with a single write ending in a newline; after a crash
+// the last record may lack its newline, and such an incomplete record is
+// dropped when the index is opened. At startup the index is rewritten with
+// only the entries of subgroups that still exist, which keeps it from growing
+// without bound across restarts.
+type metaIndex struct {
+	mu      sync.Mutex
+	path    string
+	file    *os.File
+	entries map[string]map[string]string
+}
+
+// indexRecord is one line of the index: either a key set on a subgroup or the
+// removal of the subgroup with all its keys.
+type indexRecord struct {
+	Dir     string `json:"dir"`
+	Key     string `json:"key,omitempty"`
+	Value   string `json:"value,omitempty"`
+	Removed bool   `json:"removed,omitempty"`
+}
+
+// index is the metadata index given with -metaIndex, or nil when metadata is
+// kept in xattrs.
+var index *metaIndex
+
+func openMetaIndex(path string) (*metaIndex, error) {
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	x := &metaIndex{path: path, entries: make(map[string]map[string]string)}
+	if valid := x.replay(data); valid < len(data) {
+		slog.Warn("Ignoring incomplete last record of metadata index", "path", path, "bytes", len(data)-valid)
+	}
+	for dir := range x.entries {
+		if _, err := os.Stat(dir); errors.Is(err, fs.ErrNotExist) {
+			delete(x.entries, dir)
+		}
+	}
+	if err := x.compact(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// replay applies the complete records of data and returns the length of the
+// part it consumed. A line that is complete but can't be decoded is skipped.
+func (x *metaIndex) replay(data []byte) int {
+	offset := 0
+	for offset < len(data) {
+		end := bytes.IndexByte(data[offset:], '\n')
+		if end < 0 {
+			break
+		}
+		var record indexRecord
+		if err := json.Unmarshal(data[offset:offset+end], &record); err != nil {
+			slog.Error("Skipping corrupt metadata index record", "path", x.path, "offset", offset, "err", err)
+		} else {
+			x.apply(record)
+		}
+		offset += end + 1
+	}
+	return offset
+}
+
+func (x *metaIndex) apply(record indexRecord) {
+	if record.Removed {
+		delete(x.entries, record.Dir)
+		return
+	}
+	if x.entries[record.Dir] == nil {
+		x.entries[record.Dir] = make(map[string]string)
+	}
+	x.entries[record.Dir][record.Key] = record.Value
+}
+
+// compact writes the current entries to a new file, replaces the index with
+// it and keeps it open for appending.
+func (x *metaIndex) compact() error {
+	tmp := x.path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(file)
+	encoder := json.NewEncoder(w)
+	for dir, keys := range x.entries {
+		for key, value := range keys {
+			if err := encoder.Encode(indexRecord{Dir: dir, Key: key, Value: value}); err != nil {
+				file.Close()
+				return err
+			}
+		}
+	}
+	if err := errors.Join(w.Flush(), file.Sync(), file.Close()); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, x.path); err != nil {
+		return err
+	}
+	if x.file, err = os.OpenFile(x.path, os.O_WRONLY|os.O_APPEND, 0644); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (x *metaIndex) append(record indexRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if _, err := x.file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("%s: %w", x.path, err)
+	}
+	x.apply(record)
+	return nil
+}
+
+func (x *metaIndex) set(dir, key, value string) error {
+	return x.append(indexRecord{Dir: filepath.Clean(dir), Key: key, Value: value})
+}
+
+func (x *metaIndex) get(dir, key string) (string, bool) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	value, ok := x.entries[filepath.Clean(dir)][key]
+	return value, ok
+}
+
+func (x *metaIndex) remove(dir string) error {
+	dir = filepath.Clean(dir)
+	x.mu.Lock()
+	_, ok := x.entries[dir]
+	x.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	return x.append(indexRecord{Dir: dir, Removed: true})
+}
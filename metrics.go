@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"time"
+)
+
+// Metrics is implemented by every metrics backend. Labels are given as
+// name/value pairs, e.g. Add("cgroups_created", 1, "plan", "business").
+type Metrics interface {
+	// Add increases the counter name by delta.
+	Add(name string, delta float64, labels ...string)
+	// Set sets the gauge name to value.
+	Set(name string, value float64, labels ...string)
+	// Observe records a duration.
+	Observe(name string, d time.Duration, labels ...string)
+}
+
+// metrics is used at every instrumentation call site; backends enabled by flags
+// are added to it at startup.
+var metrics = &multiMetrics{}
+
+type multiMetrics struct {
+	backends []Metrics
+}
+
+func (m *multiMetrics) Add(name string, delta float64, labels ...string) {
+	for _, b := range m.backends {
+		b.Add(name, delta, labels...)
+	}
+}
+
+func (m *multiMetrics) Set(name string, value float64, labels ...string) {
+	for _, b := range m.backends {
+		b.Set(name, value, labels...)
+	}
+}
+
+func (m *multiMetrics) Observe(name string, d time.Duration, labels ...string) {
+	for _, b := range m.backends {
+		b.Observe(name, d, labels...)
+	}
+}
+
+// statsdMetrics sends every sample as a StatsD UDP packet. Label values are
+// appended to the metric name, e.g. pguard.cgroups_created.business.
+type statsdMetrics struct {
+	conn net.Conn
+}
+
+func newStatsdMetrics(addr string) (*statsdMetrics, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &statsdMetrics{conn: conn}, nil
+}
+
+func (s *statsdMetrics) Add(name string, delta float64, labels ...string) {
+	s.send(name, fmt.Sprintf("%g|c", delta), labels)
+}
+
+func (s *statsdMetrics) Set(name string, value float64, labels ...string) {
+	s.send(name, fmt.Sprintf("%g|g", value), labels)
+}
+
+func (s *statsdMetrics) Observe(name string, d time.Duration, labels ...string) {
+	s.send(name, fmt.Sprintf("%d|ms", d.Milliseconds()), labels)
+}
+
+func (s *statsdMetrics) send(name, value string, labels []string) {
+	var b strings.Builder
+	b.WriteString("pguard.")
+	b.WriteString(name)
+	for i := 1; i < len(labels); i += 2 {
+		b.WriteByte('.')
+		b.WriteString(labels[i])
+	}
+	b.WriteByte(':')
+	b.WriteString(value)
+	if _, err := s.conn.Write([]byte(b.String())); err != nil {
+		slog.Debug("Failed to send statsd metric", "name", name, "err", err)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// findCgroup2Mount returns the mountpoint of the first cgroup2 filesystem
+// listed in mountinfo (see proc(5) for the format).
+func findCgroup2Mount(mountinfo string) (string, error) {
+	file, err := os.Open(mountinfo)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// 36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw
+		pre, post, ok := strings.Cut(scanner.Text(), " - ")
+		if !ok {
+			continue
+		}
+		fields, fsFields := strings.Fields(pre), strings.Fields(post)
+		if len(fields) < 5 || len(fsFields) < 1 || fsFields[0] != "cgroup2" {
+			continue
+		}
+		return unescapeMountPath(fields[4]), nil
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	return "", errors.New("no cgroup2 filesystem is mounted")
+}
+
+// findCgroup1Mounts returns the mountpoints of the cgroup v1 hierarchies
+// listed in mountinfo by the controllers mounted in them. Controllers mounted
+// together, e.g. cpu,cpuacct, map to the same mountpoint.
+func findCgroup1Mounts(mountinfo string) (map[string]string, error) {
+	file, err := os.Open(mountinfo)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	mounts := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		pre, post, ok := strings.Cut(scanner.Text(), " - ")
+		if !ok {
+			continue
+		}
+		// The super options of a v1 cgroup mount list its controllers:
+		// cgroup cgroup rw,memory
+		fields, fsFields := strings.Fields(pre), strings.Fields(post)
+		if len(fields) < 5 || len(fsFields) < 3 || fsFields[0] != "cgroup" {
+			continue
+		}
+		for _, option := range strings.Split(fsFields[2], ",") {
+			if _, ok := mounts[option]; !ok {
+				mounts[option] = unescapeMountPath(fields[4])
+			}
+		}
+	}
+	return mounts, scanner.Err()
+}
+
+// unescapeMountPath decodes the octal escapes (e.g. \040 for a space) used for
+// special characters in mountinfo paths.
+func unescapeMountPath(path string) string {
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		if path[i] == '\\' && i+3 < len(path) {
+			if c, err := strconv.ParseUint(path[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(path[i])
+	}
+	return b.String()
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// maxNameAttempts bounds the names createSubgroupDir tries.
+const maxNameAttempts = 16
+
+// maxNameLength bounds the length of subgroup directory names.
+var maxNameLength = defaultMaxNameLength
+
+// createSubgroupDir creates a new subgroup of slice named after pid, e.g.
+// "4242_tj3b1k-1": the pid, then the start of this pguard and a counter in
+// base 36. Names of an earlier run can still collide, e.g. after the clock was
+// set back, so a name that exists is never reused; the next counter value is
+// tried instead. The subgroup returned is marked as being created, the caller
+// ends that with endCreating.
+func createSubgroupDir(slice, pid string) (string, error) {
+	for range maxNameAttempts {
+		name, err := subgroupName(pid, started+"-"+strconv.FormatUint(counter.Add(1), 36))
+		if err != nil {
+			return "", err
+		}
+		subDir := slice + name
+		beginCreating(subDir)
+		err = createNewCgroupDir(subDir, 0755)
+		if err == nil {
+			return subDir, nil
+		}
+		endCreating(subDir)
+		if !errors.Is(err, unix.EEXIST) {
+			return "", err
+		}
+		slog.Debug("Subgroup name taken, trying the next one", "path", subDir)
+	}
+	return "", fmt.Errorf("no free subgroup name in %s after %d attempts", slice, maxNameAttempts)
+}
+
+// subgroupName builds the name of a subgroup from a descriptive label and a
+// suffix that makes it unique. Characters other than letters, digits, '-' and
+// '_' are replaced (a '.' could clash with the names of control files) and the
+// label is shortened so the whole name fits maxNameLength; the unique suffix
+// is always kept whole.
+func subgroupName(label, unique string) (string, error) {
+	unique = sanitizeNamePart(unique)
+	if unique == "" || len(unique) >= maxNameLength {
+		return "", fmt.Errorf("can't build a subgroup name of at most %d characters for suffix %q", maxNameLength, unique)
+	}
+	label = sanitizeNamePart(label)
+	if room := maxNameLength - len(unique) - 1; len(label) > room {
+		label = label[:room]
+	}
+	if label == "" {
+		return unique, nil
+	}
+	return label + "_" + unique, nil
+}
+
+func sanitizeNamePart(part string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_':
+			return r
+		}
+		return '_'
+	}, part)
+}
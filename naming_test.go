@@ -0,0 +1,82 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// setMaxNameLength sets -maxNameLength for the test.
+func setMaxNameLength(t *testing.T, max int) {
+	saved := maxNameLength
+	maxNameLength = max
+	t.Cleanup(func() { maxNameLength = saved })
+}
+
+func TestSubgroupName(t *testing.T) {
+	setMaxNameLength(t, 24)
+	for _, test := range []struct {
+		label, unique, want string
+	}{
+		{label: "4242", unique: "tj3b1k-1", want: "4242_tj3b1k-1"},
+		{label: "", unique: "tj3b1k-1", want: "tj3b1k-1"},
+		{label: "../web frontend", unique: "tj3b1k-2", want: "___web_frontend_tj3b1k-2"},
+		{label: "cgroup.procs", unique: "x.1", want: "cgroup_procs_x_1"},
+		{label: "zażółć", unique: "a", want: "za_____a"},
+		{label: strings.Repeat("long-tag", 10), unique: "tj3b1k-3", want: "long-taglong-ta_tj3b1k-3"},
+	} {
+		got, err := subgroupName(test.label, test.unique)
+		if err != nil {
+			t.Errorf("subgroupName(%q, %q): %v", test.label, test.unique, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("subgroupName(%q, %q) = %q, want %q", test.label, test.unique, got, test.want)
+		}
+		if len(got) > maxNameLength {
+			t.Errorf("subgroupName(%q, %q) = %q, longer than %d", test.label, test.unique, got, maxNameLength)
+		}
+	}
+
+	// Truncating the labels keeps names with different suffixes apart.
+	long := strings.Repeat("x", 100)
+	first, _ := subgroupName(long, "tj3b1k-9")
+	second, _ := subgroupName(long, "tj3b1k-a")
+	if first == second {
+		t.Errorf("two suffixes both gave %q", first)
+	}
+
+	for _, unique := range []string{"", strings.Repeat("u", 24)} {
+		if name, err := subgroupName("4242", unique); err == nil {
+			t.Errorf("suffix %q gave %q, want an error", unique, name)
+		}
+	}
+}
+
+func TestCreateSubgroupDirSkipsTakenName(t *testing.T) {
+	tree := newTestTree(t)
+	slice := usersPath + "alice.slice/"
+	if err := tree.Mkdir(slice, 0755); err != nil {
+		t.Fatal(err)
+	}
+	// A subgroup of an earlier run holds the name the next counter value
+	// gives.
+	taken, err := subgroupName(selfPid, started+"-"+strconv.FormatUint(counter.Load()+1, 36))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Mkdir(slice+taken, 0755); err != nil {
+		t.Fatal(err)
+	}
+	subDir, err := createSubgroupDir(slice, selfPid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	endCreating(subDir)
+	if subDir == slice+taken {
+		t.Fatalf("createSubgroupDir returned the taken %s", subDir)
+	}
+	if !tree.exists(subDir) || !strings.HasPrefix(subDir, slice+selfPid+"_") {
+		t.Errorf("createSubgroupDir returned %s, want a new subgroup named after pid %s", subDir, selfPid)
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// pidfilePath is the -pidfile, empty if none is written.
+var pidfilePath string
+
+// writePidfile writes the pid of pguard to path for init scripts and
+// supervisors tracking it. A pidfile left by a pguard that is still running
+// is an error; one whose process is gone, or is no pguard, is stale and
+// overwritten.
+func writePidfile(path string) error {
+	if content, err := os.ReadFile(path); err == nil {
+		pid := strings.TrimSpace(string(content))
+		if validPid(pid) && pid != strconv.Itoa(os.Getpid()) && isPguard(pid) {
+			return fmt.Errorf("pguard is already running as pid %s", pid)
+		}
+		slog.Warn("Replacing stale pidfile", "path", path, "pid", pid)
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	// Written under another name and renamed, so nobody reads a half
+	// written file.
+	tmp := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err := os.WriteFile(tmp, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	pidfilePath = path
+	return nil
+}
+
+// removePidfile removes the pidfile on shutdown, unless another pguard
+// replaced it meanwhile.
+func removePidfile() {
+	if pidfilePath == "" {
+		return
+	}
+	content, err := os.ReadFile(pidfilePath)
+	if err != nil || strings.TrimSpace(string(content)) != strconv.Itoa(os.Getpid()) {
+		return
+	}
+	if err := os.Remove(pidfilePath); err != nil {
+		slog.Error("Failed to remove pidfile", "path", pidfilePath, "err", err)
+	}
+}
+
+// isPguard reports whether pid is a running process with the command name of
+// this one.
+func isPguard(pid string) bool {
+	comm, err := os.ReadFile(filepath.Join(procPath, pid, "comm"))
+	if err != nil {
+		return false
+	}
+	own, err := os.ReadFile(filepath.Join(procPath, "self", "comm"))
+	return err == nil && bytes.Equal(comm, own)
+}
@@ -0,0 +1,448 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"maps"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	planStandard = "standard"
+	planBusiness = "business"
+)
+
+// PlanConfig holds the limits written to a subgroup created for a plan.
+//
+// ProcsFirst controls the order of the subgroup writes. By default the limits
+// are written first and the process is moved into cgroup.procs last, so it
+// never runs unconstrained inside the subgroup; until the move it keeps running
+// in its original cgroup. With ProcsFirst the process is moved into the empty
+// subgroup and the limits are applied afterwards, which suits controllers that
+// only accept some settings on a populated cgroup, at the cost of a short
+// window in which the new subgroup has no limits of its own.
+//
+// CpuMax "max" (or "max period") makes the subgroup's CPU unlimited and is
+// written like any other value, clearing a limit set on the subgroup before.
+// An empty CpuMax or CpuWeight is not written at all and leaves the subgroup
+// with the kernel default or whatever it already has. The same goes for
+// MemoryMax (bytes, optionally with a K, M, G or T suffix, or "max") and
+// IoMax, whose entries ("MAJ:MIN rbps=... wbps=...") are written to io.max one
+// at a time. PidsMax is a number or "max"; an empty one writes "max".
+//
+// MemoryHigh is the soft limit written to memory.high, in the same units as
+// MemoryMax. Above it the subgroup's processes are throttled and their memory
+// is reclaimed aggressively, but they are never OOM-killed for it; only
+// memory.max is a hard limit. Set below MemoryMax it gives a process that
+// grows the chance to slow down before the kill; at or above MemoryMax it has
+// no effect. Empty leaves memory.high alone.
+//
+// SwapMax is written to memory.swap.max: "0" keeps the subgroup out of swap
+// entirely, "max" lets it swap without limit. Kernels without swap accounting
+// have no memory.swap.max, the value is skipped there.
+//
+// IoWeight, 1 to 10000, is written to io.weight of the subgroup and of the
+// user slice: the proportional share of disk time under contention, the IO
+// counterpart of CpuWeight, where IoMax is a hard cap. It only takes effect
+// with an IO scheduler that supports weights, like BFQ; without one there is
+// no io.weight and the value is skipped.
+//
+// CpuPeriod is the period of CpuMax and SliceCpuMax in microseconds, 1000 to
+// 1000000. With it those can be given as a bare quota, e.g. CpuMax "10000"
+// and CpuPeriod "20000" write cpu.max "10000 20000"; a shorter period lets the
+// scheduler throttle and refill a latency-sensitive tier more often. Without
+// it the quota is written with the period of the CpuMax string, or the
+// kernel's 100000 for a lone "max".
+//
+// CpuBurst is written to cpu.max.burst: the microseconds of runtime per period
+// a subgroup may borrow beyond its quota from what it left unused before, for
+// bursty workloads. It needs a CpuMax with a quota; with an unlimited one there
+// is nothing to burst beyond.
+//
+// CpuIdle makes the subgroup a best-effort tier by writing 1 to cpu.idle: its
+// processes are scheduled like SCHED_IDLE and get CPU only when nothing else
+// in the parent wants it. cpu.weight has no meaning for such a group, the
+// kernel refuses to set it, so a plan can't have both. Subgroups of other
+// plans get cpu.idle 0, e.g. after a reassign.
+//
+// OomGroup, when set, is written to memory.oom.group. With true the OOM killer
+// kills all processes of a subgroup together once one of them is picked, so no
+// half of an application is left running; false kills single processes, the
+// kernel default.
+//
+// Nice, when set, is the scheduling nice value (-20..19) given to the process
+// once it is in the subgroup. It orders the process against everything else on
+// the host, on top of the cpu.weight share within the cgroup tree.
+//
+// SliceMemoryMax is the memory.max of the whole user slice, shared by all
+// subgroups of the user; plans without one get -sliceMemoryMax. SliceCpuMax is
+// its cpu.max and defaults to CpuMax, so a user can't get more CPU than the
+// plan allows by running many subgroups; cpu.weight shares it out among them.
+// The slice is set up with the plan of the request that creates it, and again
+// when a later request comes with a plan of different slice limits.
+//
+// OomScoreAdj, when set, is written to /proc/<pid>/oom_score_adj (-1000..1000)
+// to make the plan's processes more (positive) or less (negative) likely to be
+// picked by the OOM killer when the whole host runs out of memory.
+type PlanConfig struct {
+	// Extends names the plan this one inherits its unset fields from. It is
+	// resolved when the config is loaded and empty in the plans in effect.
+	Extends string `json:"extends,omitempty"`
+
+	CpuMax      string   `json:"cpuMax"`
+	CpuPeriod   string   `json:"cpuPeriod,omitempty"`
+	CpuWeight   string   `json:"cpuWeight"`
+	CpuBurst    string   `json:"cpuBurst,omitempty"`
+	CpuIdle     bool     `json:"cpuIdle,omitempty"`
+	MemoryMax   string   `json:"memoryMax,omitempty"`
+	MemoryHigh  string   `json:"memoryHigh,omitempty"`
+	SwapMax     string   `json:"swapMax,omitempty"`
+	IoMax       []string `json:"ioMax,omitempty"`
+	IoWeight    string   `json:"ioWeight,omitempty"`
+	PidsMax     string   `json:"pidsMax,omitempty"`
+	ProcsFirst  bool     `json:"procsFirst,omitempty"`
+	Nice        *int     `json:"nice,omitempty"`
+	OomScoreAdj *int     `json:"oomScoreAdj,omitempty"`
+	OomGroup    *bool    `json:"oomGroup,omitempty"`
+
+	SliceMemoryMax string `json:"sliceMemoryMax,omitempty"`
+	SliceCpuMax    string `json:"sliceCpuMax,omitempty"`
+}
+
+var builtinPlans = map[string]PlanConfig{
+	planStandard: {CpuMax: cpuMaxStandard, CpuWeight: cpuWeightStd},
+	planBusiness: {CpuMax: cpuMaxBusiness, CpuWeight: cpuWeightBus},
+}
+
+// activePlans holds the plans requests are served with. A new set of plans
+// replaces the map as a whole and a stored map is never modified, so requests
+// read it without locking and never see half of an update.
+var activePlans atomic.Pointer[map[string]PlanConfig]
+
+// procsFirstPlans are the plans named in -procsFirst, kept so that every new
+// set of plans gets the flag again.
+var procsFirstPlans []string
+
+// currentPlans returns the plans in effect.
+func currentPlans() map[string]PlanConfig {
+	if p := activePlans.Load(); p != nil {
+		return *p
+	}
+	return builtinPlans
+}
+
+// swapPlans makes the built-in plans together with the given ones the plans
+// in effect; given plans replace built-in ones of the same name.
+func swapPlans(given map[string]PlanConfig) {
+	next := maps.Clone(builtinPlans)
+	for name, plan := range given {
+		next[strings.ToLower(name)] = plan
+	}
+	for _, name := range procsFirstPlans {
+		if plan, ok := next[name]; ok {
+			plan.ProcsFirst = true
+			next[name] = plan
+		}
+	}
+	activePlans.Store(&next)
+}
+
+// defaultPlanFlag is -default-plan, the plan of requests that name none. The
+// defaultPlan of a config takes its place while that config is in effect.
+var defaultPlanFlag string
+
+// defaultPlan holds the default plan in effect, "" if requests without a plan
+// are refused.
+var defaultPlan atomic.Value
+
+// setDefaultPlan makes plan, or -default-plan if it is empty, the default.
+func setDefaultPlan(plan string) {
+	if plan == "" {
+		plan = defaultPlanFlag
+	}
+	defaultPlan.Store(strings.ToLower(plan))
+}
+
+func getDefaultPlan() string {
+	plan, _ := defaultPlan.Load().(string)
+	return plan
+}
+
+// fallbackPlan is the plan served instead of one that no longer exists: the
+// default plan if there is one, the standard plan otherwise.
+func fallbackPlan() string {
+	if plan := getDefaultPlan(); plan != "" {
+		if _, ok := currentPlans()[plan]; ok {
+			return plan
+		}
+	}
+	return planStandard
+}
+
+// errUnknownPlan is returned for requests naming a plan that isn't configured.
+var errUnknownPlan = errors.New("unknown plan")
+
+// getPlanConfig returns the configuration of the plan and whether it exists.
+// For an unknown plan it reports false along with the fallback one, which
+// callers restoring a recorded plan that has since been removed go on with;
+// new requests are refused instead.
+func getPlanConfig(plan string) (PlanConfig, bool) {
+	plans := currentPlans()
+	if config, ok := plans[strings.ToLower(plan)]; ok {
+		return config, true
+	}
+	return plans[fallbackPlan()], false
+}
+
+// resolvePlan returns the name of the plan a request for plan is served with,
+// the fallback one for a plan that no longer exists.
+func resolvePlan(plan string) string {
+	if _, ok := currentPlans()[strings.ToLower(plan)]; ok {
+		return strings.ToLower(plan)
+	}
+	return fallbackPlan()
+}
+
+// sliceMemoryMax returns the memory.max of the user slice, -sliceMemoryMax if
+// the plan sets none. When that is "max" but the plan limits its subgroups and
+// -max-subgroups-per-user their number, the slice gets their sum, MemoryMax
+// times the number, so the aggregate limit is explicit. Without a number of
+// subgroups there is no sum to cap the slice at and it stays "max", as is a
+// plan's explicit "sliceMemoryMax": "max".
+func (p PlanConfig) sliceMemoryMax() string {
+	if p.SliceMemoryMax != "" {
+		return p.SliceMemoryMax
+	}
+	if memoryMax != "max" || maxSubgroupsPerUser <= 0 {
+		return memoryMax
+	}
+	size, ok := memoryBytes(p.MemoryMax)
+	if !ok || size > math.MaxUint64/uint64(maxSubgroupsPerUser) {
+		return "max"
+	}
+	return strconv.FormatUint(size*uint64(maxSubgroupsPerUser), 10)
+}
+
+// memorySuffixShifts are the shifts of the size suffixes of memory.max.
+var memorySuffixShifts = map[string]uint{"": 0, "K": 10, "M": 20, "G": 30, "T": 40}
+
+// memoryBytes returns the bytes of a memory.max value like "512M", false for
+// "max", an empty value or one that doesn't fit in 64 bits.
+func memoryBytes(value string) (uint64, bool) {
+	number := strings.TrimRight(value, "KMGTkmgt")
+	size, err := strconv.ParseUint(number, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	shift, ok := memorySuffixShifts[strings.ToUpper(value[len(number):])]
+	if !ok || size > math.MaxUint64>>shift {
+		return 0, false
+	}
+	return size << shift, true
+}
+
+// sliceCpuMax returns the cpu.max of the user slice: SliceCpuMax, else the
+// plan's CpuMax, else "max".
+func (p PlanConfig) sliceCpuMax() string {
+	switch {
+	case p.SliceCpuMax != "":
+		return p.SliceCpuMax
+	case p.CpuMax != "":
+		return p.CpuMax
+	}
+	return "max"
+}
+
+// largerCpuMax returns the cpu.max value of a and b that allows more CPU.
+func largerCpuMax(a, b string) string {
+	if cpuShare(b) > cpuShare(a) {
+		return b
+	}
+	return a
+}
+
+// cpuShare returns the CPUs a cpu.max value allows, +Inf for "max".
+func cpuShare(value string) float64 {
+	quota, period, ok := strings.Cut(value, " ")
+	if quota == "max" {
+		return math.Inf(1)
+	}
+	q, err := strconv.ParseFloat(quota, 64)
+	if err != nil {
+		return 0
+	}
+	p := float64(cpuPeriod)
+	if ok {
+		if p, err = strconv.ParseFloat(period, 64); err != nil || p == 0 {
+			return 0
+		}
+	}
+	return q / p
+}
+
+// largerMemoryMax returns the memory.max value of a and b that allows more
+// memory, "max" being the largest.
+func largerMemoryMax(a, b string) string {
+	if a == "max" || b == "max" {
+		return "max"
+	}
+	x, _ := memoryBytes(a)
+	if y, _ := memoryBytes(b); y > x {
+		return b
+	}
+	return a
+}
+
+// largerWeight returns the larger of the weights a and b, either of which may
+// be unset.
+func largerWeight(a, b string) string {
+	x, _ := strconv.Atoi(a)
+	if y, err := strconv.Atoi(b); err == nil && y > x {
+		return b
+	}
+	return a
+}
+
+// inherit returns the plan with every field whose key isn't among the keys
+// the plan was decoded from taken from base. Keys match field names like
+// encoding/json does, regardless of case.
+func (p PlanConfig) inherit(base PlanConfig, keys map[string]json.RawMessage) PlanConfig {
+	set := make(map[string]bool, len(keys))
+	for key := range keys {
+		set[strings.ToLower(key)] = true
+	}
+	plan := reflect.ValueOf(&p).Elem()
+	from := reflect.ValueOf(base)
+	for i := range plan.NumField() {
+		name, _, _ := strings.Cut(plan.Type().Field(i).Tag.Get("json"), ",")
+		if !set[strings.ToLower(name)] {
+			plan.Field(i).Set(from.Field(i))
+		}
+	}
+	p.Extends = ""
+	return p
+}
+
+// oomGroup returns the memory.oom.group value of the plan, "" if it sets none.
+func (p PlanConfig) oomGroup() string {
+	switch {
+	case p.OomGroup == nil:
+		return ""
+	case *p.OomGroup:
+		return "1"
+	}
+	return "0"
+}
+
+// pidsMax returns the pids.max written for the plan, "max" if it sets none.
+func (p PlanConfig) pidsMax() string {
+	if p.PidsMax == "" {
+		return "max"
+	}
+	return p.PidsMax
+}
+
+// controllers returns the cgroup controllers whose files the plan writes.
+func (p PlanConfig) controllers() []string {
+	var controllers []string
+	if p.CpuMax != "" || p.CpuWeight != "" || p.CpuIdle || p.SliceCpuMax != "" {
+		controllers = append(controllers, "cpu")
+	}
+	if p.MemoryMax != "" || p.MemoryHigh != "" || p.SwapMax != "" || p.OomGroup != nil {
+		controllers = append(controllers, "memory")
+	}
+	if len(p.IoMax) > 0 || p.IoWeight != "" {
+		controllers = append(controllers, "io")
+	}
+	if p.PidsMax != "" {
+		controllers = append(controllers, "pids")
+	}
+	return controllers
+}
+
+// neededControllers returns the controllers used by any of the plans, plus
+// memory for the limit of the user slices, less the ones left out of
+// -controllers. Only these are enabled in the subtrees pguard manages.
+func neededControllers() []string {
+	needed := []string{"memory"}
+	for _, plan := range currentPlans() {
+		needed = append(needed, plan.controllers()...)
+	}
+	needed = slices.DeleteFunc(needed, func(controller string) bool { return !controllerEnabled(controller) })
+	slices.Sort(needed)
+	return slices.Compact(needed)
+}
+
+// subtreeControl formats controllers for a cgroup.subtree_control write.
+func subtreeControl(controllers []string) string {
+	enable := make([]string, len(controllers))
+	for i, controller := range controllers {
+		enable[i] = "+" + controller
+	}
+	return strings.Join(enable, " ")
+}
+
+// applyNice sets the nice value of the plan on the process. It needs root or
+// CAP_SYS_NICE to raise the priority.
+func applyNice(subDir, pid string, nice int) {
+	id, err := strconv.Atoi(pid)
+	if err != nil {
+		slog.Error("Can't set nice of invalid pid", "pid", pid)
+		return
+	}
+	if skipInDryRun("set nice", subDir, "pid", pid, "nice", nice) {
+		return
+	}
+	if err := unix.Setpriority(unix.PRIO_PROCESS, id, nice); err != nil {
+		if errors.Is(err, unix.EPERM) || errors.Is(err, unix.EACCES) {
+			slog.Error("Not permitted to set nice, run as root or with CAP_SYS_NICE", "pid", pid, "nice", nice, "err", err)
+		} else {
+			slog.Error("Failed to set nice", "pid", pid, "nice", nice, "err", err)
+		}
+		return
+	}
+	if err := setMeta(subDir, metaNice, strconv.Itoa(nice)); err != nil {
+		slog.Error("Failed to record nice", "path", subDir, "err", err)
+	}
+}
+
+// applyOomScoreAdj sets the OOM score adjustment of the plan on the process.
+// Lowering it below the current value needs CAP_SYS_RESOURCE.
+func applyOomScoreAdj(subDir, pid string, adj int) {
+	path := filepath.Join(procPath, pid, "oom_score_adj")
+	if skipInDryRun("write", path, "value", adj) {
+		return
+	}
+	if err := os.WriteFile(path, []byte(strconv.Itoa(adj)), 0644); err != nil {
+		if errors.Is(err, unix.EPERM) || errors.Is(err, unix.EACCES) {
+			slog.Error("Not permitted to set oom_score_adj, run as root or with CAP_SYS_RESOURCE", "pid", pid, "oomScoreAdj", adj, "err", err)
+		} else {
+			slog.Error("Failed to set oom_score_adj", "pid", pid, "oomScoreAdj", adj, "err", err)
+		}
+		return
+	}
+	if err := setMeta(subDir, metaOomScoreAdj, strconv.Itoa(adj)); err != nil {
+		slog.Error("Failed to record oom_score_adj", "path", subDir, "err", err)
+	}
+}
+
+// weightForPriority scales the plan's base cpu.weight by the request priority,
+// keeping the result within the range accepted by the kernel.
+func weightForPriority(base, priority string) string {
+	weight, err := strconv.ParseFloat(base, 64)
+	if err != nil {
+		return base
+	}
+	weight *= priorityWeightFactor[priority]
+	return strconv.Itoa(int(min(max(weight, cpuWeightMin), cpuWeightMax)))
+}
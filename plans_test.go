@@ -0,0 +1,190 @@
+package main
+
+import (
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// setMemoryMax sets -sliceMemoryMax for the test.
+func setMemoryMax(t *testing.T, value string) {
+	saved := memoryMax
+	memoryMax = value
+	t.Cleanup(func() { memoryMax = saved })
+}
+
+func TestMemoryBytes(t *testing.T) {
+	for _, test := range []struct {
+		value string
+		bytes uint64
+		ok    bool
+	}{
+		{"1048576", 1 << 20, true},
+		{"512M", 512 << 20, true},
+		{"2g", 2 << 30, true},
+		{"16777215T", 16777215 << 40, true},
+		{"16777216T", 0, false},
+		{"18446744073709551615", 1<<64 - 1, true},
+		{"18446744073709551615K", 0, false},
+		{"max", 0, false},
+		{"", 0, false},
+		{"5P", 0, false},
+	} {
+		bytes, ok := memoryBytes(test.value)
+		if bytes != test.bytes || ok != test.ok {
+			t.Errorf("memoryBytes(%q) = %d, %v; want %d, %v", test.value, bytes, ok, test.bytes, test.ok)
+		}
+	}
+	if err := validateMemoryMax("16777216T"); err == nil {
+		t.Error("validateMemoryMax accepted a size overflowing 64 bits")
+	}
+}
+
+func TestSliceMemoryMax(t *testing.T) {
+	defer func(saved int) { maxSubgroupsPerUser = saved }(maxSubgroupsPerUser)
+	setMemoryMax(t, memoryMax)
+	for _, test := range []struct {
+		memoryMax    string
+		maxSubgroups int
+		plan         PlanConfig
+		want         string
+	}{
+		{"2147483648", 0, PlanConfig{MemoryMax: "1G"}, "2147483648"},
+		{"max", 0, PlanConfig{MemoryMax: "1G"}, "max"},
+		{"max", 0, PlanConfig{}, "max"},
+		{"max", 4, PlanConfig{MemoryMax: "1G"}, strconv.Itoa(4 << 30)},
+		{"max", 4, PlanConfig{}, "max"},
+		{"max", 4, PlanConfig{MemoryMax: "1G", SliceMemoryMax: "max"}, "max"},
+		{"max", 4, PlanConfig{MemoryMax: "1G", SliceMemoryMax: "3G"}, "3G"},
+		{"max", 1 << 30, PlanConfig{MemoryMax: "16000000T"}, "max"},
+	} {
+		memoryMax, maxSubgroupsPerUser = test.memoryMax, test.maxSubgroups
+		if got := test.plan.sliceMemoryMax(); got != test.want {
+			t.Errorf("-sliceMemoryMax %s, -max-subgroups-per-user %d, %+v: got %s, want %s", test.memoryMax, test.maxSubgroups, test.plan, got, test.want)
+		}
+	}
+}
+
+func TestSliceCapsSubgroupsTogether(t *testing.T) {
+	tree := newTestTree(t)
+	setMemoryMax(t, "max")
+	const subgroups = 3
+	maxSubgroupsPerUser = subgroups
+	usePlans(t, map[string]PlanConfig{"capped": {CpuMax: cpuMaxStandard, MemoryMax: "256M"}})
+
+	var total uint64
+	var slice string
+	for range subgroups {
+		subDir := assign(t, "alice", "capped")
+		slice = filepath.Dir(subDir)
+		size, ok := memoryBytes(tree.read(t, filepath.Join(subDir, "memory.max")))
+		if !ok {
+			t.Fatalf("no memory.max in %s", subDir)
+		}
+		total += size
+	}
+	if reply := request(t, selfPid+"|alice|capped"); !strings.HasPrefix(reply, "ERR ") {
+		t.Errorf("a subgroup over -max-subgroups-per-user was created: %s", reply)
+	}
+	capped, ok := memoryBytes(tree.read(t, filepath.Join(slice, "memory.max")))
+	if !ok {
+		t.Fatalf("the slice memory.max is %q, want a limit", tree.read(t, filepath.Join(slice, "memory.max")))
+	}
+	if want := uint64(subgroups * 256 << 20); capped != want || total > capped {
+		t.Errorf("slice memory.max %d, subgroups %d together; want the slice at %d", capped, total, want)
+	}
+}
+
+func TestSliceLimitsFollowPlansInUse(t *testing.T) {
+	tree := newTestTree(t)
+	standard := assign(t, "alice", planStandard)
+	slice := filepath.Dir(standard)
+	cpuMax := filepath.Join(slice, "cpu.max")
+	if got, want := tree.read(t, cpuMax), builtinPlans[planStandard].CpuMax; got != want {
+		t.Fatalf("slice cpu.max %q, want %q of the plan", got, want)
+	}
+
+	business := assign(t, "alice", planBusiness)
+	assign(t, "alice", planStandard)
+	want := builtinPlans[planBusiness].CpuMax
+	if got := tree.written(cpuMax); !slices.Equal(got, []string{builtinPlans[planStandard].CpuMax, want}) {
+		t.Errorf("slice cpu.max written %q, want it raised once to %q", got, want)
+	}
+
+	tree.exit(t, business)
+	tree.exit(t, standard)
+	assign(t, "alice", planStandard)
+	if got, want := tree.read(t, cpuMax), builtinPlans[planStandard].CpuMax; got != want {
+		t.Errorf("slice cpu.max %q once the business subgroup is gone, want %q", got, want)
+	}
+}
+
+func TestLargerSliceLimits(t *testing.T) {
+	for _, test := range []struct{ a, b, want string }{
+		{"50000 100000", "70000 100000", "70000 100000"},
+		{"70000 100000", "50000 100000", "70000 100000"},
+		{"50000 100000", "20000 20000", "20000 20000"},
+		{"50000 100000", "max 100000", "max 100000"},
+	} {
+		if got := largerCpuMax(test.a, test.b); got != test.want {
+			t.Errorf("largerCpuMax(%q, %q) = %q, want %q", test.a, test.b, got, test.want)
+		}
+	}
+	for _, test := range []struct{ a, b, want string }{
+		{"1G", "512M", "1G"},
+		{"512M", "1G", "1G"},
+		{"1G", "max", "max"},
+	} {
+		if got := largerMemoryMax(test.a, test.b); got != test.want {
+			t.Errorf("largerMemoryMax(%q, %q) = %q, want %q", test.a, test.b, got, test.want)
+		}
+	}
+	for _, test := range []struct{ a, b, want string }{
+		{"", "50", "50"},
+		{"200", "50", "200"},
+		{"50", "", "50"},
+	} {
+		if got := largerWeight(test.a, test.b); got != test.want {
+			t.Errorf("largerWeight(%q, %q) = %q, want %q", test.a, test.b, got, test.want)
+		}
+	}
+}
+
+func TestEmptyPlanUsesDefault(t *testing.T) {
+	tree := newTestTree(t)
+	saved := defaultPlanFlag
+	t.Cleanup(func() { defaultPlanFlag = saved })
+	cpuMax := func(user string) string {
+		return tree.read(t, filepath.Join(placedPath(t, request(t, selfPid+"|"+user+"|")), "cpu.max"))
+	}
+
+	defaultPlanFlag = ""
+	setDefaultPlan("")
+	if reply := request(t, selfPid+"|alice|"); !strings.HasPrefix(reply, "ERR ") {
+		t.Errorf("empty plan without a default: %s", reply)
+	}
+
+	defaultPlanFlag = planBusiness
+	setDefaultPlan("")
+	if got := cpuMax("bob"); got != cpuMaxBusiness {
+		t.Errorf("empty plan with -default-plan %s: cpu.max %q, want %q", planBusiness, got, cpuMaxBusiness)
+	}
+
+	config, err := parseConfig("test", []byte(`{"defaultPlan": "batch", "plans": {"batch": {"cpuMax": "10000 100000"}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.apply()
+	enableControllers()
+	if got := cpuMax("carol"); got != "10000 100000" {
+		t.Errorf("empty plan with the config's defaultPlan: cpu.max %q, want batch's", got)
+	}
+	if reply := request(t, selfPid+"|dave|nosuchplan"); !strings.HasPrefix(reply, "ERR ") {
+		t.Errorf("unknown plan with a default: %s, want it refused", reply)
+	}
+	if _, err := parseConfig("test", []byte(`{"defaultPlan": "nosuchplan"}`)); err == nil {
+		t.Error("a defaultPlan naming no plan was accepted")
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// maxPlansSize bounds the config accepted from -plansURL.
+const maxPlansSize = 1 << 20
+
+var (
+	plansURL     string
+	plansRefresh time.Duration
+	plansClient  = &http.Client{Timeout: 10 * time.Second}
+
+	// Validators of the last config applied from plansURL, sent back so an
+	// unchanged config is answered with 304 Not Modified.
+	plansETag         string
+	plansLastModified string
+)
+
+// refreshPlansCycle fetches the plans from plansURL every -plansRefresh.
+func refreshPlansCycle() {
+	for range time.Tick(plansRefresh) {
+		if refreshPlans() {
+			enableControllers()
+		}
+	}
+}
+
+// refreshPlans fetches the config at plansURL and, when it changed and is
+// valid, swaps in its plans and reports true. On any failure the plans in
+// effect are kept.
+func refreshPlans() bool {
+	config, err := fetchPlans()
+	switch {
+	case err != nil:
+		slog.Error("Failed to refresh plans, keeping the current ones", "url", plansURL, "err", err)
+		metrics.Add("plans_refresh", 1, "result", "failed")
+		return false
+	case config == nil:
+		slog.Debug("Plans not modified", "url", plansURL)
+		metrics.Add("plans_refresh", 1, "result", "unchanged")
+		return false
+	default:
+		config.apply()
+		slog.Info("Plans refreshed", "url", plansURL, "plans", len(config.Plans))
+		metrics.Add("plans_refresh", 1, "result", "updated")
+		return true
+	}
+}
+
+// fetchPlans returns the config at plansURL, or nil if the server reports it
+// unchanged since the last successful fetch.
+func fetchPlans() (*Config, error) {
+	req, err := http.NewRequest(http.MethodGet, plansURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	if plansETag != "" {
+		req.Header.Set("If-None-Match", plansETag)
+	}
+	if plansLastModified != "" {
+		req.Header.Set("If-Modified-Since", plansLastModified)
+	}
+
+	resp, err := plansClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("%s: %s", plansURL, resp.Status)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxPlansSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxPlansSize {
+		return nil, fmt.Errorf("%s: config larger than %d bytes", plansURL, maxPlansSize)
+	}
+	config, err := parseConfig(plansURL, data)
+	if err != nil {
+		return nil, err
+	}
+	plansETag = resp.Header.Get("ETag")
+	plansLastModified = resp.Header.Get("Last-Modified")
+	return config, nil
+}
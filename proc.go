@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// pfKthread is the PF_KTHREAD bit of the flags in /proc/<pid>/stat.
+const pfKthread = 0x00200000
+
+// procPath is where the process information is read from.
+var procPath = "/proc"
+
+// isKernelThread reports whether pid is a kernel thread. Those can't be moved
+// into a cgroup and the cgroup.procs write would fail with an unhelpful
+// error.
+func isKernelThread(pid string) (bool, error) {
+	content, err := os.ReadFile(filepath.Join(procPath, pid, "stat"))
+	if err != nil {
+		return false, err
+	}
+	// The command name in parentheses may contain spaces, the fields after it
+	// start with the state; flags is the 9th field of the line.
+	end := strings.LastIndexByte(string(content), ')')
+	if end < 0 {
+		return false, fmt.Errorf("malformed %s/%s/stat", procPath, pid)
+	}
+	fields := strings.Fields(string(content[end+1:]))
+	if len(fields) < 7 {
+		return false, fmt.Errorf("malformed %s/%s/stat", procPath, pid)
+	}
+	flags, err := strconv.ParseUint(fields[6], 10, 64)
+	if err != nil {
+		return false, fmt.Errorf("malformed %s/%s/stat: %w", procPath, pid, err)
+	}
+	return flags&pfKthread != 0, nil
+}
+
+// validPid reports whether pid is the decimal number of a process, a positive
+// integer without sign or leading zeros, so it can be used in /proc paths.
+func validPid(pid string) bool {
+	id, err := strconv.ParseInt(pid, 10, 32)
+	return err == nil && id > 0 && strconv.FormatInt(id, 10) == pid
+}
+
+// processOwner returns the uid owning pid, which is the uid it runs as.
+func processOwner(pid string) (uint32, error) {
+	info, err := os.Stat(filepath.Join(procPath, pid))
+	if err != nil {
+		return 0, err
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, fmt.Errorf("no owner for %s/%s", procPath, pid)
+	}
+	return stat.Uid, nil
+}
+
+// processAlive reports whether pid still exists.
+func processAlive(pid string) bool {
+	_, err := os.Stat(filepath.Join(procPath, pid))
+	return err == nil
+}
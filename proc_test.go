@@ -0,0 +1,64 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// useFakeProc points procPath at a directory with a /proc/<pid>/stat for
+// every pid in stats.
+func useFakeProc(t *testing.T, stats map[string]string) {
+	t.Helper()
+	dir := t.TempDir()
+	for pid, stat := range stats {
+		if err := os.Mkdir(filepath.Join(dir, pid), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, pid, "stat"), []byte(stat+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	saved := procPath
+	procPath = dir
+	t.Cleanup(func() { procPath = saved })
+}
+
+// Stat lines of a kernel thread, with PF_KTHREAD among its flags, and of a
+// process whose command name has spaces and parentheses.
+const (
+	kthreadStat = "2 (kthreadd) S 0 0 0 0 -1 2129984 0 0 0 0 0 0 0 0 20 0 1 0 9 0 0"
+	processStat = "88 (my (odd) cmd) S 1 88 88 0 -1 4194560 120 0 0 0 3 1 0 0 20 0 1 0 4200 0 0"
+)
+
+func TestIsKernelThread(t *testing.T) {
+	useFakeProc(t, map[string]string{"2": kthreadStat, "88": processStat, "99": "99 (truncated"})
+	for pid, want := range map[string]bool{"2": true, "88": false} {
+		if got, err := isKernelThread(pid); err != nil || got != want {
+			t.Errorf("isKernelThread(%s) = %v, %v; want %v", pid, got, err, want)
+		}
+	}
+	for _, pid := range []string{"99", "100"} {
+		if _, err := isKernelThread(pid); err == nil {
+			t.Errorf("isKernelThread(%s): no error for a malformed or missing stat", pid)
+		}
+	}
+}
+
+func TestKernelThreadRefused(t *testing.T) {
+	tree := newTestTree(t)
+	useFakeProc(t, map[string]string{"2": kthreadStat, "88": processStat})
+	if reply := request(t, "2|alice|standard"); !strings.HasPrefix(reply, "ERR rejected kernel thread") {
+		t.Errorf("assigning a kernel thread: %s", reply)
+	}
+	if tree.exists(usersPath + "alice.slice") {
+		t.Error("the refused kernel thread left a slice behind")
+	}
+	placedPath(t, request(t, "88|bob|standard"))
+
+	saved := *allowKernelThreads
+	*allowKernelThreads = true
+	t.Cleanup(func() { *allowKernelThreads = saved })
+	placedPath(t, request(t, "2|carol|standard"))
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// promMetrics keeps every sample in memory and serves them on /metrics in the
+// Prometheus text format. Counters get a _total suffix and durations are
+// exported as summaries in seconds, e.g. pguard_sweep_duration_seconds_sum.
+type promMetrics struct {
+	mu     sync.Mutex
+	series map[string]*promFamily
+}
+
+// promFamily is a metric with all its label combinations.
+type promFamily struct {
+	kind   string // counter, gauge or summary
+	values map[string]float64
+	counts map[string]uint64 // observations of a summary
+}
+
+func newPromMetrics() *promMetrics {
+	return &promMetrics{series: make(map[string]*promFamily)}
+}
+
+// servePromMetrics serves m on addr in the background.
+func servePromMetrics(m *promMetrics, addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m)
+	go func() {
+		if err := http.Serve(listener, mux); err != nil {
+			slog.Error("Metrics server stopped", "addr", addr, "err", err)
+		}
+	}()
+	slog.Info("Serving Prometheus metrics", "addr", addr)
+	return nil
+}
+
+func (m *promMetrics) family(name, kind string) *promFamily {
+	f, ok := m.series[name]
+	if !ok {
+		f = &promFamily{kind: kind, values: make(map[string]float64), counts: make(map[string]uint64)}
+		m.series[name] = f
+	}
+	return f
+}
+
+func (m *promMetrics) Add(name string, delta float64, labels ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.family(name+"_total", "counter").values[promLabels(labels)] += delta
+}
+
+func (m *promMetrics) Set(name string, value float64, labels ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.family(name, "gauge").values[promLabels(labels)] = value
+}
+
+func (m *promMetrics) Observe(name string, d time.Duration, labels ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f := m.family(name+"_seconds", "summary")
+	key := promLabels(labels)
+	f.values[key] += d.Seconds()
+	f.counts[key]++
+}
+
+func (m *promMetrics) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	names := make([]string, 0, len(m.series))
+	for name := range m.series {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		f := m.series[name]
+		fmt.Fprintf(w, "# TYPE pguard_%s %s\n", name, f.kind)
+		keys := make([]string, 0, len(f.values))
+		for key := range f.values {
+			keys = append(keys, key)
+		}
+		slices.Sort(keys)
+		for _, key := range keys {
+			if f.kind == "summary" {
+				fmt.Fprintf(w, "pguard_%s_sum%s %g\n", name, key, f.values[key])
+				fmt.Fprintf(w, "pguard_%s_count%s %d\n", name, key, f.counts[key])
+				continue
+			}
+			fmt.Fprintf(w, "pguard_%s%s %g\n", name, key, f.values[key])
+		}
+	}
+}
+
+var promEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// promLabels formats label pairs as {name="value",...}, or "" without labels.
+func promLabels(labels []string) string {
+	if len(labels) < 2 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i := 0; i+1 < len(labels); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, "%s=\"%s\"", labels[i], promEscaper.Replace(labels[i+1]))
+	}
+	b.WriteByte('}')
+	return b.String()
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/malumar/pguard/client"
+)
+
+// reassignCommand moves a running process to another plan, e.g.
+// "reassign|1234|alice|business". The subgroup of the user's slice that holds
+// the pid gets the limits of the new plan written in place, so the user's
+// processes aren't split across two subgroups. A pid that isn't in any of the
+// user's subgroups is assigned like a normal request. The reply names the
+// subgroup: "reassigned <path> plan=<plan>" or "created <path> plan=<plan>".
+func reassignCommand(conn net.Conn, args []string) {
+	if len(args) != 3 || !validPid(args[0]) || !validUsername(args[1]) || args[2] == "" {
+		reply(conn, "ERR %s expected reassign|pid|user|plan", client.CodeBadRequest)
+		return
+	}
+	pid, username, plan := args[0], args[1], args[2]
+	if _, ok := getPlanConfig(plan); !ok {
+		reply(conn, "ERR %s %v %q", client.CodeUnknownPlan, errUnknownPlan, plan)
+		return
+	}
+	if !processAlive(pid) {
+		reply(conn, "ERR %s no such process %s", client.CodeNoSuchPid, pid)
+		return
+	}
+	if cred, err := peerCredentials(conn); err == nil || len(assignGids) > 0 {
+		err := authorizeCreate(cred, username)
+		if err == nil {
+			err = authorizePids(cred, []string{pid})
+		}
+		if err != nil {
+			slog.Error("Reassignment not authorized", "user", username, "err", err)
+			reply(conn, "ERR %s unauthorized: %v", client.CodeUnauthorized, err)
+			return
+		}
+	}
+	if draining.Load() {
+		reply(conn, "ERR %s draining", client.CodeUnavailable)
+		return
+	}
+	if !beginSetup() {
+		reply(conn, "ERR %s shutting down", client.CodeUnavailable)
+		return
+	}
+	defer setups.Done()
+
+	slice := fmt.Sprintf("%s%s.slice/", usersPath, username)
+	subDir := findSubgroup(slice, pid)
+	if subDir == "" {
+		placed, err := createCgroup(slog.Default(), slice, plan, []string{pid}, priorityNormal)
+		if err != nil {
+			if !errors.Is(err, errUserDrained) {
+				failures.record(failureReason(err))
+			}
+			reply(conn, "ERR %s %v", errorCode(err), err)
+			return
+		}
+		metrics.Add("requests", 1, "result", "created")
+		reply(conn, "created %s plan=%s", strings.TrimPrefix(placed.subDir, usersPath), placed.plan)
+		return
+	}
+
+	if err := reassignSubgroup(slice, subDir, plan); err != nil {
+		slog.Error("Failed to reassign subgroup", "path", subDir, "plan", plan, "err", err)
+		reply(conn, "ERR %s %v", errorCode(err), err)
+		return
+	}
+	metrics.Add("requests", 1, "result", "reassigned")
+	slog.Info("Subgroup reassigned", "path", subDir, "pid", pid, "plan", resolvePlan(plan))
+	reply(conn, "reassigned %s plan=%s", strings.TrimPrefix(subDir, usersPath), resolvePlan(plan))
+}
+
+// findSubgroup returns the subgroup of slice whose cgroup.procs lists pid, or
+// "" if there is none.
+func findSubgroup(slice, pid string) string {
+	entries, err := os.ReadDir(slice)
+	if err != nil {
+		return ""
+	}
+	for _, entry := range entries {
+		if entry.IsDir() && slices.Contains(readPids(slice+entry.Name()), pid) {
+			return slice + entry.Name()
+		}
+	}
+	return ""
+}
+
+// reassignSubgroup writes the limits of plan to the existing subgroup subDir,
+// keeping its recorded priority, and records the new plan. The subgroup is
+// marked as being created meanwhile so that a sweep leaves it alone.
+func reassignSubgroup(slice, subDir, plan string) error {
+	beginCreating(slice)
+	defer endCreating(slice)
+	beginCreating(subDir)
+	defer endCreating(subDir)
+
+	config, _ := getPlanConfig(plan)
+	if err := setupSliceCoalesced(slice, config); err != nil {
+		return err
+	}
+	priority := metaValue(subDir, metaPriority)
+	if priority == "" {
+		priority = priorityNormal
+	}
+	config.CpuWeight = weightForPriority(config.CpuWeight, priority)
+
+	dir, err := openCgroupDir(subDir)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	if err := layout.applyLimits(dir, subDir, config); err != nil {
+		return err
+	}
+	if err := setMeta(subDir, metaPlan, resolvePlan(plan)); err != nil {
+		slog.Error("Failed to record plan", "path", subDir, "err", err)
+	}
+	return nil
+}
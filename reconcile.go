@@ -0,0 +1,34 @@
+package main
+
+import (
+	"log/slog"
+	"path/filepath"
+)
+
+// reconcile writes the limits of the current plans to the populated subgroups
+// a previous run left behind, so a plan changed in the config while pguard was
+// down applies to the processes already running, not only to new ones. Each
+// subgroup gets the plan recorded for it; subgroups without one, or whose plan
+// no longer exists, keep their limits. Empty subgroups are left to the cleanup.
+func reconcile() {
+	reconciled, skipped := 0, 0
+	walkSubgroups(func(user, dir string) {
+		if !layout.populated(dir) {
+			return
+		}
+		plan, _ := getMeta(dir, metaPlan)
+		if _, ok := getPlanConfig(plan); plan == "" || !ok {
+			slog.Warn("Not reconciling subgroup without a known plan", "path", dir, "plan", plan)
+			skipped++
+			return
+		}
+		slice := filepath.Join(usersPath, user+".slice") + "/"
+		if err := reassignSubgroup(slice, dir, plan); err != nil {
+			slog.Error("Failed to reconcile subgroup", "path", dir, "plan", plan, "err", err)
+			skipped++
+			return
+		}
+		reconciled++
+	})
+	slog.Info("Reconciled existing subgroups", "reconciled", reconciled, "skipped", skipped)
+}
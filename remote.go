@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/malumar/pguard/client"
+)
+
+// remoteAuthPrefix starts the first line a remote client sends when
+// -listenTokenFile is set, "AUTH <token>", before its request.
+const remoteAuthPrefix = "AUTH "
+
+var (
+	// remoteCapability caps every connection accepted on the -listen
+	// address. Remote peers have no credentials, so -adminUids can't grant
+	// them more.
+	remoteCapability = capWrite
+	// remoteToken is the shared secret remote clients authenticate with,
+	// empty without -listenTokenFile.
+	remoteToken string
+
+	remoteOpts remoteOptions
+)
+
+// remoteConn is a connection accepted on the -listen address.
+type remoteConn struct {
+	net.Conn
+}
+
+// remoteOptions are the -listen flags.
+type remoteOptions struct {
+	addr      string
+	tokenFile string
+	cert      string
+	key       string
+	clientCA  string
+	access    string
+}
+
+// listenRemote opens the TCP listener of -listen tcp://host:port. It refuses
+// to open one nobody authenticates on: either a shared token or mTLS with
+// client certificates signed by -listenClientCA is required.
+func listenRemote(opts remoteOptions) (net.Listener, error) {
+	addr, ok := strings.CutPrefix(opts.addr, "tcp://")
+	if !ok {
+		return nil, fmt.Errorf("expected tcp://host:port, got %q", opts.addr)
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return nil, err
+	}
+	if opts.tokenFile == "" && opts.clientCA == "" {
+		return nil, errors.New("needs -listenTokenFile or -listenClientCA, a remote listener is never open to everyone")
+	}
+	var err error
+	if remoteCapability, err = parseCapability(opts.access); err != nil {
+		return nil, err
+	}
+	if opts.tokenFile != "" {
+		token, err := os.ReadFile(opts.tokenFile)
+		if err != nil {
+			return nil, err
+		}
+		if remoteToken = strings.TrimSpace(string(token)); remoteToken == "" {
+			return nil, fmt.Errorf("%s is empty", opts.tokenFile)
+		}
+	}
+
+	if opts.cert == "" && opts.key == "" && opts.clientCA == "" {
+		slog.Warn("Remote listener without TLS, the token and requests are sent in the clear", "address", addr)
+		return net.Listen("tcp", addr)
+	}
+	cert, err := tls.LoadX509KeyPair(opts.cert, opts.key)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if opts.clientCA != "" {
+		pem, err := os.ReadFile(opts.clientCA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", opts.clientCA)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tls.Listen("tcp", addr, config)
+}
+
+// serveRemote handles the connections of the remote listener like the ones of
+// the socket until ctx is cancelled.
+func serveRemote(ctx context.Context, listener net.Listener) {
+	context.AfterFunc(ctx, func() { listener.Close() })
+	slog.Info("Remote listener launched", "address", listener.Addr(), "capability", remoteCapability)
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			slog.Error("Failed to accept remote connection", "err", err)
+			continue
+		}
+		metrics.Add("connections", 1)
+		inFlight.Add(1)
+		go func() {
+			defer inFlight.Done()
+			if !authenticateRemote(conn) {
+				metrics.Add("connections_rejected", 1)
+				conn.Close()
+				return
+			}
+			handleConnection(ctx, remoteConn{conn})
+		}()
+	}
+}
+
+// authenticateRemote checks the "AUTH <token>" line of a remote client when
+// -listenTokenFile is set. The line is read a byte at a time so that nothing
+// of the request following it is consumed.
+func authenticateRemote(conn net.Conn) bool {
+	if remoteToken == "" {
+		return true
+	}
+	if err := conn.SetReadDeadline(time.Now().Add(readTimeout)); err != nil {
+		slog.Error("can't SetReadDeadline", "err", err, "timeout", readTimeout)
+	}
+	var line []byte
+	b := make([]byte, 1)
+	for len(line) < maxRequestSize {
+		if _, err := conn.Read(b); err != nil {
+			slog.Debug("Remote connection read error", "remote", conn.RemoteAddr(), "err", err)
+			return false
+		}
+		if b[0] == '\n' {
+			break
+		}
+		line = append(line, b[0])
+	}
+	token, ok := strings.CutPrefix(strings.TrimSpace(string(line)), remoteAuthPrefix)
+	if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(remoteToken)) != 1 {
+		slog.Warn("Rejecting remote connection with a wrong token", "remote", conn.RemoteAddr())
+		reply(conn, "ERR %s wrong token", client.CodeUnauthorized)
+		return false
+	}
+	return true
+}
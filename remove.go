@@ -0,0 +1,77 @@
+package main
+
+import (
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/malumar/pguard/client"
+)
+
+// removeCommand removes one subgroup right away, e.g. "remove|alice/job" with
+// the name the list command shows, or with the path an assignment answered,
+// "remove|alice.slice/job", for an orchestrator that knows the
+// subgroup is done before the cleanup notices. A subgroup that still has
+// processes is refused unless "remove|alice/job|force" is sent, which kills
+// them first. The thread cgroup of a thread assignment,
+// "remove|alice/job/thread-5678", is removed once its thread left, without
+// force. It is authorized like an assignment to the user.
+func removeCommand(conn net.Conn, args []string) {
+	force := len(args) == 2 && args[1] == "force"
+	if len(args) != 1 && !force {
+		reply(conn, "ERR %s expected remove|user/subgroup[|force]", client.CodeBadRequest)
+		return
+	}
+	username, name, _ := strings.Cut(args[0], "/")
+	username = strings.TrimSuffix(username, ".slice")
+	name, thread, isThread := strings.Cut(name, "/")
+	if !validUsername(username) || !validUsername(name) || isThread && !isThreadCgroup(thread) {
+		reply(conn, "ERR %s invalid subgroup %q", client.CodeBadRequest, args[0])
+		return
+	}
+	if cred, err := peerCredentials(conn); err == nil || len(assignGids) > 0 {
+		if err := authorizeCreate(cred, username); err != nil {
+			slog.Error("Removal not authorized", "user", username, "err", err)
+			reply(conn, "ERR %s unauthorized: %v", client.CodeUnauthorized, err)
+			return
+		}
+	}
+	subDir := filepath.Join(usersPath, username+".slice", name)
+	if isThread {
+		// A thread can't be killed on its own, only with its process.
+		if force {
+			reply(conn, "ERR %s can't kill a thread cgroup, remove %s.slice/%s", client.CodeRejected, username, name)
+			return
+		}
+		subDir = filepath.Join(subDir, thread)
+	}
+	if info, err := os.Stat(subDir); err != nil || !info.IsDir() {
+		reply(conn, "ERR %s unknown subgroup %s", client.CodeBadRequest, args[0])
+		return
+	}
+
+	if layout.populated(subDir) {
+		if !force {
+			reply(conn, "ERR %s %s has processes, add |force to kill them", client.CodeRejected, args[0])
+			return
+		}
+		if err := killCgroup(subDir, []string{subDir}); err != nil {
+			slog.Error("Failed to kill subgroup", "path", subDir, "err", err)
+			reply(conn, "ERR %s %v", errorCode(err), err)
+			return
+		}
+		waitUnpopulated([]string{subDir}, killWait)
+	}
+	if !cleanupSubgroup(subDir, activeWatcher) {
+		if layout.populated(subDir) {
+			reply(conn, "ERR %s %s still has processes", client.CodeRejected, args[0])
+		} else {
+			reply(conn, "ERR %s can't remove %s, it is being set up or busy", client.CodeUnavailable, args[0])
+		}
+		return
+	}
+	slog.Info("Subgroup removed on request", "path", subDir, "force", force)
+	reply(conn, "removed %s", args[0])
+}
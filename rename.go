@@ -0,0 +1,180 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/malumar/pguard/client"
+	"golang.org/x/sys/unix"
+)
+
+// migratedMeta are the metadata attributes carried over to a migrated
+// subgroup.
+var migratedMeta = []string{metaPlan, metaPriority, metaNice, metaOomScoreAdj}
+
+// renameCommand moves the subgroups of a user slice to the slice of another
+// user name, e.g. "rename|olduser|newuser". cgroupfs can't rename directories
+// that hold processes, so every subgroup is recreated under the new slice with
+// the limits of its recorded plan, its processes are moved, and the emptied old
+// subgroup is removed. The running processes are not interrupted. One line is
+// answered per subgroup, the old slice is removed once all of them migrated.
+func renameCommand(conn net.Conn, args []string) {
+	if len(args) != 2 || !validUsername(args[0]) || !validUsername(args[1]) || args[0] == args[1] {
+		reply(conn, "ERR %s expected rename|oldUser|newUser", client.CodeBadRequest)
+		return
+	}
+	oldSlice := fmt.Sprintf("%s%s.slice/", usersPath, args[0])
+	newSlice := fmt.Sprintf("%s%s.slice/", usersPath, args[1])
+	entries, err := os.ReadDir(oldSlice)
+	if err != nil {
+		reply(conn, "ERR %s unknown user %s", client.CodeBadRequest, args[0])
+		return
+	}
+	// The new slice gets the slice limits of the plan the user's subgroups
+	// run with.
+	plan := planStandard
+	for _, entry := range entries {
+		if recorded, err := getMeta(oldSlice+entry.Name(), metaPlan); err == nil && recorded != "" {
+			plan = recorded
+			break
+		}
+	}
+	config, _ := getPlanConfig(plan)
+	// The new slice stays empty until the first subgroup is migrated.
+	beginCreating(newSlice)
+	defer endCreating(newSlice)
+	if err := setupSlice(newSlice, config); err != nil {
+		slog.Error("Failed to create user slice", "path", newSlice, "err", err)
+		reply(conn, "ERR %s can't create slice of %s: %v", errorCode(err), args[1], err)
+		return
+	}
+
+	migrated, failed := 0, 0
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		from := oldSlice + entry.Name() + "/"
+		to := newSlice + entry.Name() + "/"
+		if err := migrateSubgroup(from, to); err != nil {
+			slog.Error("Failed to migrate subgroup", "from", from, "to", to, "err", err)
+			reply(conn, "failed %s.slice/%s: %v", args[0], entry.Name(), err)
+			failed++
+			continue
+		}
+		reply(conn, "migrated %s.slice/%s -> %s.slice/%s", args[0], entry.Name(), args[1], entry.Name())
+		migrated++
+	}
+
+	forgetSubgroupCount(oldSlice)
+	forgetSubgroupCount(newSlice)
+	if failed == 0 {
+		if err := layout.remove(oldSlice); err != nil {
+			slog.Error("Failed to remove renamed user slice", "path", oldSlice, "err", err)
+		} else {
+			forgetSlice(oldSlice)
+		}
+	}
+	slog.Info("User slice renamed", "from", args[0], "to", args[1], "migrated", migrated, "failed", failed)
+	reply(conn, "renamed migrated=%d failed=%d", migrated, failed)
+}
+
+// migrateSubgroup recreates the subgroup from as to with the same plan and
+// moves its processes over, verifying the move by reading cgroup.procs back.
+// The watch moves with the processes. If they can't all be moved, the ones
+// that were are moved back and to is removed, so they aren't left split.
+func migrateSubgroup(from, to string) (err error) {
+	if _, err := os.Stat(to); err == nil {
+		return fmt.Errorf("%s already exists", to)
+	}
+	beginCreating(to)
+	defer endCreating(to)
+	if err := CreateCgroupDir(to, 0755); err != nil {
+		return err
+	}
+	var moved []string
+	defer func() {
+		if err != nil {
+			rollbackMigration(from, to, moved)
+		}
+	}()
+	for _, key := range migratedMeta {
+		if value, err := getMeta(from, key); err == nil && value != "" {
+			if err := setMeta(to, key, value); err != nil {
+				slog.Error("Failed to copy metadata", "path", to, "key", key, "err", err)
+			}
+		}
+	}
+
+	config, _ := getPlanConfig(metaValue(from, metaPlan))
+	if priority := metaValue(from, metaPriority); priority != "" {
+		config.CpuWeight = weightForPriority(config.CpuWeight, priority)
+	}
+	dir, err := openCgroupDir(to)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	if err := layout.applyLimits(dir, to, config); err != nil {
+		return err
+	}
+
+	pids := readPids(from)
+	for _, pid := range pids {
+		err := dir.write("cgroup.procs", pid)
+		if err != nil && !errors.Is(err, unix.ESRCH) {
+			return fmt.Errorf("moving pid %s: %w", pid, err)
+		}
+		if err == nil {
+			moved = append(moved, pid)
+		}
+	}
+	inside := readPids(to)
+	for _, pid := range pids {
+		if !slices.Contains(inside, pid) && processAlive(pid) {
+			return fmt.Errorf("pid %s is not in %s after the move", pid, filepath.Join(to, "cgroup.procs"))
+		}
+	}
+	if activeWatcher != nil && !dryRun {
+		if err := addWatch(activeWatcher, filepath.Clean(to)); err != nil {
+			slog.Error("Failed to watch subgroup", "path", to, "err", err)
+		}
+		if err := removeWatch(activeWatcher, filepath.Clean(from)); err != nil {
+			slog.Error("Failed to remove watch", "path", from, "err", err)
+		}
+	}
+	// Requests for either user count the subgroups again from here on,
+	// not only once the whole rename is done.
+	forgetSubgroupCount(filepath.Dir(filepath.Clean(to)))
+	if err := layout.remove(from); err != nil {
+		slog.Error("Failed to remove migrated subgroup", "path", from, "err", err)
+	} else {
+		forgetMeta(from)
+		forgetSubgroupCount(filepath.Dir(filepath.Clean(from)))
+	}
+	return nil
+}
+
+// rollbackMigration undoes a failed migrateSubgroup: the moved processes go
+// back to from and to is removed.
+func rollbackMigration(from, to string, moved []string) {
+	for _, pid := range moved {
+		if err := writeToFile(filepath.Join(from, "cgroup.procs"), pid); err != nil && !errors.Is(err, unix.ESRCH) {
+			slog.Error("Failed to move process back", "pid", pid, "path", from, "err", err)
+		}
+	}
+	if layout.populated(to) {
+		slog.Error("Processes left in the subgroup of a failed migration", "path", to)
+		return
+	}
+	if err := layout.remove(to); err != nil {
+		slog.Error("Failed to remove subgroup of a failed migration", "path", to, "err", err)
+		return
+	}
+	forgetMeta(to)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/glottis/inotify"
+	"golang.org/x/sys/unix"
+)
+
+// useWatcher makes a new inotify watcher the active one for the test. Its
+// events are left unread.
+func useWatcher(t *testing.T) *inotify.Watcher {
+	t.Helper()
+	watcher, err := inotify.NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	activeWatcher = watcher
+	t.Cleanup(func() { watcher.Close() })
+	return watcher
+}
+
+// isWatched reports whether path is in the watched set.
+func isWatched(path string) bool {
+	watchedMu.Lock()
+	defer watchedMu.Unlock()
+	_, ok := watched[filepath.Clean(path)]
+	return ok
+}
+
+// migrationTarget sets up the slice of user and returns where from migrates
+// to in it.
+func migrationTarget(t *testing.T, from, user string) string {
+	t.Helper()
+	slice := usersPath + user + ".slice/"
+	if err := setupSlice(slice, builtinPlans[planStandard]); err != nil {
+		t.Fatal(err)
+	}
+	return slice + filepath.Base(from) + "/"
+}
+
+func TestMigrateSubgroupMovesWatch(t *testing.T) {
+	tree := newTestTree(t)
+	tree.moves = true
+	useWatcher(t)
+	from := assign(t, "alice", planStandard)
+	to := migrationTarget(t, from, "bob")
+
+	if err := migrateSubgroup(from+"/", to); err != nil {
+		t.Fatal(err)
+	}
+	if got := tree.read(t, to+"cgroup.procs"); got != selfPid {
+		t.Errorf("cgroup.procs of the new subgroup = %q, want %s", got, selfPid)
+	}
+	if tree.exists(from) {
+		t.Error("the old subgroup is still there")
+	}
+	if !isWatched(to) || isWatched(from) {
+		t.Errorf("watched: new subgroup %v, old one %v; want only the new one", isWatched(to), isWatched(from))
+	}
+}
+
+func TestMigrateSubgroupRollsBack(t *testing.T) {
+	tree := newTestTree(t)
+	tree.moves = true
+	useWatcher(t)
+	from := assign(t, "alice", planStandard)
+	parentPid := strconv.Itoa(os.Getppid())
+	if err := writeToFile(filepath.Join(from, "cgroup.procs"), parentPid); err != nil {
+		t.Fatal(err)
+	}
+	to := migrationTarget(t, from, "bob")
+	// The first process moves, the second one can't.
+	tree.intercept = func(path, data string) error {
+		if path == to+"cgroup.procs" && data == parentPid {
+			return unix.EINVAL
+		}
+		return nil
+	}
+
+	if err := migrateSubgroup(from+"/", to); err == nil {
+		t.Fatal("the migration succeeded with a process that can't move")
+	}
+	procs := readPids(from)
+	if len(procs) != 2 {
+		t.Errorf("cgroup.procs of the old subgroup = %q, want both processes back", procs)
+	}
+	if tree.exists(to) {
+		t.Error("the new subgroup of the failed migration is still there")
+	}
+	if !isWatched(from) || isWatched(to) {
+		t.Errorf("watched: old subgroup %v, new one %v; want only the old one", isWatched(from), isWatched(to))
+	}
+}
+
+func TestSweepSparesSliceBeingRenamedTo(t *testing.T) {
+	tree := newTestTree(t)
+	assign(t, "alice", planStandard)
+	newSlice := usersPath + "bob.slice"
+	release := tree.holdWrites(filepath.Join(newSlice, "cgroup.subtree_control"))
+	defer release()
+	replied := make(chan string, 1)
+	go func() { replied <- request(t, "rename|alice|bob") }()
+
+	// The new slice exists, still without subgroups, while it is set up.
+	if !waitFor(5*time.Second, func() bool { return tree.exists(newSlice) }) {
+		t.Fatal("the new slice was never created")
+	}
+	if _, removed := cleanupAllSubgroups(nil, ""); removed != 0 {
+		t.Errorf("the sweep removed %d directories during the rename", removed)
+	}
+	release()
+	if reply := <-replied; !strings.HasSuffix(reply, "renamed migrated=1 failed=0") {
+		t.Errorf("rename: %s", reply)
+	}
+}
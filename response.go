@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/malumar/pguard/client"
+)
+
+// responseVersion is increased whenever a field of Response changes meaning
+// or is removed; new fields can be added without.
+const responseVersion = 1
+
+// Status codes of a Response, modelled after HTTP.
+const (
+	statusOK          = 200
+	statusBadRequest  = 400
+	statusForbidden   = 403
+	statusRejected    = 422 // the request is valid but pguard won't do it
+	statusQuarantined = 429
+	statusInternal    = 500
+	statusUnavailable = 503
+)
+
+// statusCodes are the codes of the ERR answers by status, unless a Response
+// has a more specific one.
+var statusCodes = map[int]client.Code{
+	statusBadRequest:  client.CodeBadRequest,
+	statusForbidden:   client.CodeUnauthorized,
+	statusRejected:    client.CodeRejected,
+	statusQuarantined: client.CodeQuarantined,
+	statusInternal:    client.CodeInternal,
+	statusUnavailable: client.CodeUnavailable,
+}
+
+// Formats a client can ask for in the last field of an assignment request,
+// e.g. "1234|alice|business||json".
+const (
+	formatText = "text"
+	formatJSON = "json"
+)
+
+// Response is the answer to an assignment request. Clients asking for the
+// JSON format get it as a single JSON line; the text format is "OK <path>",
+// "OK <path> pids=<n>" for several processes, or "ERR <code> <message>".
+type Response struct {
+	Version int `json:"version"`
+	Status  int `json:"status"`
+	// Code classifies a failure, see client.Code. respond fills it in from
+	// the status if it is empty.
+	Code    client.Code `json:"code,omitempty"`
+	Message string      `json:"message,omitempty"`
+	// Path is the created subgroup relative to usersPath.
+	Path string `json:"path,omitempty"`
+	// Plan is the plan the request was served with.
+	Plan string `json:"plan,omitempty"`
+	// Limits are the values written for the subgroup and its process,
+	// keyed by file name, e.g. "cpu.max" or "oom_score_adj".
+	Limits map[string]string `json:"limits,omitempty"`
+	// Pids is the number of processes moved into the subgroup.
+	Pids int `json:"pids,omitempty"`
+	// DurationUs is the time pguard spent on the request.
+	DurationUs int64 `json:"durationUs"`
+}
+
+// placementResponse describes a successful createCgroup.
+func placementResponse(p placement) Response {
+	return Response{
+		Status: statusOK,
+		Path:   strings.TrimPrefix(p.subDir, usersPath),
+		Plan:   p.plan,
+		Limits: subgroupLimits(p.config),
+		Pids:   p.pids,
+	}
+}
+
+// subgroupLimits returns the values written for a subgroup of the plan and
+// its processes, keyed by file name.
+func subgroupLimits(config PlanConfig) map[string]string {
+	limits := make(map[string]string)
+	if config.CpuMax != "" {
+		limits["cpu.max"] = config.CpuMax
+	}
+	if config.CpuBurst != "" {
+		limits["cpu.max.burst"] = config.CpuBurst
+	}
+	if config.CpuIdle {
+		limits["cpu.idle"] = "1"
+	}
+	if config.CpuWeight != "" {
+		limits["cpu.weight"] = config.CpuWeight
+	}
+	if config.MemoryMax != "" {
+		limits["memory.max"] = config.MemoryMax
+	}
+	if config.MemoryHigh != "" {
+		limits["memory.high"] = config.MemoryHigh
+	}
+	if config.SwapMax != "" {
+		limits["memory.swap.max"] = config.SwapMax
+	}
+	if value := config.oomGroup(); value != "" {
+		limits["memory.oom.group"] = value
+	}
+	if len(config.IoMax) > 0 {
+		limits["io.max"] = strings.Join(config.IoMax, "\n")
+	}
+	if config.IoWeight != "" {
+		limits["io.weight"] = config.IoWeight
+	}
+	limits["pids.max"] = config.pidsMax()
+	if config.Nice != nil {
+		limits["nice"] = strconv.Itoa(*config.Nice)
+	}
+	if config.OomScoreAdj != nil {
+		limits["oom_score_adj"] = strconv.Itoa(*config.OomScoreAdj)
+	}
+	return limits
+}
+
+// reasonStatus is the status of a failed createCgroup by its failure reason.
+var reasonStatus = map[string]int{
+	reasonUnknownPlan:     statusBadRequest,
+	reasonPidGone:         statusRejected,
+	reasonNotDelegated:    statusInternal,
+	reasonRejectedByLimit: statusRejected,
+	reasonExhausted:       statusUnavailable,
+	reasonInternal:        statusInternal,
+}
+
+// failureResponse describes a failed createCgroup.
+func failureResponse(err error) Response {
+	reason := failureReason(err)
+	if errors.Is(err, errCgroupExhausted) {
+		return Response{Status: statusUnavailable, Message: "cgroup resource exhausted"}
+	}
+	if errors.Is(err, errWritePending) {
+		return Response{Status: statusUnavailable, Message: err.Error()}
+	}
+	if errors.Is(err, errUserDrained) {
+		return Response{Status: statusUnavailable, Message: "draining"}
+	}
+	if errors.Is(err, errTooManySubgroups) {
+		return Response{Status: statusRejected, Message: errTooManySubgroups.Error()}
+	}
+	switch reason {
+	case reasonUnknownPlan:
+		return Response{Status: statusBadRequest, Code: client.CodeUnknownPlan, Message: err.Error()}
+	case reasonPidGone:
+		return Response{Status: statusRejected, Code: client.CodeNoSuchPid, Message: err.Error()}
+	}
+	return Response{Status: reasonStatus[reason], Message: reason + ": " + err.Error()}
+}
+
+// errorCode classifies err for the ERR answer of a command, as a failed
+// assignment with err would be.
+func errorCode(err error) client.Code {
+	r := failureResponse(err)
+	if r.Code != "" {
+		return r.Code
+	}
+	return statusCodes[r.Status]
+}
+
+// respond writes r in the requested format, stamping it with the version and
+// the time passed since start.
+func respond(conn net.Conn, format string, start time.Time, r Response) {
+	r.Version = responseVersion
+	r.DurationUs = time.Since(start).Microseconds()
+	if r.Status != statusOK && r.Code == "" {
+		r.Code = statusCodes[r.Status]
+	}
+	if format == formatJSON {
+		line, err := json.Marshal(r)
+		if err != nil {
+			slog.Error("Failed to encode response", "err", err)
+			return
+		}
+		reply(conn, "%s", line)
+		return
+	}
+	if r.Status == statusOK {
+		if r.Pids > 1 {
+			reply(conn, "OK %s pids=%d", r.Path, r.Pids)
+			return
+		}
+		reply(conn, "OK %s", r.Path)
+		return
+	}
+	reply(conn, "ERR %s %s", r.Code, r.Message)
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestJSONResponseFields(t *testing.T) {
+	newTestTree(t)
+	var r Response
+	reply := request(t, selfPid+"|alice|standard||json")
+	if err := json.Unmarshal([]byte(reply), &r); err != nil {
+		t.Fatalf("%q: %v", reply, err)
+	}
+	if r.Version != responseVersion || r.Status != statusOK || r.Code != "" || r.Message != "" {
+		t.Errorf("version %d status %d code %q message %q, want version %d status %d without code or message",
+			r.Version, r.Status, r.Code, r.Message, responseVersion, statusOK)
+	}
+	if info, err := os.Stat(filepath.Join(usersPath, r.Path)); err != nil || !info.IsDir() {
+		t.Errorf("path %q isn't the created subgroup: %v", r.Path, err)
+	}
+	if r.Plan != planStandard || r.Pids != 1 {
+		t.Errorf("plan %q pids %d, want %s and 1", r.Plan, r.Pids, planStandard)
+	}
+	if r.Limits["cpu.max"] != cpuMaxStandard || r.Limits["cpu.weight"] != cpuWeightStd {
+		t.Errorf("limits %v, want the standard plan's cpu.max and cpu.weight", r.Limits)
+	}
+	// The time is always there, even when it rounds down to zero.
+	var fields map[string]json.RawMessage
+	json.Unmarshal([]byte(reply), &fields)
+	if _, ok := fields["durationUs"]; !ok || r.DurationUs < 0 {
+		t.Errorf("durationUs missing or negative in %s", reply)
+	}
+
+	r = Response{}
+	reply = request(t, selfPid+"|alice|nosuchplan||json")
+	if err := json.Unmarshal([]byte(reply), &r); err != nil {
+		t.Fatalf("%q: %v", reply, err)
+	}
+	if r.Status == statusOK || r.Code == "" || r.Message == "" || r.Path != "" {
+		t.Errorf("failure %s, want a status, code and message without a path", reply)
+	}
+
+	if reply := request(t, selfPid+"|bob|standard"); !strings.HasPrefix(reply, "OK bob.slice/") || strings.Contains(reply, "{") {
+		t.Errorf("text reply %q, want the compact OK <path>", reply)
+	}
+}
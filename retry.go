@@ -0,0 +1,136 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+var (
+	// writeRetries is how often a control file write failing with a
+	// transient error is retried, writeRetryDelay the pause before the first
+	// retry; it doubles with every further one.
+	writeRetries    int
+	writeRetryDelay time.Duration
+
+	// writeTimeout bounds a single control file write, 0 means no bound.
+	writeTimeout time.Duration
+)
+
+// errWriteTimeout is returned for a control file write that didn't finish
+// within -writeTimeout.
+var errWriteTimeout = errors.New("cgroup write timed out")
+
+// transientWriteErrors are the errors of a control file write worth retrying.
+// Right after a subgroup is created or a controller is enabled in its parent,
+// the kernel may briefly report its files as missing or busy.
+var transientWriteErrors = []error{unix.ENOENT, unix.EBUSY, unix.EAGAIN, unix.EINTR}
+
+// retryWrite runs write until it succeeds, fails with an error that isn't
+// transient or -writeRetries retries are used up, and returns its last error.
+func retryWrite(path string, write func() error) error {
+	delay := writeRetryDelay
+	for retry := 1; ; retry++ {
+		err := timedWrite(path, write)
+		if err == nil || retry > writeRetries || !isTransientWriteError(err) {
+			return err
+		}
+		slog.Debug("Retrying cgroup write", "path", path, "retry", retry, "delay", delay, "err", err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// pendingWrites are the timed out writes still stuck in the kernel, by the
+// directory of their file. Such a write may still land: a late cgroup.procs
+// write moves the process after its request failed.
+var (
+	pendingWritesMu sync.Mutex
+	pendingWrites   = make(map[string][]chan struct{})
+)
+
+// timedWrite runs write, giving up after -writeTimeout. A write stuck in the
+// kernel can't be interrupted, so the caller gets errWriteTimeout instead of
+// blocking with it, and the write stays pending, see awaitPendingWrites,
+// until it returns.
+func timedWrite(path string, write func() error) error {
+	if writeTimeout <= 0 {
+		return write()
+	}
+	var err error
+	done := make(chan struct{})
+	go func() {
+		err = write()
+		close(done)
+	}()
+	// Stopped right away, unlike time.After, so thousands of writes a second
+	// don't keep as many timers alive for -writeTimeout.
+	timer := time.NewTimer(writeTimeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+		return err
+	case <-timer.C:
+		slog.Error("Cgroup write timed out", "path", path, "timeout", writeTimeout)
+		metrics.Add("write_timeouts", 1)
+		trackPendingWrite(path, done, &err)
+		return fmt.Errorf("%s: %w after %s", path, errWriteTimeout, writeTimeout)
+	}
+}
+
+// trackPendingWrite keeps the timed out write to path pending until done is
+// closed, err holding its result by then.
+func trackPendingWrite(path string, done chan struct{}, err *error) {
+	dir := filepath.Dir(path)
+	pendingWritesMu.Lock()
+	pendingWrites[dir] = append(pendingWrites[dir], done)
+	pendingWritesMu.Unlock()
+	metrics.Add("writes_pending", 1)
+	go func() {
+		<-done
+		slog.Warn("Timed out cgroup write finished", "path", path, "err", *err)
+		pendingWritesMu.Lock()
+		pending := slices.DeleteFunc(pendingWrites[dir], func(c chan struct{}) bool { return c == done })
+		if len(pending) == 0 {
+			delete(pendingWrites, dir)
+		} else {
+			pendingWrites[dir] = pending
+		}
+		pendingWritesMu.Unlock()
+		metrics.Add("writes_pending", -1)
+	}()
+}
+
+// writesPending reports whether a timed out write to a file in dir is still
+// pending.
+func writesPending(dir string) bool {
+	pendingWritesMu.Lock()
+	defer pendingWritesMu.Unlock()
+	return len(pendingWrites[filepath.Clean(dir)]) > 0
+}
+
+// awaitPendingWrites waits until the timed out writes to the files in dir
+// have returned.
+func awaitPendingWrites(dir string) {
+	pendingWritesMu.Lock()
+	pending := slices.Clone(pendingWrites[filepath.Clean(dir)])
+	pendingWritesMu.Unlock()
+	for _, done := range pending {
+		<-done
+	}
+}
+
+func isTransientWriteError(err error) bool {
+	for _, transient := range transientWriteErrors {
+		if errors.Is(err, transient) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// setWriteTimeout sets -writeTimeout for the test.
+func setWriteTimeout(t *testing.T, timeout time.Duration) {
+	saved := writeTimeout
+	writeTimeout = timeout
+	t.Cleanup(func() { writeTimeout = saved })
+}
+
+// pendingSubgroup returns the only subgroup of user's slice, failing the test
+// unless there is exactly one.
+func pendingSubgroup(t *testing.T, user string) string {
+	t.Helper()
+	slice := usersPath + user + ".slice/"
+	entries, err := os.ReadDir(slice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var subgroups []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			subgroups = append(subgroups, slice+entry.Name())
+		}
+	}
+	if len(subgroups) != 1 {
+		t.Fatalf("subgroups of %s: %q, want one", slice, subgroups)
+	}
+	return subgroups[0]
+}
+
+// settled reports whether the failed createCgroup of subDir is done with it.
+func settled(subDir string) bool {
+	creatingMu.Lock()
+	defer creatingMu.Unlock()
+	return !writesPending(subDir) && !isCreating(subDir)
+}
+
+func TestTimedOutMoveKeepsSubgroup(t *testing.T) {
+	for _, landed := range []bool{true, false} {
+		name := map[bool]string{true: "landed", false: "failed"}[landed]
+		t.Run(name, func(t *testing.T) {
+			tree := newTestTree(t)
+			setWriteTimeout(t, 20*time.Millisecond)
+			release := tree.holdWrites("cgroup.procs")
+			defer release()
+
+			reply := request(t, selfPid+"|alice|standard")
+			if !strings.HasPrefix(reply, "ERR unavailable cgroup write pending") {
+				t.Fatalf("reply %q, want the write reported pending", reply)
+			}
+			subDir := pendingSubgroup(t, "alice")
+			if settled(subDir) {
+				t.Fatal("the subgroup was settled while its write is pending")
+			}
+			if !landed {
+				tree.failWrites("cgroup.procs", unix.ESRCH)
+			}
+			release()
+			if !waitFor(5*time.Second, func() bool { return settled(subDir) }) {
+				t.Fatal("the subgroup wasn't settled once the write returned")
+			}
+			if landed {
+				if got := tree.read(t, filepath.Join(subDir, "cgroup.procs")); got != selfPid {
+					t.Errorf("cgroup.procs = %q, want %s moved in late", got, selfPid)
+				}
+			} else if tree.exists(subDir) {
+				t.Error("the subgroup no process got into wasn't removed")
+			}
+		})
+	}
+}
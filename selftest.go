@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// selftestSlice is the throwaway slice of -selftest. Like loadtestSlice it
+// can't collide with a tenant, user names never start with a dot.
+const selftestSlice = ".selftest"
+
+// runSelftest sets up a throwaway user slice and subgroup with the standard
+// plan through the same code paths as an assignment, reads the limits back
+// from the control files and removes both again. Unlike -check it writes to
+// the cgroup tree, so it catches a kernel or a delegation refusing the
+// values. The cgroup v1 files hold the limits in other units, there only the
+// writes are checked.
+func runSelftest() (err error) {
+	config := builtinPlans[planStandard]
+	slice := fmt.Sprintf("%s%s.slice/", usersPath, selftestSlice)
+	subDir := slice + "check"
+
+	if err := CreateCgroupDir(slice, 0755); err != nil {
+		return fmt.Errorf("create %s: %w", slice, err)
+	}
+	defer func() {
+		if removeErr := removeSelftest(slice, subDir); removeErr != nil {
+			err = errors.Join(err, removeErr)
+		}
+	}()
+	if err := layout.setupSlice(slice, config); err != nil {
+		return fmt.Errorf("set up %s: %w", slice, err)
+	}
+	if err := CreateCgroupDir(subDir, 0755); err != nil {
+		return fmt.Errorf("create %s: %w", subDir, err)
+	}
+	if err := applyCgroupConfig(slog.Default(), subDir, config, nil); err != nil {
+		return fmt.Errorf("apply the %s plan to %s: %w", planStandard, subDir, err)
+	}
+	if _, ok := layout.(cgroupV1); ok {
+		return nil
+	}
+
+	config = withoutUnavailable(subDir, config)
+	want := map[string]string{"cpu.max": config.CpuMax, "cpu.weight": config.CpuWeight}
+	if controllerAvailable("pids") {
+		want["pids.max"] = config.pidsMax()
+	}
+	for name, value := range want {
+		if value == "" {
+			continue
+		}
+		content, err := os.ReadFile(filepath.Join(subDir, name))
+		if err != nil {
+			return fmt.Errorf("read back %s: %w", name, err)
+		}
+		if got := strings.TrimSpace(string(content)); got != value {
+			return fmt.Errorf("%s of %s holds %q, wrote %q", name, subDir, got, value)
+		}
+	}
+	return nil
+}
+
+// removeSelftest removes the throwaway subgroup and slice of runSelftest.
+func removeSelftest(slice, subDir string) error {
+	for _, path := range []string{subDir, slice} {
+		if _, err := os.Stat(path); err != nil {
+			continue
+		}
+		if err := layout.remove(path); err != nil {
+			return err
+		}
+	}
+	slog.Debug("Self-test cgroups removed", "path", slice)
+	return nil
+}
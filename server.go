@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+// Server is a started pguard server: its socket is listening and connections
+// are being handled. The cgroup configuration must be set up before, and a
+// process runs one Server at a time, the assignment state being global.
+type Server struct {
+	// Listener is the socket listener, its Addr is the address clients
+	// dial.
+	Listener net.Listener
+
+	addr       string
+	cancel     context.CancelFunc
+	done       chan struct{}
+	remoteDone chan struct{}
+}
+
+// umaskMu serializes the changes of the process-wide umask.
+var umaskMu sync.Mutex
+
+// listenSocket listens on the unix socket addr. Its file is created with
+// socketMode through the umask rather than changed afterwards, so no client
+// can connect while it still has looser permissions.
+func listenSocket(addr string) (net.Listener, error) {
+	if isAbstractSocket(addr) {
+		return net.Listen(protocol, addr)
+	}
+	umaskMu.Lock()
+	defer umaskMu.Unlock()
+	defer unix.Umask(unix.Umask(int(0777 &^ socketMode)))
+	return net.Listen(protocol, addr)
+}
+
+// startServer listens on addr, along with the -listen address if set, and
+// serves both until ctx is cancelled or Shutdown is called. It returns once
+// the socket accepts connections.
+func startServer(ctx context.Context, addr string) (*Server, error) {
+	listener, err := listenSocket(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if isAbstractSocket(addr) {
+		slog.Warn("Listening on an abstract socket, it has no file permissions", "address", addr)
+	} else {
+		if os.Getuid() == 0 {
+			if err := os.Chown(addr, *uid, *gid); err != nil {
+				slog.Error("can't chown addr path", "addr", addr, "err", err)
+			}
+		}
+		if info, err := os.Stat(addr); err == nil {
+			slog.Info("Socket permissions", "address", addr, "mode", fmt.Sprintf("%04o", info.Mode().Perm()))
+		}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	s := &Server{Listener: listener, addr: addr, cancel: cancel, done: make(chan struct{})}
+	if remoteOpts.addr != "" {
+		remote, err := listenRemote(remoteOpts)
+		if err != nil {
+			cancel()
+			listener.Close()
+			return nil, fmt.Errorf("can't listen on %s: %w", remoteOpts.addr, err)
+		}
+		s.remoteDone = make(chan struct{})
+		go func() {
+			serveRemote(ctx, remote)
+			close(s.remoteDone)
+		}()
+	}
+
+	context.AfterFunc(ctx, func() { listener.Close() })
+	slog.Info("Server launched", "address", addr)
+	go func() {
+		s.serve(ctx)
+		close(s.done)
+	}()
+	return s, nil
+}
+
+// serve accepts connections on the socket until ctx is cancelled.
+func (s *Server) serve(ctx context.Context) {
+	for {
+		conn, err := s.Listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			slog.Error("Failed to accept connection", "err", err)
+			continue
+		}
+		metrics.Add("connections", 1)
+		if !acceptPeer(conn) {
+			metrics.Add("connections_rejected", 1)
+			conn.Close()
+			continue
+		}
+		inFlight.Add(1)
+		go func() {
+			defer inFlight.Done()
+			handleConnection(ctx, conn)
+		}()
+	}
+}
+
+// Shutdown stops accepting connections and shuts down: it waits for the
+// connections in flight, stops the sweep and removes the socket. It returns
+// ctx's error if ctx is done first, the shutdown then carrying on in the
+// background.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.cancel()
+	finished := make(chan struct{})
+	go func() {
+		<-s.done
+		if s.remoteDone != nil {
+			<-s.remoteDone
+		}
+		shutdown(s.addr)
+		close(finished)
+	}()
+	select {
+	case <-finished:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// startTestServer starts a Server on a socket in a temporary directory and
+// makes the shutdown state ready for the next test once it has ended.
+func startTestServer(t *testing.T) (*Server, string) {
+	t.Helper()
+	addr := filepath.Join(t.TempDir(), "pguard.sock")
+	server, err := startServer(context.Background(), addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		server.Shutdown(context.Background())
+		setupsMu.Lock()
+		setupsClosed = false
+		setupsMu.Unlock()
+		cleanupTicker = nil
+	})
+	return server, addr
+}
+
+// dial sends line to the server listening on addr and returns the reply.
+func dial(t *testing.T, addr, line string) string {
+	t.Helper()
+	conn, err := net.Dial(protocol, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte(line + "\n")); err != nil {
+		t.Fatal(err)
+	}
+	reply, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimSpace(reply)
+}
+
+func TestServerStartDialShutdown(t *testing.T) {
+	tree := newTestTree(t)
+	server, addr := startTestServer(t)
+	if got := server.Listener.Addr().String(); got != addr {
+		t.Errorf("listening on %s, want %s", got, addr)
+	}
+	info, err := os.Stat(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode().Perm(); mode != socketMode {
+		t.Errorf("socket mode %04o, want %04o", mode, socketMode)
+	}
+
+	if reply := dial(t, addr, "ping"); reply != "PONG" {
+		t.Errorf("ping: got %q, want PONG", reply)
+	}
+	reply := dial(t, addr, selfPid+"|alice|standard")
+	rel, ok := strings.CutPrefix(reply, "OK ")
+	if !ok {
+		t.Fatalf("assignment: %s", reply)
+	}
+	if got := tree.read(t, filepath.Join(usersPath, rel, "cgroup.procs")); got != selfPid {
+		t.Errorf("cgroup.procs = %q, want %s", got, selfPid)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	if _, err := os.Stat(addr); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("socket still there after Shutdown: %v", err)
+	}
+	if conn, err := net.Dial(protocol, addr); err == nil {
+		conn.Close()
+		t.Error("dialing succeeded after Shutdown")
+	}
+}
+
+func TestSocketCreatedWithMode(t *testing.T) {
+	saved := socketMode
+	socketMode = 0600
+	t.Cleanup(func() { socketMode = saved })
+	umask := unix.Umask(0022)
+	defer unix.Umask(umask)
+
+	addr := filepath.Join(t.TempDir(), "pguard.sock")
+	listener, err := listenSocket(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	info, err := os.Stat(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode().Perm(); mode != socketMode {
+		t.Errorf("socket created with mode %04o, want %04o", mode, socketMode)
+	}
+	if restored := unix.Umask(0022); restored != 0022 {
+		t.Errorf("umask %04o after listening, want 0022 restored", restored)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// shutdownTimeout bounds how long shutdown waits for in-flight connections.
+const shutdownTimeout = 10 * time.Second
+
+// daemonCtx is cancelled when shutdown starts. Background loops started
+// outside of main, like the cleanup cycle of a promoted standby, stop on it.
+var daemonCtx = context.Background()
+
+// inFlight tracks the connections being handled.
+var inFlight sync.WaitGroup
+
+// setups tracks the running createCgroup calls of assignment requests.
+// Shutdown waits for them without a timeout, so a subgroup is either set up
+// completely or never created, and it refuses new ones once setupsClosed.
+var (
+	setupsMu     sync.Mutex
+	setupsClosed bool
+	setups       sync.WaitGroup
+)
+
+// beginSetup registers a cgroup setup about to start. It reports false once
+// shutdown has begun, the setup must not start then.
+func beginSetup() bool {
+	setupsMu.Lock()
+	defer setupsMu.Unlock()
+	if setupsClosed {
+		return false
+	}
+	setups.Add(1)
+	return true
+}
+
+// closeSetups refuses further setups and waits for the running ones.
+func closeSetups() {
+	setupsMu.Lock()
+	setupsClosed = true
+	setupsMu.Unlock()
+	setups.Wait()
+}
+
+// shutdown runs once the listener is closed: it waits for the connections
+// still being handled and the cgroup setups they started, sweeps the tree
+// with -cleanupOnExit, stops the cleanup cycle and the watcher and removes the
+// socket file.
+func shutdown(addr string) {
+	slog.Info("Shutting down", "address", addr)
+	done := make(chan struct{})
+	go func() {
+		inFlight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(shutdownTimeout):
+		slog.Warn("Connections still in flight at shutdown", "timeout", shutdownTimeout)
+	}
+	closeSetups()
+
+	if cleanupTicker != nil {
+		// Tearing the tree down on the way out is opt-in: a plain restart
+		// must not strip the limits of tenants that are still running.
+		if *cleanupOnExit {
+			scanned, removed := cleanupAllSubgroups(activeWatcher, "")
+			slog.Info("Cleaned up on exit", "scanned", scanned, "removed", removed)
+		}
+		cleanupTicker.Stop()
+	}
+	if activeWatcher != nil {
+		if err := activeWatcher.Close(); err != nil {
+			slog.Error("Failed to close watcher", "err", err)
+		}
+	}
+	if !isAbstractSocket(addr) {
+		if err := os.Remove(addr); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			slog.Error("Failed to remove socket", "address", addr, "err", err)
+		}
+	}
+	removePidfile()
+	slog.Info("Shutdown complete")
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/malumar/pguard/client"
+)
+
+// snapshotEntry describes one subgroup in the output of the snapshot command,
+// which is written as one JSON object per line.
+type snapshotEntry struct {
+	Path     string   `json:"path"`
+	User     string   `json:"user"`
+	Plan     string   `json:"plan"`
+	Priority string   `json:"priority"`
+	Pids     []string `json:"pids"`
+}
+
+var (
+	standbyMu sync.Mutex
+	// lastSnapshot is the state of the active pguard as last seen by a
+	// standby; it is nil once the standby has been promoted.
+	lastSnapshot []snapshotEntry
+	promoted     bool
+)
+
+// snapshotCommand lists every managed subgroup with its plan and processes.
+func snapshotCommand(conn net.Conn, _ []string) {
+	for _, entry := range takeSnapshot() {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			slog.Error("Failed to encode snapshot entry", "path", entry.Path, "err", err)
+			continue
+		}
+		reply(conn, "%s", line)
+	}
+}
+
+func takeSnapshot() []snapshotEntry {
+	var entries []snapshotEntry
+	walkSubgroups(func(user, dir string) {
+		plan, _ := getMeta(dir, metaPlan)
+		priority, _ := getMeta(dir, metaPriority)
+		entries = append(entries, snapshotEntry{
+			Path:     strings.TrimPrefix(dir, usersPath),
+			User:     user,
+			Plan:     plan,
+			Priority: priority,
+			Pids:     readPids(dir),
+		})
+	})
+	return entries
+}
+
+// readPids returns the processes listed in the cgroup.procs of dir.
+func readPids(dir string) []string {
+	content, err := os.ReadFile(filepath.Join(dir, "cgroup.procs"))
+	if err != nil {
+		return nil
+	}
+	return strings.Fields(string(content))
+}
+
+// mirrorActive keeps a standby in sync with the active pguard until it is
+// promoted: every -standbyInterval it pulls the snapshot and creates the user
+// slices the active one has, so they are ready on failover. No process is
+// moved and the cleanup cycle doesn't run on a standby.
+func mirrorActive(addr string) {
+	for {
+		standbyMu.Lock()
+		if promoted {
+			standbyMu.Unlock()
+			return
+		}
+		standbyMu.Unlock()
+
+		entries, err := fetchSnapshot(addr)
+		if err != nil {
+			slog.Error("Failed to fetch snapshot from active pguard", "addr", addr, "err", err)
+		} else {
+			mirrorSlices(entries)
+		}
+		time.Sleep(*standbyInterval)
+	}
+}
+
+func fetchSnapshot(addr string) ([]snapshotEntry, error) {
+	conn, err := net.DialTimeout(protocol, addr, connectionDeadLineInSeconds*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(*standbyInterval)); err != nil {
+		return nil, err
+	}
+	if _, err := fmt.Fprintln(conn, "snapshot"); err != nil {
+		return nil, err
+	}
+
+	var entries []snapshotEntry
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		if strings.HasPrefix(scanner.Text(), "ERR") {
+			return nil, fmt.Errorf("active pguard answered %q", scanner.Text())
+		}
+		var entry snapshotEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+func mirrorSlices(entries []snapshotEntry) {
+	standbyMu.Lock()
+	defer standbyMu.Unlock()
+	if promoted {
+		return
+	}
+	lastSnapshot = entries
+	mirrored := make(map[string]bool)
+	for _, entry := range entries {
+		if !validUsername(entry.User) || mirrored[entry.User] {
+			continue
+		}
+		mirrored[entry.User] = true
+		config, _ := getPlanConfig(entry.Plan)
+		if err := setupSlice(fmt.Sprintf("%s%s.slice/", usersPath, entry.User), config); err != nil {
+			slog.Error("Failed to mirror user slice", "user", entry.User, "err", err)
+		}
+	}
+	slog.Debug("Mirrored active pguard", "subgroups", len(entries))
+}
+
+// promoteCommand turns a standby into the active pguard: mirroring stops, the
+// processes of the last snapshot that exist on this host are placed with their
+// recorded plans and the cleanup cycle starts. Shutdown waits for the import
+// to finish, and a promotion is refused once shutdown has begun.
+func promoteCommand(conn net.Conn, _ []string) {
+	standbyMu.Lock()
+	if *standbyOf == "" || promoted {
+		standbyMu.Unlock()
+		reply(conn, "ERR %s not a standby", client.CodeRejected)
+		return
+	}
+	if !beginSetup() {
+		standbyMu.Unlock()
+		reply(conn, "ERR %s shutting down", client.CodeUnavailable)
+		return
+	}
+	defer setups.Done()
+	promoted = true
+	entries := lastSnapshot
+	lastSnapshot = nil
+	standbyMu.Unlock()
+
+	imported := 0
+	for _, entry := range entries {
+		if !validUsername(entry.User) {
+			continue
+		}
+		for _, pid := range entry.Pids {
+			if !processAlive(pid) {
+				continue
+			}
+			priority := entry.Priority
+			if _, ok := priorityWeightFactor[priority]; !ok {
+				priority = priorityNormal
+			}
+			slice := fmt.Sprintf("%s%s.slice/", usersPath, entry.User)
+			if _, err := createCgroup(slog.Default(), slice, entry.Plan, []string{pid}, priority); err == nil {
+				imported++
+			}
+		}
+	}
+	setupWatcher()
+	slog.Info("Promoted to active", "subgroups", len(entries), "imported", imported)
+	reply(conn, "promoted subgroups=%d imported=%d", len(entries), imported)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// errTooManySubgroups is returned for a request of a user whose slice already
+// has -max-subgroups-per-user subgroups.
+var errTooManySubgroups = errors.New("too many subgroups")
+
+var (
+	// maxSubgroupsPerUser bounds the subgroups of one user slice, 0 means no
+	// limit.
+	maxSubgroupsPerUser int
+
+	// subgroupCounts caches the number of subgroups per user slice, so a
+	// request doesn't list the slice. A slice whose subgroups were removed is
+	// dropped and counted again by the next request.
+	subgroupCountsMu sync.Mutex
+	subgroupCounts   = make(map[string]int)
+)
+
+// reserveSubgroup counts a subgroup about to be created in slice. It fails
+// with errTooManySubgroups when the slice is at the limit.
+func reserveSubgroup(slice string) error {
+	if maxSubgroupsPerUser <= 0 {
+		return nil
+	}
+	slice = filepath.Clean(slice)
+	subgroupCountsMu.Lock()
+	defer subgroupCountsMu.Unlock()
+	count, ok := subgroupCounts[slice]
+	if !ok {
+		count = sliceSubgroups(slice)
+	}
+	if count >= maxSubgroupsPerUser {
+		subgroupCounts[slice] = count
+		return errTooManySubgroups
+	}
+	subgroupCounts[slice] = count + 1
+	return nil
+}
+
+// forgetSubgroupCount drops the cached count of slice after its subgroups
+// changed other than by a successful createCgroup.
+func forgetSubgroupCount(slice string) {
+	subgroupCountsMu.Lock()
+	delete(subgroupCounts, filepath.Clean(slice))
+	subgroupCountsMu.Unlock()
+}
+
+// claimEmptySubgroup looks for an empty subgroup of slice created for the same
+// plan and priority, so a reconnecting client doesn't leave one more directory
+// behind for the cleanup. The subgroup found is marked as being created, the
+// caller ends that with endCreating; "" means there is none and a new one has
+// to be created. Subgroups of other plans are never reused, a plan leaving a
+// limit unset would inherit the value written for another one, and neither are
+// those left with thread cgroups, which can't take a process.
+func claimEmptySubgroup(slice, plan, priority string) string {
+	entries, err := os.ReadDir(slice)
+	if err != nil {
+		return ""
+	}
+	for _, entry := range entries {
+		subDir := slice + entry.Name()
+		if !entry.IsDir() || isAdopted(subDir) || layout.populated(subDir) || hasThreadCgroups(subDir) ||
+			metaValue(subDir, metaPlan) != plan || metaValue(subDir, metaPriority) != priority {
+			continue
+		}
+		// The sweep removes subgroups with creatingMu held, checking again
+		// under it tells whether this one is still there and unused.
+		creatingMu.Lock()
+		_, err := os.Stat(subDir)
+		if err == nil && !isCreating(subDir) && !layout.populated(subDir) {
+			creating[filepath.Clean(subDir)]++
+			creatingMu.Unlock()
+			return subDir
+		}
+		creatingMu.Unlock()
+	}
+	return ""
+}
+
+// sliceSubgroups returns the number of subgroups in slice.
+func sliceSubgroups(slice string) int {
+	entries, err := os.ReadDir(slice)
+	if err != nil {
+		return 0
+	}
+	count := 0
+	for _, entry := range entries {
+		if entry.IsDir() {
+			count++
+		}
+	}
+	return count
+}
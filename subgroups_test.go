@@ -0,0 +1,81 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// limitSubgroups sets -max-subgroups-per-user for the test.
+func limitSubgroups(t *testing.T, max int) {
+	saved := maxSubgroupsPerUser
+	maxSubgroupsPerUser = max
+	t.Cleanup(func() { maxSubgroupsPerUser = saved })
+}
+
+// refused reports whether user's next assignment is refused for having too
+// many subgroups.
+func refused(t *testing.T, user string) bool {
+	t.Helper()
+	return strings.HasPrefix(request(t, selfPid+"|"+user+"|standard"), "ERR rejected too many subgroups")
+}
+
+func TestAdoptCountsAgainstSubgroupLimit(t *testing.T) {
+	newTestTree(t)
+	limitSubgroups(t, 2)
+	assign(t, "alice", planStandard)
+	if err := cgroupFiles.Mkdir(usersPath+"alice.slice/job", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if reply := request(t, "adopt|alice.slice/job|standard"); !strings.HasPrefix(reply, "adopted ") {
+		t.Fatalf("adopt: %s", reply)
+	}
+	if !refused(t, "alice") {
+		t.Error("a third subgroup was created next to an adopted one with a limit of 2")
+	}
+}
+
+func TestRenameCountsMigratedSubgroups(t *testing.T) {
+	tree := newTestTree(t)
+	tree.moves = true
+	limitSubgroups(t, 2)
+	assign(t, "alice", planStandard)
+	// Another process, so that moving the test process leaves bob's
+	// subgroup populated instead of free for reuse.
+	placedPath(t, request(t, strconv.Itoa(os.Getppid())+"|bob|standard"))
+	if reply := request(t, "rename|alice|bob"); !strings.HasSuffix(reply, "renamed migrated=1 failed=0") {
+		t.Fatalf("rename: %s", reply)
+	}
+	if !refused(t, "bob") {
+		t.Error("a third subgroup was created next to a migrated one with a limit of 2")
+	}
+	if refused(t, "alice") {
+		t.Error("the renamed user is still counted with the subgroup it no longer has")
+	}
+}
+
+func TestEmptySubgroupReused(t *testing.T) {
+	tree := newTestTree(t)
+	first := assign(t, "alice", planStandard)
+	second := assign(t, "alice", planStandard)
+	if second == first {
+		t.Fatalf("the populated subgroup %s was handed out again", first)
+	}
+
+	tree.exit(t, first)
+	if again := assign(t, "alice", planStandard); again != first {
+		t.Errorf("assignment placed in %s, want the emptied %s reused", again, first)
+	}
+	if got := tree.read(t, first+"/cgroup.procs"); got != selfPid {
+		t.Errorf("reused subgroup cgroup.procs = %q, want %s", got, selfPid)
+	}
+
+	tree.exit(t, second)
+	if other := assign(t, "alice", planBusiness); other == second {
+		t.Errorf("the empty %s subgroup of another plan was reused", planStandard)
+	}
+	if n := sliceSubgroups(usersPath + "alice.slice/"); n != 3 {
+		t.Errorf("%d subgroups, want the two standard ones and a fresh business one", n)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// threadPrefix starts the name of the thread cgroup placeThread creates for a
+// thread in its process's subgroup, e.g. "thread-5678".
+const threadPrefix = "thread-"
+
+// isThreadCgroup reports whether name is that of a thread cgroup placeThread
+// creates.
+func isThreadCgroup(name string) bool {
+	tid, ok := strings.CutPrefix(name, threadPrefix)
+	return ok && validPid(tid)
+}
+
+// hasThreadCgroups reports whether placeThread created thread cgroups in
+// subDir. Such a subgroup is a threaded domain with threaded controllers
+// enabled for its children, so no process can be moved into it itself.
+func hasThreadCgroups(subDir string) bool {
+	threads, _ := filepath.Glob(filepath.Join(subDir, threadPrefix+"*"))
+	return len(threads) > 0
+}
+
+// threadedControllers are the controllers that work in threaded cgroups.
+// Memory and io account per process and stay with the subgroup.
+var threadedControllers = []string{"cpu", "cpuset", "pids", "perf_event"}
+
+// checkThread checks that tid is a thread of pid, the only process of the
+// request, and that the layout has threaded cgroups.
+func checkThread(pids []string, tid string) error {
+	if _, ok := layout.(cgroupV1); ok {
+		return errors.New("thread placement needs cgroup v2")
+	}
+	if len(pids) != 1 {
+		return errors.New("a thread belongs to a single pid")
+	}
+	if !validPid(tid) {
+		return fmt.Errorf("invalid tid %s", tid)
+	}
+	if _, err := os.Stat(filepath.Join(procPath, pids[0], "task", tid)); err != nil {
+		return fmt.Errorf("tid %s is not a thread of pid %s", tid, pids[0])
+	}
+	return nil
+}
+
+// placeThread moves the thread tid of pid into a threaded cgroup of its own
+// with the CPU and pids limits of plan. The thread cgroup is created in the
+// user's subgroup that holds pid; a pid that isn't in one is assigned like a
+// normal request first, since a thread can only move within the subtree of
+// its process. The placement names the thread cgroup.
+func placeThread(logger *slog.Logger, slice, plan, pid, tid, priority string) (placement, error) {
+	var placed placement
+	if subDir := findSubgroup(slice, pid); subDir != "" {
+		config, ok := getPlanConfig(plan)
+		if !ok {
+			return placement{}, fmt.Errorf("%w %q", errUnknownPlan, plan)
+		}
+		config.CpuWeight = weightForPriority(config.CpuWeight, priority)
+		placed = placement{subDir: subDir, plan: resolvePlan(plan), config: config, pids: 1}
+	} else {
+		var err error
+		if placed, err = createCgroup(logger, slice, plan, []string{pid}, priority); err != nil {
+			return placement{}, err
+		}
+	}
+
+	subDir := placed.subDir
+	beginCreating(subDir)
+	defer endCreating(subDir)
+	threadDir := filepath.Join(subDir, threadPrefix+tid)
+	if !skipInDryRun("create", threadDir) {
+		if err := layout.mkdir(threadDir, 0755); err != nil && !errors.Is(err, fs.ErrExist) {
+			return placement{}, err
+		}
+	}
+	// The subgroup becomes the threaded domain of its thread cgroups. Only
+	// once one is threaded may threaded controllers be enabled in a
+	// subgroup that has processes.
+	if err := writeToFile(filepath.Join(threadDir, "cgroup.type"), "threaded"); err != nil {
+		return placement{}, err
+	}
+	if err := writeToFile(filepath.Join(subDir, "cgroup.subtree_control"), subtreeControl(threadedNeeded())); err != nil {
+		return placement{}, err
+	}
+
+	dir, err := openCgroupDir(threadDir)
+	if err != nil {
+		return placement{}, err
+	}
+	defer dir.Close()
+	if err := layout.applyLimits(dir, threadDir, threadLimits(placed.config)); err != nil {
+		return placement{}, err
+	}
+	if err := dir.write("cgroup.threads", tid); err != nil {
+		return placement{}, err
+	}
+	placed.subDir = threadDir
+	return placed, nil
+}
+
+// threadedNeeded returns the usable controllers that work in threaded
+// cgroups.
+func threadedNeeded() []string {
+	var controllers []string
+	for _, controller := range usableControllers() {
+		if slices.Contains(threadedControllers, controller) {
+			controllers = append(controllers, controller)
+		}
+	}
+	return controllers
+}
+
+// threadLimits keeps the limits of config a threaded cgroup has files for.
+func threadLimits(config PlanConfig) PlanConfig {
+	return PlanConfig{
+		CpuMax:    config.CpuMax,
+		CpuBurst:  config.CpuBurst,
+		CpuIdle:   config.CpuIdle,
+		CpuWeight: config.CpuWeight,
+		PidsMax:   config.PidsMax,
+	}
+}
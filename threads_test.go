@@ -0,0 +1,54 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// assignThread assigns the main thread of the test process to user alone and
+// returns the thread cgroup it was placed in.
+func assignThread(t *testing.T, user string) string {
+	t.Helper()
+	threadDir := placedPath(t, request(t, selfPid+"|"+user+"|standard|||"+selfPid))
+	if !strings.HasPrefix(filepath.Base(threadDir), threadPrefix) {
+		t.Fatalf("placed in %s, want a thread cgroup", threadDir)
+	}
+	return threadDir
+}
+
+func TestRemoveThreadCgroup(t *testing.T) {
+	tree := newTestTree(t)
+	threadDir := assignThread(t, "alice")
+	subDir := filepath.Dir(threadDir)
+	rel := strings.TrimPrefix(threadDir, usersPath)
+
+	if reply := request(t, "remove|"+rel+"|force"); !strings.HasPrefix(reply, "ERR rejected ") {
+		t.Errorf("force removal of a thread cgroup: %s", reply)
+	}
+	if reply := request(t, "remove|"+rel); !strings.HasPrefix(reply, "ERR rejected ") {
+		t.Errorf("removal of a thread cgroup with its thread: %s", reply)
+	}
+	tree.exit(t, threadDir)
+	if reply := request(t, "remove|"+rel); reply != "removed "+rel {
+		t.Errorf("removal of an emptied thread cgroup: %s", reply)
+	}
+	if tree.exists(threadDir) || !tree.exists(subDir) {
+		t.Errorf("thread cgroup there %v, subgroup there %v; want only the subgroup left", tree.exists(threadDir), tree.exists(subDir))
+	}
+	if reply := request(t, "remove|"+strings.TrimPrefix(subDir, usersPath)+"/thread-x"); !strings.HasPrefix(reply, "ERR bad-request ") {
+		t.Errorf("removal of a thread cgroup without a tid: %s", reply)
+	}
+}
+
+func TestSubgroupWithThreadCgroupsNotReused(t *testing.T) {
+	tree := newTestTree(t)
+	threadDir := assignThread(t, "alice")
+	subDir := filepath.Dir(threadDir)
+	tree.exit(t, threadDir)
+	tree.exit(t, subDir)
+
+	if reused := assign(t, "alice", planStandard); reused == subDir {
+		t.Errorf("the emptied subgroup %s with a thread cgroup left in it was reused", subDir)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/glottis/inotify"
+)
+
+// inotify doesn't tell which paths it watches, so every watch pguard adds or
+// removes goes through addWatch/removeWatch, which keep the registry below.
+var (
+	watchedMu sync.Mutex
+	watched   = make(map[string]struct{})
+)
+
+func addWatch(watcher *inotify.Watcher, path string) error {
+	if err := watcher.Add(path); err != nil {
+		return err
+	}
+	watchedMu.Lock()
+	watched[path] = struct{}{}
+	watchedMu.Unlock()
+	slog.Debug("Watch added", "path", path)
+	return nil
+}
+
+// removeWatch removes the watch of path. Paths that were never watched, like
+// the user slices the sweep removes, are ignored.
+func removeWatch(watcher *inotify.Watcher, path string) error {
+	watchedMu.Lock()
+	_, ok := watched[path]
+	delete(watched, path)
+	watchedMu.Unlock()
+	if !ok {
+		return nil
+	}
+	return watcher.Remove(path)
+}
+
+// watchExisting watches usersPath and the subgroups already below it, e.g. the
+// ones left by a previous run, so that they are removed once empty like the
+// ones created from now on.
+func watchExisting(watcher *inotify.Watcher) {
+	if err := addWatch(watcher, filepath.Clean(usersPath)); err != nil {
+		slog.Error("Failed to watch", "path", usersPath, "err", err)
+		return
+	}
+	entries, err := os.ReadDir(usersPath)
+	if err != nil {
+		slog.Error("Failed to read directory", "dir", usersPath, "err", err)
+		return
+	}
+	for _, slice := range entries {
+		if !slice.IsDir() {
+			continue
+		}
+		dir := filepath.Join(usersPath, slice.Name())
+		subgroups, err := os.ReadDir(dir)
+		if err != nil {
+			slog.Error("Failed to read directory", "dir", dir, "err", err)
+			continue
+		}
+		for _, subgroup := range subgroups {
+			if !subgroup.IsDir() {
+				continue
+			}
+			path := filepath.Join(dir, subgroup.Name())
+			if err := addWatch(watcher, path); err != nil {
+				slog.Error("Failed to watch subgroup", "path", path, "err", err)
+			}
+		}
+	}
+}
+
+// reconcileWatches drops the watches of paths that no longer exist, removed
+// by someone else or while pguard wasn't looking, and reports how many it
+// dropped. The kernel removes a watch with its directory but the watcher
+// would keep its descriptor otherwise.
+func reconcileWatches(watcher *inotify.Watcher) int {
+	dropped := 0
+	for _, path := range watchedPaths() {
+		if _, err := os.Stat(path); !errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err := removeWatch(watcher, path); err != nil {
+			slog.Debug("Stale watch already gone", "path", path, "err", err)
+		}
+		dropped++
+	}
+	return dropped
+}
+
+// watchCount returns the number of watched paths.
+func watchCount() int {
+	watchedMu.Lock()
+	defer watchedMu.Unlock()
+	return len(watched)
+}
+
+// watchedPaths returns the watched paths in lexical order.
+func watchedPaths() []string {
+	watchedMu.Lock()
+	defer watchedMu.Unlock()
+	paths := make([]string, 0, len(watched))
+	for path := range watched {
+		paths = append(paths, path)
+	}
+	slices.Sort(paths)
+	return paths
+}
+
+// watchesCommand lists the paths the inotify watcher currently watches, one
+// per line, followed by their count.
+func watchesCommand(conn net.Conn, _ []string) {
+	paths := watchedPaths()
+	for _, path := range paths {
+		reply(conn, "%s", strings.TrimPrefix(path, usersPath))
+	}
+	reply(conn, "watches=%d", len(paths))
+}
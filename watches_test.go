@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/glottis/inotify"
+)
+
+// waitFor polls cond until it holds or timeout passes and reports whether it
+// held.
+func waitFor(timeout time.Duration, cond func() bool) bool {
+	for deadline := time.Now().Add(timeout); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if cond() {
+			return true
+		}
+	}
+	return cond()
+}
+
+func TestWatcherOutlivesStartup(t *testing.T) {
+	tree := newTestTree(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	savedCtx := daemonCtx
+	daemonCtx = ctx
+	t.Cleanup(func() { daemonCtx = savedCtx })
+
+	setupWatcher()
+	watcher := activeWatcher
+	if watcher == nil {
+		t.Fatal("setupWatcher didn't start a watcher")
+	}
+	server, addr := startTestServer(t)
+
+	// The subgroup is created and emptied after startup returned, so only a
+	// watcher still running can remove it before the next sweep.
+	reply := dial(t, addr, selfPid+"|alice|standard")
+	rel, ok := strings.CutPrefix(reply, "OK ")
+	if !ok {
+		t.Fatalf("assignment: %s", reply)
+	}
+	subDir := filepath.Join(usersPath, rel)
+	tree.exit(t, subDir)
+	if !waitFor(2*time.Second, func() bool { return !tree.exists(subDir) }) {
+		t.Fatal("the emptied subgroup wasn't removed by the watcher")
+	}
+
+	if err := server.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := watcher.Add(usersPath); err == nil {
+		t.Error("the watcher is still open after Shutdown")
+	}
+	if _, open := <-watcher.Events; open {
+		t.Error("the watcher still delivers events after Shutdown")
+	}
+}
+
+func TestHandleEventRemovesEmptiedSubgroup(t *testing.T) {
+	tree := newTestTree(t)
+	idle := assign(t, "alice", planStandard)
+	busy := assign(t, "alice", planStandard)
+	tree.exit(t, idle)
+	outside := filepath.Join(delegatedRoot, "system.slice")
+	if err := tree.Mkdir(outside, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// Events that aren't a write of an emptied subgroup's cgroup.events
+	// leave everything in place.
+	for _, event := range []inotify.Event{
+		{Name: filepath.Join(idle, "cgroup.events"), Op: inotify.Create},
+		{Name: filepath.Join(idle, "cgroup.procs"), Op: inotify.Write},
+		{Name: filepath.Join(busy, "cgroup.events"), Op: inotify.Write},
+		{Name: filepath.Join(outside, "cgroup.events"), Op: inotify.Write},
+	} {
+		handleEvent(event, nil)
+	}
+	for _, dir := range []string{idle, busy, outside} {
+		if !tree.exists(dir) {
+			t.Fatalf("%s removed on an event that doesn't empty it", dir)
+		}
+	}
+
+	handleEvent(inotify.Event{Name: filepath.Join(idle, "cgroup.events"), Op: inotify.Write}, nil)
+	if tree.exists(idle) {
+		t.Error("the emptied subgroup is still there after its cgroup.events event")
+	}
+	if !tree.exists(busy) {
+		t.Error("the event removed the populated sibling too")
+	}
+}